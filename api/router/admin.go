@@ -0,0 +1,60 @@
+package router
+
+import (
+	"strconv"
+
+	"github.com/bwoff11/frens/service"
+	"github.com/gofiber/fiber/v2"
+)
+
+type AdminRepo struct {
+	Users   *service.UserService
+	Emoji   *service.EmojiService
+	MediaGC *service.MediaGCService
+
+	// Webhooks registers the instance webhooks
+	Webhooks *WebhooksRepo
+}
+
+func (ar *AdminRepo) addPrivateRoutes(rtr fiber.Router) {
+	grp := rtr.Group("/admin", ar.Users.RequireAdmin)
+	grp.Get("/media/gc", ar.getMediaGC)
+	grp.Post("/media/gc", ar.runMediaGC)
+	grp.Post("/emoji", ar.createEmoji)
+	grp.Delete("/emoji/:emojiID", ar.deleteEmoji)
+	ar.Webhooks.addRoutes(grp.Group("/webhooks"), true)
+}
+
+func (ar *AdminRepo) getMediaGC(c *fiber.Ctx) error {
+	return ar.MediaGC.Stats(c)
+}
+
+func (ar *AdminRepo) runMediaGC(c *fiber.Ctx) error {
+	var req RunMediaGCRequest
+	if err := c.QueryParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid query")
+	}
+
+	return ar.MediaGC.Run(c, req.DryRun)
+}
+
+func (ar *AdminRepo) createEmoji(c *fiber.Ctx) error {
+	var req CreateEmojiRequest
+	if err := c.BodyParser(&req); err != nil {
+		return err
+	}
+	if err := validate.Struct(req); err != nil {
+		return err
+	}
+
+	return ar.Emoji.Create(c, req.Shortcode, req.MediaID)
+}
+
+func (ar *AdminRepo) deleteEmoji(c *fiber.Ctx) error {
+	emojiID, err := strconv.ParseUint(c.Params("emojiID"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid emoji ID")
+	}
+
+	return ar.Emoji.Delete(c, uint32(emojiID))
+}
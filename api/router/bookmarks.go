@@ -13,10 +13,29 @@ type BookmarksRepo struct {
 
 func (br *BookmarksRepo) addPrivateRoutes(rtr fiber.Router) {
 	grp := rtr.Group("/bookmarks")
+	grp.Get("/", br.list)
+
+	// Before the bookmark routes, which would match the collections path
+	collections := grp.Group("/collections")
+	collections.Get("/", br.listCollections)
+	collections.Post("/", br.createCollection)
+	collections.Patch("/:collectionID", br.updateCollection)
+	collections.Delete("/:collectionID", br.deleteCollection)
+	collections.Get("/:collectionID/bookmarks", br.listCollection)
+
 	grp.Post("/:postID", br.bookmarkPost)
+	grp.Patch("/:postID", br.updateBookmark)
 	grp.Delete("/:postID", br.unbookmarkPost)
 }
 
+func (br *BookmarksRepo) list(c *fiber.Ctx) error {
+	page, err := parsePage(c)
+	if err != nil {
+		return err
+	}
+	return br.Service.List(c, page)
+}
+
 func (br *BookmarksRepo) bookmarkPost(c *fiber.Ctx) error {
 	postID, err := strconv.ParseUint(c.Params("postID"), 10, 32)
 	if err != nil {
@@ -34,3 +53,75 @@ func (br *BookmarksRepo) unbookmarkPost(c *fiber.Ctx) error {
 
 	return br.Service.UnbookmarkPost(c, uint32(postID))
 }
+
+func (br *BookmarksRepo) updateBookmark(c *fiber.Ctx) error {
+	postID, err := strconv.ParseUint(c.Params("postID"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid post ID")
+	}
+
+	var req UpdateBookmarkRequest
+	if err := c.BodyParser(&req); err != nil {
+		return err
+	}
+	if err := validate.Struct(req); err != nil {
+		return err
+	}
+
+	return br.Service.UpdateBookmark(c, uint32(postID), req.CollectionID, req.Note)
+}
+
+func (br *BookmarksRepo) listCollections(c *fiber.Ctx) error {
+	return br.Service.ListCollections(c)
+}
+
+func (br *BookmarksRepo) createCollection(c *fiber.Ctx) error {
+	var req CreateBookmarkCollectionRequest
+	if err := c.BodyParser(&req); err != nil {
+		return err
+	}
+	if err := validate.Struct(req); err != nil {
+		return err
+	}
+
+	return br.Service.CreateCollection(c, req.Name)
+}
+
+func (br *BookmarksRepo) updateCollection(c *fiber.Ctx) error {
+	collectionID, err := strconv.ParseUint(c.Params("collectionID"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid collection ID")
+	}
+
+	var req UpdateBookmarkCollectionRequest
+	if err := c.BodyParser(&req); err != nil {
+		return err
+	}
+	if err := validate.Struct(req); err != nil {
+		return err
+	}
+
+	return br.Service.UpdateCollection(c, uint32(collectionID), req.Name, req.Position)
+}
+
+func (br *BookmarksRepo) deleteCollection(c *fiber.Ctx) error {
+	collectionID, err := strconv.ParseUint(c.Params("collectionID"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid collection ID")
+	}
+
+	return br.Service.DeleteCollection(c, uint32(collectionID))
+}
+
+func (br *BookmarksRepo) listCollection(c *fiber.Ctx) error {
+	collectionID, err := strconv.ParseUint(c.Params("collectionID"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid collection ID")
+	}
+
+	page, err := parsePage(c)
+	if err != nil {
+		return err
+	}
+	return br.Service.ListCollection(c, uint32(collectionID), page)
+}
@@ -0,0 +1,57 @@
+package router
+
+import (
+	"github.com/bwoff11/frens/service"
+	"github.com/gofiber/fiber/v2"
+)
+
+type EmailRepo struct {
+	Service *service.EmailService
+}
+
+// Unsubscribe links are opened from emails, without a token
+func (er *EmailRepo) addPublicRoutes(rtr fiber.Router) {
+	rtr.Get("/email/unsubscribe", er.confirmUnsubscribe)
+	rtr.Post("/email/unsubscribe", er.unsubscribe)
+}
+
+func (er *EmailRepo) addPrivateRoutes(rtr fiber.Router) {
+	rtr.Get("/email/preferences", er.Service.GetPreferences)
+	rtr.Patch("/email/preferences", er.updatePreferences)
+}
+
+func (er *EmailRepo) updatePreferences(c *fiber.Ctx) error {
+	var req UpdateEmailPreferencesRequest
+	if err := c.BodyParser(&req); err != nil {
+		return err
+	}
+	if err := validate.Struct(req); err != nil {
+		return err
+	}
+
+	return er.Service.UpdatePreferences(c, service.EmailPreferenceChanges(req))
+}
+
+func (er *EmailRepo) confirmUnsubscribe(c *fiber.Ctx) error {
+	var req UnsubscribeRequest
+	if err := c.QueryParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid unsubscribe link")
+	}
+	if err := validate.Struct(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid unsubscribe link")
+	}
+
+	return er.Service.ConfirmUnsubscribe(c, req.User, req.List, req.Signature)
+}
+
+func (er *EmailRepo) unsubscribe(c *fiber.Ctx) error {
+	var req UnsubscribeRequest
+	if err := c.QueryParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid unsubscribe link")
+	}
+	if err := validate.Struct(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid unsubscribe link")
+	}
+
+	return er.Service.Unsubscribe(c, req.User, req.List, req.Signature)
+}
@@ -0,0 +1,19 @@
+package router
+
+import (
+	"github.com/bwoff11/frens/service"
+	"github.com/gofiber/fiber/v2"
+)
+
+type EmojiRepo struct {
+	Service *service.EmojiService
+}
+
+func (er *EmojiRepo) addPublicRoutes(rtr fiber.Router) {
+	grp := rtr.Group("/emoji")
+	grp.Get("/", er.list)
+}
+
+func (er *EmojiRepo) list(c *fiber.Ctx) error {
+	return er.Service.List(c)
+}
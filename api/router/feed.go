@@ -1,8 +1,6 @@
 package router
 
 import (
-	"strconv"
-
 	"github.com/bwoff11/frens/service"
 	"github.com/gofiber/fiber/v2"
 )
@@ -11,37 +9,39 @@ type FeedRepo struct {
 	Service *service.FeedService
 }
 
+// addPublicRoutes registers the feeds that can be read without logging in.
+// optionalAuth identifies the user when a token is sent anyway.
+func (fr *FeedRepo) addPublicRoutes(rtr fiber.Router, optionalAuth fiber.Handler) {
+	grp := rtr.Group("/feeds")
+	grp.Get("/explore", optionalAuth, fr.getExplore)
+}
+
 func (fr *FeedRepo) addPrivateRoutes(rtr fiber.Router) {
 	grp := rtr.Group("/feeds")
-	//grp.Get("/algorithmic", fr.getAlgorithmic)
-	grp.Get("/algorithmic", fr.getChronological) // placeholder
+	grp.Get("/algorithmic", fr.getAlgorithmic)
 	grp.Get("/chronological", fr.getChronological)
-	//grp.Get("/explore", fr.getExplore)
-	grp.Get("/explore", fr.getChronological) // placeholder
 }
 
 func (fr *FeedRepo) getChronological(c *fiber.Ctx) error {
-	var req ChronoFeedRequest
-
-	// Get the count parameter from the query string
-	count := c.Query("count", "0") // the second argument is a default value
-	countUint, err := strconv.ParseUint(count, 10, 8)
+	page, err := parsePage(c)
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).SendString("Invalid count parameter")
+		return err
 	}
-	req.Count = uint8(countUint)
+	return fr.Service.GetChronological(c, page)
+}
 
-	// Get the cursor parameter from the query string
-	cursor := c.Query("cursor", "0") // the second argument is a default value
-	cursorUint, err := strconv.ParseUint(cursor, 10, 32)
+func (fr *FeedRepo) getAlgorithmic(c *fiber.Ctx) error {
+	page, err := parsePage(c)
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).SendString("Invalid cursor parameter")
+		return err
 	}
-	req.Cursor = uint32(cursorUint)
+	return fr.Service.GetAlgorithmic(c, page)
+}
 
-	if err := validate.Struct(req); err != nil {
+func (fr *FeedRepo) getExplore(c *fiber.Ctx) error {
+	page, err := parsePage(c)
+	if err != nil {
 		return err
 	}
-
-	return fr.Service.GetChronological(c, req.Count, req.Cursor)
+	return fr.Service.GetExplore(c, page)
 }
@@ -0,0 +1,44 @@
+package router
+
+import (
+	"strconv"
+
+	"github.com/bwoff11/frens/service"
+	"github.com/gofiber/fiber/v2"
+)
+
+type FiltersRepo struct {
+	Service *service.FilterService
+}
+
+func (fr *FiltersRepo) addPrivateRoutes(rtr fiber.Router) {
+	grp := rtr.Group("/filters/keywords")
+	grp.Get("/", fr.list)
+	grp.Post("/", fr.create)
+	grp.Delete("/:filterID", fr.delete)
+}
+
+func (fr *FiltersRepo) list(c *fiber.Ctx) error {
+	return fr.Service.List(c)
+}
+
+func (fr *FiltersRepo) create(c *fiber.Ctx) error {
+	var req CreateKeywordFilterRequest
+	if err := c.BodyParser(&req); err != nil {
+		return err
+	}
+	if err := validate.Struct(req); err != nil {
+		return err
+	}
+
+	return fr.Service.Create(c, req.Keyword)
+}
+
+func (fr *FiltersRepo) delete(c *fiber.Ctx) error {
+	filterID, err := strconv.ParseUint(c.Params("filterID"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid filter ID")
+	}
+
+	return fr.Service.Delete(c, uint32(filterID))
+}
@@ -1,9 +1,36 @@
 package router
 
 import (
+	"strconv"
+
 	"github.com/bwoff11/frens/service"
+	"github.com/gofiber/fiber/v2"
 )
 
 type FollowsRepo struct {
 	Service *service.FollowService
 }
+
+func (fr *FollowsRepo) addPrivateRoutes(rtr fiber.Router) {
+	grp := rtr.Group("/follows")
+	grp.Post("/:userID", fr.follow)
+	grp.Delete("/:userID", fr.unfollow)
+}
+
+func (fr *FollowsRepo) follow(c *fiber.Ctx) error {
+	userID, err := strconv.ParseUint(c.Params("userID"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid user ID")
+	}
+
+	return fr.Service.Follow(c, uint32(userID))
+}
+
+func (fr *FollowsRepo) unfollow(c *fiber.Ctx) error {
+	userID, err := strconv.ParseUint(c.Params("userID"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid user ID")
+	}
+
+	return fr.Service.Unfollow(c, uint32(userID))
+}
@@ -1,9 +1,112 @@
 package router
 
 import (
+	"strconv"
+
 	"github.com/bwoff11/frens/service"
+	"github.com/gofiber/fiber/v2"
 )
 
 type MediaRepo struct {
 	Service *service.MediaService
 }
+
+// addPublicRoutes registers the routes serving files. Files of public media
+// can be downloaded without logging in, and signed URLs carry their own
+// authorization. optionalAuth identifies the user when a token is sent.
+func (mr *MediaRepo) addPublicRoutes(rtr fiber.Router, optionalAuth fiber.Handler) {
+	rtr.Get("/media/:mediaID/file", optionalAuth, mr.getFile)
+	rtr.Get("/files/*", mr.getSignedFile)
+}
+
+func (mr *MediaRepo) addPrivateRoutes(rtr fiber.Router) {
+	grp := rtr.Group("/media")
+	grp.Post("/", mr.Service.UploadLimiter, mr.upload)
+	grp.Get("/:mediaID", mr.get)
+	grp.Patch("/:mediaID", mr.update)
+	grp.Delete("/:mediaID", mr.delete)
+}
+
+func (mr *MediaRepo) upload(c *fiber.Ctx) error {
+	file, err := c.FormFile("file")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Missing file")
+	}
+
+	var req UploadMediaRequest
+	if err := c.BodyParser(&req); err != nil {
+		return err
+	}
+	if err := validate.Struct(req); err != nil {
+		return err
+	}
+
+	return mr.Service.Upload(c, file, req.Description, req.Sensitive)
+}
+
+func (mr *MediaRepo) get(c *fiber.Ctx) error {
+	mediaID, err := strconv.ParseUint(c.Params("mediaID"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid media ID")
+	}
+
+	return mr.Service.Get(c, uint32(mediaID))
+}
+
+func (mr *MediaRepo) getFile(c *fiber.Ctx) error {
+	mediaID, err := strconv.ParseUint(c.Params("mediaID"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid media ID")
+	}
+
+	var req MediaFileRequest
+	if err := c.QueryParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid query parameters")
+	}
+	if err := validate.Struct(req); err != nil {
+		return err
+	}
+	if req.Variant == "" {
+		req.Variant = "original"
+	}
+
+	return mr.Service.GetFile(c, uint32(mediaID), req.Variant)
+}
+
+func (mr *MediaRepo) delete(c *fiber.Ctx) error {
+	mediaID, err := strconv.ParseUint(c.Params("mediaID"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid media ID")
+	}
+
+	return mr.Service.Delete(c, uint32(mediaID))
+}
+
+func (mr *MediaRepo) update(c *fiber.Ctx) error {
+	mediaID, err := strconv.ParseUint(c.Params("mediaID"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid media ID")
+	}
+
+	var req UpdateMediaRequest
+	if err := c.BodyParser(&req); err != nil {
+		return err
+	}
+	if err := validate.Struct(req); err != nil {
+		return err
+	}
+
+	return mr.Service.Update(c, uint32(mediaID), req.Description, req.Sensitive)
+}
+
+func (mr *MediaRepo) getSignedFile(c *fiber.Ctx) error {
+	var req SignedFileRequest
+	if err := c.QueryParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid query")
+	}
+	if err := validate.Struct(req); err != nil {
+		return err
+	}
+
+	return mr.Service.GetSignedFile(c, c.Params("*"), req.Expires, req.Signature)
+}
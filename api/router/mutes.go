@@ -0,0 +1,41 @@
+package router
+
+import (
+	"strconv"
+
+	"github.com/bwoff11/frens/service"
+	"github.com/gofiber/fiber/v2"
+)
+
+type MutesRepo struct {
+	Service *service.MuteService
+}
+
+func (mr *MutesRepo) addPrivateRoutes(rtr fiber.Router) {
+	grp := rtr.Group("/mutes")
+	grp.Get("/", mr.list)
+	grp.Post("/:userID", mr.mute)
+	grp.Delete("/:userID", mr.unmute)
+}
+
+func (mr *MutesRepo) list(c *fiber.Ctx) error {
+	return mr.Service.List(c)
+}
+
+func (mr *MutesRepo) mute(c *fiber.Ctx) error {
+	userID, err := strconv.ParseUint(c.Params("userID"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid user ID")
+	}
+
+	return mr.Service.Mute(c, uint32(userID))
+}
+
+func (mr *MutesRepo) unmute(c *fiber.Ctx) error {
+	userID, err := strconv.ParseUint(c.Params("userID"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid user ID")
+	}
+
+	return mr.Service.Unmute(c, uint32(userID))
+}
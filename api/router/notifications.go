@@ -0,0 +1,44 @@
+package router
+
+import (
+	"github.com/bwoff11/frens/service"
+	"github.com/gofiber/fiber/v2"
+)
+
+type NotificationsRepo struct {
+	Service *service.NotificationService
+}
+
+func (nr *NotificationsRepo) addPrivateRoutes(rtr fiber.Router) {
+	grp := rtr.Group("/notifications")
+	grp.Get("/", nr.list)
+	grp.Post("/read", nr.markRead)
+}
+
+func (nr *NotificationsRepo) list(c *fiber.Ctx) error {
+	var req ListNotificationsRequest
+	if err := c.QueryParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid query parameters")
+	}
+	if err := validate.Struct(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+
+	page, err := parsePage(c)
+	if err != nil {
+		return err
+	}
+	return nr.Service.List(c, service.NotificationFilter{Kinds: req.Kinds, Unread: req.Unread}, page)
+}
+
+func (nr *NotificationsRepo) markRead(c *fiber.Ctx) error {
+	var req MarkNotificationsReadRequest
+	if err := c.BodyParser(&req); err != nil {
+		return err
+	}
+	if err := validate.Struct(req); err != nil {
+		return err
+	}
+
+	return nr.Service.MarkRead(c, req.IDs)
+}
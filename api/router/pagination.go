@@ -0,0 +1,18 @@
+package router
+
+import (
+	"github.com/bwoff11/frens/service"
+	"github.com/gofiber/fiber/v2"
+)
+
+// parsePage reads the pagination parameters shared by every list endpoint.
+func parsePage(c *fiber.Ctx) (service.Page, error) {
+	var req PageRequest
+	if err := c.QueryParser(&req); err != nil {
+		return service.Page{}, fiber.NewError(fiber.StatusBadRequest, "Invalid query parameters")
+	}
+	if err := validate.Struct(req); err != nil {
+		return service.Page{}, fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	return service.Page{Size: req.Count, Cursor: req.Cursor}, nil
+}
@@ -1,6 +1,8 @@
 package router
 
 import (
+	"strconv"
+
 	"github.com/bwoff11/frens/service"
 	"github.com/gofiber/fiber/v2"
 )
@@ -15,6 +17,9 @@ func (pr *PostsRepo) addPublicRoutes(rtr fiber.Router) {
 func (pr *PostsRepo) addPrivateRoutes(rtr fiber.Router) {
 	grp := rtr.Group("/posts")
 	grp.Post("/", pr.create)
+	grp.Post("/:postID/replies", pr.reply)
+	grp.Post("/:postID/reposts", pr.repost)
+	grp.Delete("/:postID", pr.delete)
 }
 
 func (pr *PostsRepo) create(c *fiber.Ctx) error {
@@ -25,5 +30,63 @@ func (pr *PostsRepo) create(c *fiber.Ctx) error {
 	if err := validate.Struct(req); err != nil {
 		return err
 	}
-	return pr.Service.Create(c, req.Text, req.Privacy)
+	return pr.Service.Create(c, service.NewPost{
+		Text:           req.Text,
+		Privacy:        req.Privacy,
+		ContentWarning: req.ContentWarning,
+		MediaIDs:       req.MediaIDs,
+	})
+}
+
+// reply creates a post answering the one in the path. Replies take the same
+// fields as posts.
+func (pr *PostsRepo) reply(c *fiber.Ctx) error {
+	postID, err := strconv.ParseUint(c.Params("postID"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid post ID")
+	}
+
+	var req CreatePostRequest
+	if err := c.BodyParser(&req); err != nil {
+		return err
+	}
+	if err := validate.Struct(req); err != nil {
+		return err
+	}
+	return pr.Service.Create(c, service.NewPost{
+		Text:           req.Text,
+		Privacy:        req.Privacy,
+		ContentWarning: req.ContentWarning,
+		ReplyToID:      uint32(postID),
+		MediaIDs:       req.MediaIDs,
+	})
+}
+
+func (pr *PostsRepo) repost(c *fiber.Ctx) error {
+	postID, err := strconv.ParseUint(c.Params("postID"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid post ID")
+	}
+
+	var req CreateRepostRequest
+	if err := c.BodyParser(&req); err != nil {
+		return err
+	}
+	if err := validate.Struct(req); err != nil {
+		return err
+	}
+	return pr.Service.Create(c, service.NewPost{
+		Text:       req.Text,
+		Privacy:    req.Privacy,
+		RepostOfID: uint32(postID),
+	})
+}
+
+func (pr *PostsRepo) delete(c *fiber.Ctx) error {
+	postID, err := strconv.ParseUint(c.Params("postID"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid post ID")
+	}
+
+	return pr.Service.Delete(c, uint32(postID))
 }
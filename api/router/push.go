@@ -0,0 +1,51 @@
+package router
+
+import (
+	"github.com/bwoff11/frens/pkg/webpush"
+	"github.com/bwoff11/frens/service"
+	"github.com/gofiber/fiber/v2"
+)
+
+type PushRepo struct {
+	Service *service.PushService
+}
+
+func (pr *PushRepo) addPublicRoutes(rtr fiber.Router) {
+	rtr.Get("/push/key", pr.Service.ServerKey)
+}
+
+func (pr *PushRepo) addPrivateRoutes(rtr fiber.Router) {
+	grp := rtr.Group("/push/subscription")
+	grp.Get("/", pr.Service.Get)
+	grp.Post("/", pr.subscribe)
+	grp.Patch("/", pr.updateAlerts)
+	grp.Delete("/", pr.Service.Unsubscribe)
+}
+
+func (pr *PushRepo) subscribe(c *fiber.Ctx) error {
+	var req PushSubscriptionRequest
+	if err := c.BodyParser(&req); err != nil {
+		return err
+	}
+	if err := validate.Struct(req); err != nil {
+		return err
+	}
+
+	return pr.Service.Subscribe(c, webpush.Subscription{
+		Endpoint: req.Endpoint,
+		P256dh:   req.Keys.P256dh,
+		Auth:     req.Keys.Auth,
+	}, service.PushAlertChanges(req.Alerts))
+}
+
+func (pr *PushRepo) updateAlerts(c *fiber.Ctx) error {
+	var req UpdatePushSubscriptionRequest
+	if err := c.BodyParser(&req); err != nil {
+		return err
+	}
+	if err := validate.Struct(req); err != nil {
+		return err
+	}
+
+	return pr.Service.UpdateAlerts(c, service.PushAlertChanges(req.Alerts))
+}
@@ -0,0 +1,53 @@
+package router
+
+import (
+	"strconv"
+
+	"github.com/bwoff11/frens/service"
+	"github.com/gofiber/fiber/v2"
+)
+
+type ReactionsRepo struct {
+	Service *service.ReactionService
+}
+
+func (rr *ReactionsRepo) addPrivateRoutes(rtr fiber.Router) {
+	grp := rtr.Group("/posts/:postID/reactions")
+	grp.Post("/", rr.react)
+	grp.Delete("/", rr.unreact)
+}
+
+func (rr *ReactionsRepo) react(c *fiber.Ctx) error {
+	postID, err := strconv.ParseUint(c.Params("postID"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid post ID")
+	}
+
+	var req ReactionRequest
+	if err := c.BodyParser(&req); err != nil {
+		return err
+	}
+	if err := validate.Struct(req); err != nil {
+		return err
+	}
+
+	return rr.Service.React(c, uint32(postID), req.Emoji)
+}
+
+// unreact takes the emoji from the query, since DELETE requests have no body.
+func (rr *ReactionsRepo) unreact(c *fiber.Ctx) error {
+	postID, err := strconv.ParseUint(c.Params("postID"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid post ID")
+	}
+
+	var req ReactionRequest
+	if err := c.QueryParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid query")
+	}
+	if err := validate.Struct(req); err != nil {
+		return err
+	}
+
+	return rr.Service.Unreact(c, uint32(postID), req.Emoji)
+}
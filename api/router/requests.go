@@ -11,12 +11,151 @@ type LoginRequest struct {
 	Password string `validate:"required,min=8"`
 }
 
+// CreatePostRequest creates a post. Posts need text unless they have media.
 type CreatePostRequest struct {
-	Text    string `validate:"required,min=1,max=1000"`
+	Text           string   `validate:"required_without=MediaIDs,max=1000"`
+	Privacy        string   `validate:"omitempty,oneof=public protected private"`
+	ContentWarning string   `validate:"omitempty,max=500"`
+	MediaIDs       []uint32 `validate:"omitempty,unique"`
+}
+
+// CreateRepostRequest reposts a post, optionally quoting it with text.
+type CreateRepostRequest struct {
+	Text    string `validate:"omitempty,max=1000"`
 	Privacy string `validate:"omitempty,oneof=public protected private"`
 }
 
-type ChronoFeedRequest struct {
-	Count  uint8  `validate:"omitempty,min=1,max=255"`
-	Cursor uint32 `validate:"omitempty"`
+// PageRequest holds the pagination parameters of list endpoints. Cursor is
+// the opaque value found in the links of a previous page.
+type PageRequest struct {
+	Count  int    `query:"count" validate:"omitempty,min=1,max=100"`
+	Cursor string `query:"cursor"`
+}
+
+type UpdateBookmarkRequest struct {
+	CollectionID *uint32 // Zero takes the bookmark out of its collection
+	Note         *string `validate:"omitempty,max=1000"`
+}
+
+type CreateBookmarkCollectionRequest struct {
+	Name string `validate:"required,max=100"`
+}
+
+type UpdateBookmarkCollectionRequest struct {
+	Name     *string `validate:"omitempty,min=1,max=100"`
+	Position *int    `validate:"omitempty,min=0"`
+}
+
+type CreateKeywordFilterRequest struct {
+	Keyword string `validate:"required,max=100"`
+}
+
+// ReactionRequest names a Unicode emoji, or a custom emoji by its shortcode
+// in colons.
+type ReactionRequest struct {
+	Emoji string `query:"emoji" validate:"required,max=64"`
+}
+
+type CreateEmojiRequest struct {
+	Shortcode string `validate:"required,min=2,max=32"`
+	MediaID   uint32 `validate:"required"`
+}
+
+type UpdateUserRequest struct {
+	LikesPrivacy *string `validate:"omitempty,oneof=public protected private"`
+}
+
+type MediaFileRequest struct {
+	Variant string `query:"variant" validate:"omitempty,oneof=thumbnail small original"`
+}
+
+type UploadMediaRequest struct {
+	Description string `form:"description" validate:"omitempty,max=1500"`
+	Sensitive   bool   `form:"sensitive"`
+}
+
+type UpdateMediaRequest struct {
+	Description *string `validate:"omitempty,max=1500"`
+	Sensitive   *bool
+}
+
+type RunMediaGCRequest struct {
+	DryRun bool `query:"dryRun"`
+}
+
+type SignedFileRequest struct {
+	Expires   string `query:"expires" validate:"required,numeric"`
+	Signature string `query:"signature" validate:"required,hexadecimal"`
+}
+
+// ListNotificationsRequest filters the notifications. Kinds is a comma
+// separated list.
+type ListNotificationsRequest struct {
+	Kinds  []string `query:"kinds" validate:"omitempty,max=6,dive,oneof=like reaction follow mention reply repost"`
+	Unread bool     `query:"unread"`
+}
+
+// MarkNotificationsReadRequest lists the notifications to mark as read, or
+// none to mark all of them.
+type MarkNotificationsReadRequest struct {
+	IDs []uint32 `validate:"omitempty,max=100"`
+}
+
+// StreamRequest lists the channels to stream, comma separated, like
+// home,hashtag:frens.
+type StreamRequest struct {
+	Channels []string `query:"channels" validate:"omitempty,dive,max=80"`
+}
+
+// PushSubscriptionRequest is a subscription as returned by
+// PushSubscription.toJSON() in the browser, with the alerts to change.
+type PushSubscriptionRequest struct {
+	Endpoint string `validate:"required,url,startswith=https://,max=2048"`
+	Keys     struct {
+		P256dh string `validate:"required,max=128"`
+		Auth   string `validate:"required,max=64"`
+	}
+	Alerts PushAlertsRequest
+}
+
+type UpdatePushSubscriptionRequest struct {
+	Alerts PushAlertsRequest
+}
+
+// PushAlertsRequest turns the kinds of notifications pushed on or off.
+// Kinds left out are unchanged.
+type PushAlertsRequest struct {
+	Like     *bool
+	Reaction *bool
+	Follow   *bool
+	Mention  *bool
+	Reply    *bool
+	Repost   *bool
+}
+
+// UpdateEmailPreferencesRequest changes which emails the user receives.
+// Fields left out are unchanged.
+type UpdateEmailPreferencesRequest struct {
+	Immediate *bool
+	Digest    *string `validate:"omitempty,oneof=off daily weekly"`
+}
+
+// UnsubscribeRequest is the query of an unsubscribe link from an email.
+type UnsubscribeRequest struct {
+	User      uint32 `query:"user" validate:"required"`
+	List      string `query:"list" validate:"required,oneof=immediate digest"`
+	Signature string `query:"signature" validate:"required,hexadecimal"`
+}
+
+// CreateWebhookRequest registers a webhook for the given event types.
+type CreateWebhookRequest struct {
+	URL    string   `validate:"required,url,startswith=https://|startswith=http://,max=2048"`
+	Events []string `validate:"required,min=1,max=5,dive,oneof=post.created post.liked post.reacted user.followed user.registered"`
+}
+
+// UpdateWebhookRequest changes a webhook. Fields left out are unchanged.
+type UpdateWebhookRequest struct {
+	URL    *string  `validate:"omitempty,url,startswith=https://|startswith=http://,max=2048"`
+	Events []string `validate:"omitempty,min=1,max=5,dive,oneof=post.created post.liked post.reacted user.followed user.registered"`
+	Active *bool
 }
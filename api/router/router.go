@@ -22,31 +22,56 @@ type Router struct {
 }
 
 type Repos struct {
-	Auth      *AuthRepo
-	Bookmarks *BookmarksRepo
-	Feed      *FeedRepo
-	Follows   *FollowsRepo
-	Likes     *LikesRepo
-	Media     *MediaRepo
-	Posts     *PostsRepo
-	Users     *UsersRepo
+	Admin         *AdminRepo
+	Auth          *AuthRepo
+	Bookmarks     *BookmarksRepo
+	Email         *EmailRepo
+	Emoji         *EmojiRepo
+	Feed          *FeedRepo
+	Filters       *FiltersRepo
+	Follows       *FollowsRepo
+	Likes         *LikesRepo
+	Media         *MediaRepo
+	Mutes         *MutesRepo
+	Notifications *NotificationsRepo
+	Posts         *PostsRepo
+	Push          *PushRepo
+	Reactions     *ReactionsRepo
+	Streaming     *StreamingRepo
+	Uploads       *UploadsRepo
+	Users         *UsersRepo
+	Webhooks      *WebhooksRepo
 }
 
 func New(service *service.Service, config *config.APIConfig) *Router {
-	app := fiber.New()
+	app := fiber.New(fiber.Config{
+		BodyLimit: config.BodyLimit,
+	})
 
+	webhooks := &WebhooksRepo{Service: service.Webhook}
 	router := &Router{
 		App:  app,
 		Port: config.Port,
 		Repos: Repos{
-			Auth:      &AuthRepo{Service: service.Auth},
-			Bookmarks: &BookmarksRepo{Service: service.Bookmark},
-			Feed:      &FeedRepo{Service: service.Feed},
-			Follows:   &FollowsRepo{Service: service.Follow},
-			Likes:     &LikesRepo{Service: service.Like},
-			Media:     &MediaRepo{Service: service.Media},
-			Posts:     &PostsRepo{Service: service.Post},
-			Users:     &UsersRepo{Service: service.User},
+			Admin:         &AdminRepo{Users: service.User, Emoji: service.Emoji, MediaGC: service.MediaGC, Webhooks: webhooks},
+			Auth:          &AuthRepo{Service: service.Auth},
+			Bookmarks:     &BookmarksRepo{Service: service.Bookmark},
+			Email:         &EmailRepo{Service: service.Email},
+			Emoji:         &EmojiRepo{Service: service.Emoji},
+			Feed:          &FeedRepo{Service: service.Feed},
+			Filters:       &FiltersRepo{Service: service.Filter},
+			Follows:       &FollowsRepo{Service: service.Follow},
+			Likes:         &LikesRepo{Service: service.Like},
+			Media:         &MediaRepo{Service: service.Media},
+			Mutes:         &MutesRepo{Service: service.Mute},
+			Notifications: &NotificationsRepo{Service: service.Notification},
+			Posts:         &PostsRepo{Service: service.Post},
+			Push:          &PushRepo{Service: service.Push},
+			Reactions:     &ReactionsRepo{Service: service.Reaction},
+			Streaming:     &StreamingRepo{Service: service.Stream},
+			Uploads:       &UploadsRepo{Service: service.Upload, Media: service.Media},
+			Users:         &UsersRepo{Service: service.User, Likes: service.Like, Media: service.Media},
+			Webhooks:      webhooks,
 		},
 		Token: struct {
 			Secret   []byte
@@ -60,6 +85,8 @@ func New(service *service.Service, config *config.APIConfig) *Router {
 	router.App.Use(cors.New(cors.Config{
 		AllowOrigins: "*",
 		AllowHeaders: "*",
+		// Resumable upload clients need to read the tus headers
+		ExposeHeaders: "Location, Tus-Resumable, Tus-Version, Tus-Max-Size, Tus-Extension, Upload-Offset, Upload-Length, Upload-Expires",
 	}))
 
 	addRoutes(router)
@@ -74,20 +101,53 @@ func (r *Router) Start() {
 
 func addRoutes(router *Router) {
 	v1 := router.App.Group("/v1")
+
+	// Public routes still identify the user if a token is sent
+	optionalAuth := jwtware.New(jwtware.Config{
+		SigningKey: jwtware.SigningKey{Key: router.Token.Secret},
+		Filter: func(c *fiber.Ctx) bool {
+			return c.Get(fiber.HeaderAuthorization) == ""
+		},
+	})
+
+	// Streams also take the token from the query, see StreamingRepo
+	streamAuth := jwtware.New(jwtware.Config{
+		SigningKey:  jwtware.SigningKey{Key: router.Token.Secret},
+		TokenLookup: "header:Authorization,query:access_token",
+		AuthScheme:  "Bearer",
+	})
+
 	router.Repos.Auth.addPublicRoutes(v1)
+	router.Repos.Email.addPublicRoutes(v1)
+	router.Repos.Emoji.addPublicRoutes(v1)
+	router.Repos.Feed.addPublicRoutes(v1, optionalAuth)
+	router.Repos.Media.addPublicRoutes(v1, optionalAuth)
+	router.Repos.Push.addPublicRoutes(v1)
+	router.Repos.Uploads.addPublicRoutes(v1)
+	router.Repos.Streaming.addPublicRoutes(v1, streamAuth)
+	router.Repos.Users.addPublicRoutes(v1, optionalAuth)
 
 	v1.Use(jwtware.New(jwtware.Config{
 		SigningKey: jwtware.SigningKey{Key: router.Token.Secret},
 	}))
 
+	router.Repos.Admin.addPrivateRoutes(v1)
 	router.Repos.Auth.addPrivateRoutes(v1)
 	router.Repos.Bookmarks.addPrivateRoutes(v1)
+	router.Repos.Email.addPrivateRoutes(v1)
 	router.Repos.Feed.addPrivateRoutes(v1)
-	//router.Repos.Follows.addPrivateRoutes(v1)
+	router.Repos.Filters.addPrivateRoutes(v1)
+	router.Repos.Follows.addPrivateRoutes(v1)
 	router.Repos.Likes.addPrivateRoutes(v1)
-	//router.Repos.Media.addPrivateRoutes(v1)
+	router.Repos.Uploads.addPrivateRoutes(v1) // Before the media routes they are nested in
+	router.Repos.Media.addPrivateRoutes(v1)
+	router.Repos.Mutes.addPrivateRoutes(v1)
+	router.Repos.Notifications.addPrivateRoutes(v1)
 	router.Repos.Posts.addPrivateRoutes(v1)
-	//router.Repos.Users.addPrivateRoutes(v1)
+	router.Repos.Push.addPrivateRoutes(v1)
+	router.Repos.Reactions.addPrivateRoutes(v1)
+	router.Repos.Users.addPrivateRoutes(v1)
+	router.Repos.Webhooks.addPrivateRoutes(v1)
 }
 
 /*
@@ -0,0 +1,30 @@
+package router
+
+import (
+	"github.com/bwoff11/frens/service"
+	"github.com/gofiber/fiber/v2"
+)
+
+type StreamingRepo struct {
+	Service *service.StreamService
+}
+
+// addPublicRoutes registers the streaming endpoint with its own
+// authentication, since browsers can't send headers when opening a
+// WebSocket or an event source. The token can also be passed in the
+// access_token query parameter.
+func (sr *StreamingRepo) addPublicRoutes(rtr fiber.Router, auth fiber.Handler) {
+	rtr.Get("/streaming", auth, sr.stream)
+}
+
+func (sr *StreamingRepo) stream(c *fiber.Ctx) error {
+	var req StreamRequest
+	if err := c.QueryParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid query parameters")
+	}
+	if err := validate.Struct(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+
+	return sr.Service.Stream(c, req.Channels)
+}
@@ -0,0 +1,118 @@
+package router
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/bwoff11/frens/service"
+	"github.com/gofiber/fiber/v2"
+)
+
+// UploadsRepo serves resumable uploads following the tus protocol, see
+// https://tus.io/protocols/resumable-upload.
+type UploadsRepo struct {
+	Service *service.UploadService
+	Media   *service.MediaService
+}
+
+func (ur *UploadsRepo) addPublicRoutes(rtr fiber.Router) {
+	// Clients discover the server's capabilities before logging in
+	rtr.Options("/media/uploads", ur.Service.Options)
+}
+
+func (ur *UploadsRepo) addPrivateRoutes(rtr fiber.Router) {
+	grp := rtr.Group("/media/uploads", tusResumable)
+	grp.Post("/", ur.Media.UploadLimiter, ur.create)
+	grp.Get("/:uploadID", ur.get)
+	grp.Head("/:uploadID", ur.head)
+	grp.Patch("/:uploadID", ur.append)
+	grp.Delete("/:uploadID", ur.terminate)
+}
+
+// tusResumable checks the protocol version of tus requests and adds it to
+// every response.
+func tusResumable(c *fiber.Ctx) error {
+	c.Set("Tus-Resumable", service.TusVersion)
+
+	// Reading the upload as JSON:API is not part of the protocol
+	if c.Method() == fiber.MethodGet {
+		return c.Next()
+	}
+
+	if c.Get("Tus-Resumable") != service.TusVersion {
+		c.Set("Tus-Version", service.TusVersion)
+		return c.Status(fiber.StatusPreconditionFailed).SendString("Unsupported tus version")
+	}
+	return c.Next()
+}
+
+func (ur *UploadsRepo) create(c *fiber.Ctx) error {
+	length, err := strconv.ParseInt(c.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 1 {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid Upload-Length")
+	}
+
+	metadata, err := parseUploadMetadata(c.Get("Upload-Metadata"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid Upload-Metadata")
+	}
+	req := UploadMediaRequest{
+		Description: metadata["description"],
+		Sensitive:   metadata["sensitive"] == "true",
+	}
+	if err := validate.Struct(req); err != nil {
+		return err
+	}
+
+	return ur.Service.Create(c, length, req.Description, req.Sensitive)
+}
+
+func (ur *UploadsRepo) get(c *fiber.Ctx) error {
+	return ur.Service.Get(c, c.Params("uploadID"))
+}
+
+func (ur *UploadsRepo) head(c *fiber.Ctx) error {
+	return ur.Service.Head(c, c.Params("uploadID"))
+}
+
+func (ur *UploadsRepo) append(c *fiber.Ctx) error {
+	if c.Get(fiber.HeaderContentType) != "application/offset+octet-stream" {
+		return c.Status(fiber.StatusUnsupportedMediaType).SendString("Chunks must be application/offset+octet-stream")
+	}
+
+	offset, err := strconv.ParseInt(c.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid Upload-Offset")
+	}
+
+	return ur.Service.Append(c, c.Params("uploadID"), offset, c.Body())
+}
+
+func (ur *UploadsRepo) terminate(c *fiber.Ctx) error {
+	return ur.Service.Terminate(c, c.Params("uploadID"))
+}
+
+// parseUploadMetadata decodes an Upload-Metadata header, a comma separated
+// list of keys each followed by a space and its base64 encoded value. The
+// value may be left out.
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("empty metadata key")
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, err
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
@@ -1,9 +1,56 @@
 package router
 
 import (
+	"strconv"
+
 	"github.com/bwoff11/frens/service"
+	"github.com/gofiber/fiber/v2"
 )
 
 type UsersRepo struct {
 	Service *service.UserService
+	Likes   *service.LikeService
+	Media   *service.MediaService
+}
+
+// addPublicRoutes registers the user routes that can be used without logging
+// in. optionalAuth identifies the user when a token is sent anyway.
+func (ur *UsersRepo) addPublicRoutes(rtr fiber.Router, optionalAuth fiber.Handler) {
+	grp := rtr.Group("/users")
+	grp.Get("/:userID/likes", optionalAuth, ur.getLikes)
+}
+
+func (ur *UsersRepo) addPrivateRoutes(rtr fiber.Router) {
+	grp := rtr.Group("/users")
+	grp.Patch("/me", ur.updateMe)
+	grp.Get("/me/storage", ur.getStorage)
+}
+
+func (ur *UsersRepo) updateMe(c *fiber.Ctx) error {
+	var req UpdateUserRequest
+	if err := c.BodyParser(&req); err != nil {
+		return err
+	}
+	if err := validate.Struct(req); err != nil {
+		return err
+	}
+
+	return ur.Service.UpdateMe(c, req.LikesPrivacy)
+}
+
+func (ur *UsersRepo) getStorage(c *fiber.Ctx) error {
+	return ur.Media.GetStorage(c)
+}
+
+func (ur *UsersRepo) getLikes(c *fiber.Ctx) error {
+	userID, err := strconv.ParseUint(c.Params("userID"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid user ID")
+	}
+
+	page, err := parsePage(c)
+	if err != nil {
+		return err
+	}
+	return ur.Likes.ListByUser(c, uint32(userID), page)
 }
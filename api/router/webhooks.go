@@ -0,0 +1,77 @@
+package router
+
+import (
+	"strconv"
+
+	"github.com/bwoff11/frens/service"
+	"github.com/gofiber/fiber/v2"
+)
+
+type WebhooksRepo struct {
+	Service *service.WebhookService
+}
+
+func (wr *WebhooksRepo) addPrivateRoutes(rtr fiber.Router) {
+	wr.addRoutes(rtr.Group("/webhooks"), false)
+}
+
+// addRoutes registers the webhook routes on the group. The same routes
+// manage the instance webhooks under the admin routes.
+func (wr *WebhooksRepo) addRoutes(grp fiber.Router, instance bool) {
+	grp.Get("/", func(c *fiber.Ctx) error { return wr.Service.List(c, instance) })
+	grp.Post("/", func(c *fiber.Ctx) error { return wr.create(c, instance) })
+	grp.Patch("/:webhookID", func(c *fiber.Ctx) error { return wr.update(c, instance) })
+	grp.Delete("/:webhookID", func(c *fiber.Ctx) error { return wr.delete(c, instance) })
+	grp.Get("/:webhookID/deliveries", func(c *fiber.Ctx) error { return wr.deliveries(c, instance) })
+}
+
+func (wr *WebhooksRepo) create(c *fiber.Ctx, instance bool) error {
+	var req CreateWebhookRequest
+	if err := c.BodyParser(&req); err != nil {
+		return err
+	}
+	if err := validate.Struct(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+
+	return wr.Service.Create(c, instance, req.URL, req.Events)
+}
+
+func (wr *WebhooksRepo) update(c *fiber.Ctx, instance bool) error {
+	webhookID, err := strconv.ParseUint(c.Params("webhookID"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid webhook ID")
+	}
+
+	var req UpdateWebhookRequest
+	if err := c.BodyParser(&req); err != nil {
+		return err
+	}
+	if err := validate.Struct(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+
+	return wr.Service.Update(c, instance, uint32(webhookID), service.WebhookChanges(req))
+}
+
+func (wr *WebhooksRepo) delete(c *fiber.Ctx, instance bool) error {
+	webhookID, err := strconv.ParseUint(c.Params("webhookID"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid webhook ID")
+	}
+
+	return wr.Service.Delete(c, instance, uint32(webhookID))
+}
+
+func (wr *WebhooksRepo) deliveries(c *fiber.Ctx, instance bool) error {
+	webhookID, err := strconv.ParseUint(c.Params("webhookID"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid webhook ID")
+	}
+
+	page, err := parsePage(c)
+	if err != nil {
+		return err
+	}
+	return wr.Service.Deliveries(c, instance, uint32(webhookID), page)
+}
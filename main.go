@@ -32,7 +32,11 @@ func main() {
 		panic(err)
 	}
 
-	service := service.New(db, &config.API)
+	service, err := service.New(db, config)
+	if err != nil {
+		panic(err)
+	}
+	service.Start()
 
 	router := router.New(service, &config.API)
 	router.Start()
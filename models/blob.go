@@ -0,0 +1,29 @@
+package models
+
+import "time"
+
+// Blob is a stored upload shared by all media with the same content. It is
+// addressed by the SHA-256 of the uploaded bytes, and its variants are
+// deleted from storage once no media references it anymore.
+type Blob struct {
+	Hash        string `gorm:"primary_key"` // Hex encoded SHA-256
+	CreatedAt   time.Time
+	ContentType string `gorm:"not null"`
+	Size        int64  `gorm:"not null"`
+	Width       int
+	Height      int
+	Blurhash    string
+	Kind        string  `gorm:"not null;default:'image'"`
+	Duration    float64 // Seconds of video and audio
+	RefCount    int     `gorm:"not null;default:0"`
+}
+
+// Key is the storage key prefix of the blob's variants.
+func (b *Blob) Key() string {
+	return "blobs/" + b.Hash
+}
+
+// VariantKey is the storage key of one of the blob's variants.
+func (b *Blob) VariantKey(variant string) string {
+	return b.Key() + "/" + variant
+}
@@ -10,4 +10,8 @@ type Bookmark struct {
 	User      *User     `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE" jsonapi:"relation,user"`
 	PostID    uint32    `gorm:"not null"`
 	Post      *Post     `gorm:"foreignKey:PostID;constraint:OnDelete:CASCADE" jsonapi:"relation,post"`
+
+	// CollectionID is nil for bookmarks that are not in a collection
+	CollectionID *uint32 `gorm:"index" jsonapi:"attr,collectionID,omitempty"`
+	Note         string  `gorm:"type:text;not null;default:''" jsonapi:"attr,note"` // Only shown to the owner
 }
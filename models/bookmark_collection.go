@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+// BookmarkCollection is a named group of a user's bookmarks. Collections are
+// shown in the order of their Position, starting at zero.
+type BookmarkCollection struct {
+	ID        uint32    `gorm:"primary_key;auto_increment" jsonapi:"primary,bookmark-collection"`
+	CreatedAt time.Time `jsonapi:"attr,createdAt"`
+	UpdatedAt time.Time `jsonapi:"attr,updatedAt"`
+	UserID    uint32    `gorm:"not null;index"`
+	Name      string    `gorm:"not null" jsonapi:"attr,name"`
+	Position  int       `gorm:"not null;default:0" jsonapi:"attr,position"`
+}
@@ -0,0 +1,27 @@
+package models
+
+import "time"
+
+// CustomEmoji is an instance specific emoji that can be used in reactions by
+// its shortcode. Its image is an uploaded media item, which is public once
+// the emoji is created.
+type CustomEmoji struct {
+	ID        uint32    `gorm:"primary_key;auto_increment" jsonapi:"primary,custom-emoji"`
+	CreatedAt time.Time `jsonapi:"attr,createdAt"`
+	UpdatedAt time.Time `jsonapi:"attr,updatedAt"`
+	Shortcode string    `gorm:"not null;unique" jsonapi:"attr,shortcode"` // Without the colons
+	MediaID   uint32    `gorm:"not null;index" jsonapi:"attr,mediaID"`
+	URL       string    `gorm:"-" jsonapi:"attr,url"`
+}
+
+// AfterFind sets the URL of emoji loaded from the database.
+func (e *CustomEmoji) AfterFind() error {
+	e.URL = MediaURL(e.MediaID, "small")
+	return nil
+}
+
+// AfterCreate sets the URL of newly created emoji.
+func (e *CustomEmoji) AfterCreate() error {
+	e.URL = MediaURL(e.MediaID, "small")
+	return nil
+}
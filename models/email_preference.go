@@ -0,0 +1,30 @@
+package models
+
+import "time"
+
+// Email digest frequencies.
+const (
+	DigestOff    = "off"
+	DigestDaily  = "daily"
+	DigestWeekly = "weekly"
+)
+
+// EmailPreference is which emails a user receives. Users without one get no
+// emails.
+type EmailPreference struct {
+	UserID    uint32    `gorm:"primary_key;auto_increment:false" jsonapi:"primary,email-preferences"`
+	CreatedAt time.Time `jsonapi:"attr,createdAt"`
+	UpdatedAt time.Time `jsonapi:"attr,updatedAt"`
+
+	// Immediate sends an email for each new notification, unless it is
+	// grouped with an unread one
+	Immediate bool `gorm:"not null;default:false" jsonapi:"attr,immediate"`
+
+	// Digest is how often a summary of the notifications, new followers and
+	// popular posts from followed accounts is sent
+	Digest string `gorm:"not null;default:'off'" jsonapi:"attr,digest"`
+
+	// DigestSentAt is when the last digest was sent. The next one covers
+	// what happened since.
+	DigestSentAt *time.Time `jsonapi:"attr,digestSentAt,omitempty"`
+}
@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// KeywordFilter hides posts containing Keyword from the user's feeds.
+type KeywordFilter struct {
+	ID        uint32    `gorm:"primary_key;auto_increment" jsonapi:"primary,keyword-filter"`
+	CreatedAt time.Time `jsonapi:"attr,createdAt"`
+	UpdatedAt time.Time `jsonapi:"attr,updatedAt"`
+	UserID    uint32    `gorm:"not null" jsonapi:"attr,userID"`
+	Keyword   string    `gorm:"not null" jsonapi:"attr,keyword"`
+}
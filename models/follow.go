@@ -3,7 +3,7 @@ package models
 import "time"
 
 type Follow struct {
-	ID         uint32    `gorm:"primary_key;auto_increment" jsonapi:"primary,user"`
+	ID         uint32    `gorm:"primary_key;auto_increment" jsonapi:"primary,follow"`
 	CreatedAt  time.Time `jsonapi:"attr,createdAt"`
 	UpdatedAt  time.Time `jsonapi:"attr,updatedAt"`
 	UserID     uint32    `gorm:"not null" jsonapi:"attr,userID"`
@@ -1,11 +1,102 @@
 package models
 
-import "time"
+import (
+	"strconv"
+	"time"
+)
+
+// Variants stored for every media item, from smallest to largest. For
+// video the smaller variants are images of a frame, audio only has the
+// original.
+var MediaVariants = []string{"thumbnail", "small", "original"}
+
+// MediaSourceVariant holds the upload of media waiting to be transcoded.
+const MediaSourceVariant = "source"
+
+// Kinds of media.
+const (
+	MediaKindImage = "image"
+	MediaKindVideo = "video"
+	MediaKindGIF   = "gif" // Played like a silent, looping video
+	MediaKindAudio = "audio"
+)
+
+// Processing states of media. Video and audio are transcoded in the
+// background and can't be played until they are ready.
+const (
+	MediaStateProcessing = "processing"
+	MediaStateReady      = "ready"
+	MediaStateFailed     = "failed"
+)
 
 type Media struct {
-	ID        uint32    `gorm:"primary_key;auto_increment" jsonapi:"primary,user"`
-	CreatedAt time.Time `jsonapi:"attr,createdAt"`
-	UpdatedAt time.Time `jsonapi:"attr,updatedAt"`
-	UserID    uint32    `gorm:"not null" jsonapi:"attr,userID"`
-	PostID    uint32    `gorm:"not null" jsonapi:"attr,postID"`
+	ID          uint32    `gorm:"primary_key;auto_increment" jsonapi:"primary,media"`
+	CreatedAt   time.Time `jsonapi:"attr,createdAt"`
+	UpdatedAt   time.Time `jsonapi:"attr,updatedAt"`
+	UserID      uint32    `gorm:"not null;index" jsonapi:"attr,userID"`
+	PostID      *uint32   `gorm:"index" jsonapi:"attr,postID,omitempty"`
+	Kind        string    `gorm:"not null;default:'image'" jsonapi:"attr,kind"`
+	State       string    `gorm:"not null;default:'ready';index" jsonapi:"attr,state"`
+	Key         string    `gorm:"not null"` // Storage key prefix of the variants
+	BlobHash    string    `gorm:"index"`    // Empty for media stored before deduplication
+	ContentType string    `gorm:"not null" jsonapi:"attr,contentType"`
+	Size        int64     `gorm:"not null" jsonapi:"attr,size"`
+	Width       int       `jsonapi:"attr,width"`
+	Height      int       `jsonapi:"attr,height"`
+	Blurhash    string    `jsonapi:"attr,blurhash"`
+	Duration    float64   `jsonapi:"attr,duration,omitempty"`                               // Seconds of video and audio
+	Description string    `gorm:"type:text;not null;default:''" jsonapi:"attr,description"` // Alt text
+	Sensitive   bool      `gorm:"not null;default:false" jsonapi:"attr,sensitive"`
+
+	// URLs where the variants can be downloaded. They are not stored.
+	URL          string `gorm:"-" jsonapi:"attr,url"`
+	PreviewURL   string `gorm:"-" jsonapi:"attr,previewURL"`
+	ThumbnailURL string `gorm:"-" jsonapi:"attr,thumbnailURL"`
+}
+
+// VariantKey is the storage key of one of the media's variants.
+func (m *Media) VariantKey(variant string) string {
+	return m.Key + "/" + variant
+}
+
+// SetBlob points the media at the stored content of the blob.
+func (m *Media) SetBlob(blob *Blob) {
+	m.BlobHash = blob.Hash
+	m.Key = blob.Key()
+	m.ContentType = blob.ContentType
+	m.Size = blob.Size
+	m.Width = blob.Width
+	m.Height = blob.Height
+	m.Blurhash = blob.Blurhash
+	m.Kind = blob.Kind
+	m.Duration = blob.Duration
+	m.State = MediaStateReady
+}
+
+// AfterFind sets the URLs of media loaded from the database.
+func (m *Media) AfterFind() error {
+	m.setURLs()
+	return nil
+}
+
+// AfterCreate sets the URLs of newly created media.
+func (m *Media) AfterCreate() error {
+	m.setURLs()
+	return nil
+}
+
+func (m *Media) setURLs() {
+	if m.State != MediaStateReady {
+		return
+	}
+	m.URL = MediaURL(m.ID, "original")
+	if m.Kind != MediaKindAudio {
+		m.PreviewURL = MediaURL(m.ID, "small")
+		m.ThumbnailURL = MediaURL(m.ID, "thumbnail")
+	}
+}
+
+// MediaURL is the API path serving a variant of the media item.
+func MediaURL(id uint32, variant string) string {
+	return "/v1/media/" + strconv.FormatUint(uint64(id), 10) + "/file?variant=" + variant
 }
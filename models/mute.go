@@ -0,0 +1,11 @@
+package models
+
+import "time"
+
+type Mute struct {
+	ID        uint32    `gorm:"primary_key;auto_increment" jsonapi:"primary,mute"`
+	CreatedAt time.Time `jsonapi:"attr,createdAt"`
+	UpdatedAt time.Time `jsonapi:"attr,updatedAt"`
+	UserID    uint32    `gorm:"not null" jsonapi:"attr,userID"`
+	MutedID   uint32    `gorm:"not null" jsonapi:"attr,mutedID"`
+}
@@ -0,0 +1,51 @@
+package models
+
+import "time"
+
+// Notification kinds.
+const (
+	NotificationLike     = "like"
+	NotificationReaction = "reaction"
+	NotificationFollow   = "follow"
+	NotificationMention  = "mention"
+	NotificationReply    = "reply"
+	NotificationRepost   = "repost"
+)
+
+// NotificationKinds lists all notification kinds.
+var NotificationKinds = []string{
+	NotificationLike,
+	NotificationReaction,
+	NotificationFollow,
+	NotificationMention,
+	NotificationReply,
+	NotificationRepost,
+}
+
+// Notification tells a user that others interacted with them or their posts.
+// Similar notifications are grouped while unread: GroupKey identifies the
+// group, Actor is the user who acted last and ActorCount how many different
+// users did, as in "A and 12 others liked your post".
+type Notification struct {
+	ID         uint32     `gorm:"primary_key;auto_increment" jsonapi:"primary,notification"`
+	CreatedAt  time.Time  `jsonapi:"attr,createdAt"`
+	UpdatedAt  time.Time  `gorm:"index" jsonapi:"attr,updatedAt"` // When the last actor acted
+	UserID     uint32     `gorm:"not null;index"`
+	Kind       string     `gorm:"not null" jsonapi:"attr,kind"`
+	GroupKey   string     `gorm:"not null"`
+	ActorID    uint32     `gorm:"not null"`
+	Actor      *User      `gorm:"foreignKey:ActorID" jsonapi:"relation,actor"`
+	ActorCount int        `gorm:"not null;default:1" jsonapi:"attr,actorCount"`
+	PostID     *uint32    `jsonapi:"attr,postID,omitempty"`
+	Post       *Post      `gorm:"foreignKey:PostID" jsonapi:"relation,post,omitempty"`
+	Emoji      string     `gorm:"not null;default:''" jsonapi:"attr,emoji,omitempty"` // For reactions
+	ReadAt     *time.Time `jsonapi:"attr,readAt,omitempty"`
+}
+
+// NotificationActor records that a user is one of the actors of a grouped
+// notification, so each of them is counted once.
+type NotificationActor struct {
+	NotificationID uint32 `gorm:"primary_key;auto_increment:false"`
+	ActorID        uint32 `gorm:"primary_key;auto_increment:false"`
+	CreatedAt      time.Time
+}
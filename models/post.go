@@ -1,6 +1,18 @@
 package models
 
-import "time"
+import (
+	"time"
+
+	"github.com/google/jsonapi"
+)
+
+// Post privacy levels. Public posts are visible to everyone, protected posts
+// only to the author's followers and private posts only to the author.
+const (
+	PrivacyPublic    = "public"
+	PrivacyProtected = "protected"
+	PrivacyPrivate   = "private"
+)
 
 type Post struct {
 	ID        uint32    `gorm:"primary_key;auto_increment" jsonapi:"primary,post"`
@@ -8,6 +20,53 @@ type Post struct {
 	UpdatedAt time.Time `jsonapi:"attr,updatedAt"`
 	UserID    uint32    `gorm:"not null" jsonapi:""`
 	Text      string    `gorm:"not null" jsonapi:"attr,text"`
-	Privacy   string    `gorm:"not null" jsonapi:"attr,privacy"`
-	User      *User     `gorm:"foreignkey:UserID;" jsonapi:"relation,user"`
+	Privacy   string    `gorm:"not null;default:'public'" jsonapi:"attr,privacy"`
+
+	// ContentWarning is shown in place of the text until the reader
+	// chooses to reveal it. Empty if the post has no warning.
+	ContentWarning string `gorm:"not null;default:''" jsonapi:"attr,contentWarning"`
+
+	User  *User    `gorm:"foreignkey:UserID;" jsonapi:"relation,user"`
+	Media []*Media `gorm:"foreignkey:PostID" jsonapi:"relation,media"`
+
+	// ReplyToID and RepostOfID reference the post this one answers or
+	// reposts. At most one of them is set.
+	ReplyToID  *uint32 `gorm:"index" jsonapi:"attr,replyToID,omitempty"`
+	RepostOfID *uint32 `gorm:"index" jsonapi:"attr,repostOfID,omitempty"`
+
+	// Reactions are the post's reactions as seen by the viewer, most used
+	// first. They are filled in before the post is returned.
+	Reactions []ReactionCount `gorm:"-" jsonapi:"attr,reactions"`
+
+	// Engagement counters, kept up to date as likes, bookmarks, replies and
+	// reposts are added and removed, and recounted periodically
+	LikeCount     int `gorm:"not null;default:0"`
+	BookmarkCount int `gorm:"not null;default:0"`
+	ReplyCount    int `gorm:"not null;default:0"`
+	RepostCount   int `gorm:"not null;default:0"`
+
+	// Viewer is how the user the post is shown to interacted with it. It is
+	// filled in before the post is returned.
+	Viewer PostViewerState `gorm:"-"`
+}
+
+// PostViewerState is how a user interacted with a post.
+type PostViewerState struct {
+	Liked      bool
+	Bookmarked bool
+	Reposted   bool
+}
+
+// JSONAPIMeta exposes the counters and the viewer's state as the post's
+// meta.
+func (p *Post) JSONAPIMeta() *jsonapi.Meta {
+	return &jsonapi.Meta{
+		"likeCount":     p.LikeCount,
+		"bookmarkCount": p.BookmarkCount,
+		"replyCount":    p.ReplyCount,
+		"repostCount":   p.RepostCount,
+		"liked":         p.Viewer.Liked,
+		"bookmarked":    p.Viewer.Bookmarked,
+		"reposted":      p.Viewer.Reposted,
+	}
 }
@@ -0,0 +1,53 @@
+package models
+
+import "time"
+
+// PushSubscription is where a login session of a user receives Web Push
+// notifications. Each session has at most one subscription.
+type PushSubscription struct {
+	ID        uint32     `gorm:"primary_key;auto_increment" jsonapi:"primary,push-subscription"`
+	CreatedAt time.Time  `jsonapi:"attr,createdAt"`
+	UpdatedAt time.Time  `jsonapi:"attr,updatedAt"`
+	UserID    uint32     `gorm:"not null;index" jsonapi:""`
+	SessionID string     `gorm:"not null;unique_index" jsonapi:""`
+	Endpoint  string     `gorm:"type:text;not null" jsonapi:"attr,endpoint"`
+	P256dh    string     `gorm:"not null" jsonapi:""` // The user agent's public key
+	Auth      string     `gorm:"not null" jsonapi:""` // The user agent's authentication secret
+	Alerts    PushAlerts `gorm:"embedded;embedded_prefix:alert_" jsonapi:"attr,alerts"`
+
+	// ServerKey is the VAPID public key messages are signed with, filled in
+	// before the subscription is returned
+	ServerKey string `gorm:"-" jsonapi:"attr,serverKey"`
+}
+
+// PushAlerts are the kinds of notifications a push subscription receives.
+type PushAlerts struct {
+	Like     bool `gorm:"not null" json:"like"`
+	Reaction bool `gorm:"not null" json:"reaction"`
+	Follow   bool `gorm:"not null" json:"follow"`
+	Mention  bool `gorm:"not null" json:"mention"`
+	Reply    bool `gorm:"not null" json:"reply"`
+	Repost   bool `gorm:"not null" json:"repost"`
+}
+
+// AllPushAlerts enables every kind of notification.
+var AllPushAlerts = PushAlerts{Like: true, Reaction: true, Follow: true, Mention: true, Reply: true, Repost: true}
+
+// Enabled reports whether notifications of the kind are pushed.
+func (a PushAlerts) Enabled(kind string) bool {
+	switch kind {
+	case NotificationLike:
+		return a.Like
+	case NotificationReaction:
+		return a.Reaction
+	case NotificationFollow:
+		return a.Follow
+	case NotificationMention:
+		return a.Mention
+	case NotificationReply:
+		return a.Reply
+	case NotificationRepost:
+		return a.Repost
+	}
+	return false
+}
@@ -0,0 +1,29 @@
+package models
+
+import "time"
+
+// LikeEmoji is the reaction likes are shown as. Reacting with it likes the
+// post, so likes and reactions are counted together.
+const LikeEmoji = "❤️"
+
+// Reaction is an emoji a user added to a post. Emoji is either a Unicode
+// emoji or the shortcode of a custom emoji, like ":party_parrot:". A user can
+// add each emoji to a post once.
+type Reaction struct {
+	ID        uint32    `gorm:"primary_key;auto_increment" jsonapi:"primary,reaction"`
+	CreatedAt time.Time `jsonapi:"attr,createdAt"`
+	UpdatedAt time.Time `jsonapi:"attr,updatedAt"`
+	UserID    uint32    `gorm:"not null"`
+	User      *User     `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE" jsonapi:"relation,user"`
+	PostID    uint32    `gorm:"not null"`
+	Post      *Post     `gorm:"foreignKey:PostID;constraint:OnDelete:CASCADE" jsonapi:"relation,post"`
+	Emoji     string    `gorm:"not null" jsonapi:"attr,emoji"`
+}
+
+// ReactionCount is how many users reacted to a post with an emoji, and
+// whether the user viewing the post is one of them.
+type ReactionCount struct {
+	Emoji   string `json:"emoji"`
+	Count   int    `json:"count"`
+	Reacted bool   `json:"reacted"`
+}
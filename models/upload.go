@@ -0,0 +1,44 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// States of an upload. Once all chunks are received, the upload is
+// completing while it becomes a media item. An upload whose file can't
+// become one has failed and its chunks are gone.
+const (
+	UploadStateUploading  = "uploading"
+	UploadStateCompleting = "completing"
+	UploadStateComplete   = "complete"
+	UploadStateFailed     = "failed"
+)
+
+// Upload is a resumable upload in progress. Its chunks are stored below Key
+// until all Length bytes have been received, when it becomes a media item.
+type Upload struct {
+	ID          string    `gorm:"primary_key" jsonapi:"primary,upload"`
+	CreatedAt   time.Time `jsonapi:"attr,createdAt"`
+	UpdatedAt   time.Time `jsonapi:"attr,updatedAt"`
+	ExpiresAt   time.Time `gorm:"not null;index" jsonapi:"attr,expiresAt"`
+	UserID      uint32    `gorm:"not null;index" jsonapi:"attr,userID"`
+	Length      int64     `gorm:"column:upload_length;not null" jsonapi:"attr,length"`
+	Offset      int64     `gorm:"column:upload_offset;not null;default:0" jsonapi:"attr,offset"`
+	Description string    `gorm:"type:text;not null;default:''"`
+	Sensitive   bool      `gorm:"not null;default:false"`
+	State       string    `gorm:"not null;default:'uploading'" jsonapi:"attr,state"`
+	Error       string    `gorm:"type:text;not null;default:''" jsonapi:"attr,error,omitempty"` // Why it failed
+	MediaID     *uint32   `jsonapi:"attr,mediaID,omitempty"`                                    // Set once complete
+}
+
+// Key is the storage key prefix of the upload's chunks.
+func (u *Upload) Key() string {
+	return "uploads/" + u.ID
+}
+
+// ChunkKey is the storage key of the chunk starting at offset. Keys sort in
+// the order of the chunks.
+func (u *Upload) ChunkKey(offset int64) string {
+	return fmt.Sprintf("%s/%020d", u.Key(), offset)
+}
@@ -2,6 +2,12 @@ package models
 
 import "time"
 
+// Roles of a user. Admins can use the instance administration routes.
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
 type User struct {
 	ID        uint32    `gorm:"primary_key;auto_increment" jsonapi:"primary,user"`
 	CreatedAt time.Time `jsonapi:"attr,createdAt"`
@@ -9,4 +15,9 @@ type User struct {
 	Username  string    `gorm:"not null;unique" jsonapi:"attr,username"`
 	Email     string    `gorm:"not null;unique"`
 	Password  string    `gorm:"not null"`
+	Role      string    `gorm:"not null;default:'user'"`
+
+	// LikesPrivacy is who can list the posts the user liked, using the same
+	// levels as post privacy.
+	LikesPrivacy string `gorm:"not null;default:'private'" jsonapi:"attr,likesPrivacy"`
 }
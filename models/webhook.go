@@ -0,0 +1,58 @@
+package models
+
+import (
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Webhook delivery states.
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed"
+)
+
+// Webhook sends events to a URL. User webhooks get the events their user
+// took part in; instance webhooks, registered by admins, get every event of
+// their types.
+type Webhook struct {
+	ID        uint32         `gorm:"primary_key;auto_increment" jsonapi:"primary,webhook"`
+	CreatedAt time.Time      `jsonapi:"attr,createdAt"`
+	UpdatedAt time.Time      `jsonapi:"attr,updatedAt"`
+	UserID    uint32         `gorm:"not null;index" jsonapi:""` // Who registered it
+	Instance  bool           `gorm:"not null;default:false" jsonapi:"attr,instance"`
+	URL       string         `gorm:"type:text;not null" jsonapi:"attr,url"`
+	Events    pq.StringArray `gorm:"type:text[];not null" jsonapi:"attr,events"`
+	Secret    string         `gorm:"not null" jsonapi:""` // Signs the payloads
+	Active    bool           `gorm:"not null;default:true" jsonapi:"attr,active"`
+
+	// FailureCount is how many delivery attempts failed in a row. The
+	// webhook is disabled when it reaches the configured limit.
+	FailureCount int        `gorm:"not null;default:0" jsonapi:"attr,failureCount"`
+	DisabledAt   *time.Time `jsonapi:"attr,disabledAt,omitempty"`
+
+	// SigningSecret is the secret, only returned when the webhook is created
+	SigningSecret string `gorm:"-" jsonapi:"attr,secret,omitempty"`
+}
+
+// WebhookDelivery is an event queued for or sent to a webhook. Deliveries
+// are kept after they finish as the webhook's delivery log.
+type WebhookDelivery struct {
+	ID            uint32     `gorm:"primary_key;auto_increment" jsonapi:"primary,webhook-delivery"`
+	CreatedAt     time.Time  `jsonapi:"attr,createdAt"`
+	UpdatedAt     time.Time  `jsonapi:"attr,updatedAt"`
+	WebhookID     uint32     `gorm:"not null;index" jsonapi:""`
+	EventID       string     `gorm:"not null" jsonapi:"attr,eventID"`
+	Event         string     `gorm:"not null" jsonapi:"attr,event"`
+	Payload       string     `gorm:"type:text;not null" jsonapi:""`
+	Status        string     `gorm:"not null;default:'pending';index:idx_webhook_deliveries_due" jsonapi:"attr,status"`
+	Attempts      int        `gorm:"not null;default:0" jsonapi:"attr,attempts"`
+	NextAttemptAt time.Time  `gorm:"not null;index:idx_webhook_deliveries_due" jsonapi:"attr,nextAttemptAt"`
+	LastAttemptAt *time.Time `jsonapi:"attr,lastAttemptAt,omitempty"`
+
+	// ResponseStatus and Error describe the outcome of the last attempt.
+	// ResponseStatus is 0 if no response was received.
+	ResponseStatus int    `gorm:"not null;default:0" jsonapi:"attr,responseStatus,omitempty"`
+	Error          string `gorm:"type:text;not null;default:''" jsonapi:"attr,error,omitempty"`
+}
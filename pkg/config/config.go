@@ -1,6 +1,11 @@
 package config
 
 import (
+	"fmt"
+	"runtime"
+	"strings"
+	"time"
+
 	"github.com/go-playground/validator/v10"
 	"github.com/spf13/viper"
 )
@@ -13,14 +18,27 @@ const (
 )
 
 type Config struct {
-	App      AppConfig      `mapstructure:"app"`
-	Database DatabaseConfig `mapstructure:"database"`
-	API      APIConfig      `mapstructure:"handlers"`
-	Storage  StorageConfig  `mapstructure:"storage"`
+	App       AppConfig       `mapstructure:"app"`
+	Database  DatabaseConfig  `mapstructure:"database"`
+	API       APIConfig       `mapstructure:"handlers"`
+	Storage   StorageConfig   `mapstructure:"storage"`
+	Feed      FeedConfig      `mapstructure:"feed"`
+	Timeline  TimelineConfig  `mapstructure:"timeline"`
+	Media     MediaConfig     `mapstructure:"media"`
+	Counters  CountersConfig  `mapstructure:"counters"`
+	Events    EventsConfig    `mapstructure:"events"`
+	Streaming StreamingConfig `mapstructure:"streaming"`
+	Push      PushConfig      `mapstructure:"push"`
+	Mail      MailConfig      `mapstructure:"mail"`
+	Webhooks  WebhooksConfig  `mapstructure:"webhooks"`
 }
 
+// AppConfig holds instance wide settings. Admins lists the usernames made
+// admins at startup, to bootstrap an instance; they must be registered
+// first.
 type AppConfig struct {
-	Users AppUserConfig `mapstructure:"users"`
+	Users  AppUserConfig `mapstructure:"users"`
+	Admins []string      `mapstructure:"admins"`
 }
 
 type AppUserConfig struct {
@@ -40,31 +58,300 @@ type DatabaseConfig struct {
 
 type APIConfig struct {
 	Port          string `mapstructure:"port" validate:"required"`
+	BodyLimit     int    `mapstructure:"body_limit"`
 	TokenSecret   string `mapstructure:"token_secret" validate:"required"`
 	TokenDuration int    `mapstructure:"token_duration" validate:"required"`
 }
 
+// EventsConfig controls the in-process event bus. Each subscriber queues up
+// to QueueSize events, further events for it are dropped.
+type EventsConfig struct {
+	QueueSize int `mapstructure:"queue_size" validate:"required,min=1"`
+}
+
+// StreamingConfig controls the streaming endpoint. Connections get a
+// heartbeat every HeartbeatInterval and are dropped when a write takes longer
+// than WriteTimeout. Each connection buffers up to BufferSize messages and is
+// closed if it falls further behind, so clients catch up through the API
+// instead. A connection streams at most MaxChannels channels.
+type StreamingConfig struct {
+	HeartbeatInterval time.Duration `mapstructure:"heartbeat_interval" validate:"required"`
+	WriteTimeout      time.Duration `mapstructure:"write_timeout" validate:"required"`
+	BufferSize        int           `mapstructure:"buffer_size" validate:"required,min=1"`
+	MaxChannels       int           `mapstructure:"max_channels" validate:"required,min=1"`
+}
+
+// PushConfig controls Web Push notifications. Messages are signed with the
+// VAPID private key, and Subject is a mailto: or https: URL push services can
+// use to contact the operator. If EndpointBaseURL is set, messages are sent
+// there instead of to each subscription's push service, like a local fake
+// push service in tests. Unlike the endpoints of subscriptions, it may be on
+// a private network. Push services keep messages for TTL while the
+// device is offline. Failed deliveries are tried up to MaxAttempts times,
+// waiting RetryBackoff after the first failure and twice as long after each
+// further one.
+type PushConfig struct {
+	VAPIDPrivateKey string        `mapstructure:"vapid_private_key" validate:"required"`
+	Subject         string        `mapstructure:"subject" validate:"required"`
+	EndpointBaseURL string        `mapstructure:"endpoint_base_url" validate:"omitempty,url"`
+	TTL             time.Duration `mapstructure:"ttl" validate:"required"`
+	Timeout         time.Duration `mapstructure:"timeout" validate:"required"`
+	Workers         int           `mapstructure:"workers" validate:"required,min=1"`
+	QueueSize       int           `mapstructure:"queue_size" validate:"min=0"`
+	MaxAttempts     int           `mapstructure:"max_attempts" validate:"required,min=1"`
+	RetryBackoff    time.Duration `mapstructure:"retry_backoff" validate:"required"`
+}
+
+// MailConfig controls email. The smtp backend sends through an SMTP server
+// and the log backend only logs messages, for development. Unsubscribe links
+// point to BaseURL, the public URL of the API, and are signed with
+// SigningKey. Due digests are looked for every DigestInterval, BatchSize
+// users at a time. Digests list up to DigestItems notifications and new
+// followers and the TopPosts most engaging posts from followed accounts.
+type MailConfig struct {
+	Backend        string         `mapstructure:"backend" validate:"required,oneof=smtp log"`
+	From           string         `mapstructure:"from" validate:"required"`
+	BaseURL        string         `mapstructure:"base_url" validate:"required,url"`
+	SigningKey     string         `mapstructure:"signing_key" validate:"required"`
+	Timeout        time.Duration  `mapstructure:"timeout" validate:"required"`
+	Workers        int            `mapstructure:"workers" validate:"required,min=1"`
+	QueueSize      int            `mapstructure:"queue_size" validate:"min=0"`
+	DigestInterval time.Duration  `mapstructure:"digest_interval" validate:"required"`
+	BatchSize      int            `mapstructure:"batch_size" validate:"required,min=1"`
+	DigestItems    int            `mapstructure:"digest_items" validate:"required,min=1"`
+	TopPosts       int            `mapstructure:"top_posts" validate:"min=0"`
+	SMTP           MailSMTPConfig `mapstructure:"smtp"`
+}
+
+// Validate checks that the settings of the selected backend are present.
+func (m *MailConfig) Validate() error {
+	if m.Backend == "smtp" && (m.SMTP.Host == "" || m.SMTP.Port == 0) {
+		return fmt.Errorf("mail backend %q requires mail.smtp.host, mail.smtp.port", m.Backend)
+	}
+	return nil
+}
+
+type MailSMTPConfig struct {
+	Host     string `mapstructure:"host"`
+	Port     int    `mapstructure:"port"`
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+}
+
+// WebhooksConfig controls outgoing webhooks. Workers look for due
+// deliveries every PollInterval, or as soon as one is queued, and wait up to
+// Timeout for the endpoint. Failed deliveries are tried up to MaxAttempts
+// times, waiting RetryBackoff after the first failure and twice as long
+// after each further one, but no more than MaxBackoff. Webhooks are disabled
+// after DisableAfter failed attempts in a row. Finished deliveries stay in
+// the log for LogRetention and are removed every CleanupInterval. Unless
+// AllowPrivateNetworks is set, webhooks can't reach loopback, private or
+// link-local addresses. Events are queued for delivery from the in-memory
+// event bus, so those it drops or still holds at shutdown are never
+// delivered.
+type WebhooksConfig struct {
+	Timeout              time.Duration `mapstructure:"timeout" validate:"required"`
+	Workers              int           `mapstructure:"workers" validate:"required,min=1"`
+	PollInterval         time.Duration `mapstructure:"poll_interval" validate:"required"`
+	MaxAttempts          int           `mapstructure:"max_attempts" validate:"required,min=1"`
+	RetryBackoff         time.Duration `mapstructure:"retry_backoff" validate:"required"`
+	MaxBackoff           time.Duration `mapstructure:"max_backoff" validate:"required"`
+	DisableAfter         int           `mapstructure:"disable_after" validate:"required,min=1"`
+	LogRetention         time.Duration `mapstructure:"log_retention" validate:"required"`
+	CleanupInterval      time.Duration `mapstructure:"cleanup_interval" validate:"required"`
+	MaxPerUser           int           `mapstructure:"max_per_user" validate:"required,min=1"`
+	AllowPrivateNetworks bool          `mapstructure:"allow_private_networks"`
+}
+
+// CountersConfig controls the recounting of the engagement counters of
+// posts, which fixes counters that drifted. Posts are recounted every
+// ReconcileInterval, BatchSize at a time.
+type CountersConfig struct {
+	ReconcileInterval time.Duration `mapstructure:"reconcile_interval" validate:"required"`
+	BatchSize         int           `mapstructure:"batch_size" validate:"required,min=1"`
+}
+
+// MediaConfig limits what can be uploaded. MaxSize is in bytes and
+// AllowedTypes lists the accepted MIME types, as sniffed from the content.
+// With RequireAltText, media can only be attached to posts once it has a
+// description. Quotas are the bytes of media each role may store; roles
+// without a quota, or with a quota of 0, are unlimited. An UploadsPerHour of
+// 0 disables the upload rate limit. Media that isn't public is served from
+// signed URLs, which expire after SignedURLExpiry.
+type MediaConfig struct {
+	MaxSize         int64            `mapstructure:"max_size" validate:"required,min=1"`
+	MaxPerPost      int              `mapstructure:"max_per_post" validate:"required,min=1"`
+	AllowedTypes    []string         `mapstructure:"allowed_types" validate:"required,min=1"`
+	RequireAltText  bool             `mapstructure:"require_alt_text"`
+	Quotas          map[string]int64 `mapstructure:"quotas"`
+	UploadsPerHour  int              `mapstructure:"uploads_per_hour" validate:"min=0"`
+	SignedURLExpiry time.Duration    `mapstructure:"signed_url_expiry" validate:"required"`
+	Images          ImageConfig      `mapstructure:"images"`
+	GC              MediaGCConfig    `mapstructure:"gc"`
+	Uploads         UploadConfig     `mapstructure:"uploads"`
+	Transcode       TranscodeConfig  `mapstructure:"transcode"`
+}
+
+// TranscodeConfig controls the background transcoding of video, GIF and
+// audio uploads. MaxSize replaces the media MaxSize for them. Empty binary
+// paths are looked up in PATH. Transcoding a file is given up after
+// Timeout, and tried again later.
+type TranscodeConfig struct {
+	Transcoder  string        `mapstructure:"transcoder" validate:"required,oneof=ffmpeg fake"`
+	FFmpegPath  string        `mapstructure:"ffmpeg_path"`
+	FFprobePath string        `mapstructure:"ffprobe_path"`
+	Workers     int           `mapstructure:"workers" validate:"required,min=1"`
+	QueueSize   int           `mapstructure:"queue_size" validate:"min=0"`
+	MaxSize     int64         `mapstructure:"max_size" validate:"required,min=1"`
+	Timeout     time.Duration `mapstructure:"timeout" validate:"required"`
+}
+
+// UploadConfig controls resumable uploads. Uploads expire Expiry after they
+// were created, finished or not, and expired uploads are removed every
+// CleanupInterval.
+type UploadConfig struct {
+	Expiry          time.Duration `mapstructure:"expiry" validate:"required"`
+	CleanupInterval time.Duration `mapstructure:"cleanup_interval" validate:"required"`
+}
+
+// MediaGCConfig controls the removal of unused media. Media that is not
+// attached to a post, and stored files without a database row, are removed
+// once they are older than TTL. With DryRun, scheduled runs only report
+// what they would remove.
+type MediaGCConfig struct {
+	Interval  time.Duration `mapstructure:"interval" validate:"required"`
+	TTL       time.Duration `mapstructure:"ttl" validate:"required"`
+	BatchSize int           `mapstructure:"batch_size" validate:"required,min=1"`
+	DryRun    bool          `mapstructure:"dry_run"`
+}
+
+// ImageConfig controls how uploaded images are processed. Sizes are the
+// longest side of each variant in pixels.
+type ImageConfig struct {
+	Workers         int   `mapstructure:"workers" validate:"required,min=1"`
+	MaxPixels       int64 `mapstructure:"max_pixels" validate:"required,min=1"`
+	ThumbnailSize   int   `mapstructure:"thumbnail_size" validate:"required,min=1"`
+	SmallSize       int   `mapstructure:"small_size" validate:"required,min=1"`
+	OriginalMaxSize int   `mapstructure:"original_max_size" validate:"required,min=1"`
+	JPEGQuality     int   `mapstructure:"jpeg_quality" validate:"required,min=1,max=100"`
+}
+
 type StorageConfig struct {
-	Type  StorageType        `mapstructure:"type" validate:"required"`
+	Type  StorageType        `mapstructure:"type" validate:"required,oneof=local s3"`
 	Local StorageLocalConfig `mapstructure:"local"`
 	S3    StorageS3Config    `mapstructure:"s3"`
 }
 
+// Validate checks that the settings of the selected backend are present.
+func (s *StorageConfig) Validate() error {
+	var missing []string
+	require := func(name, value string) {
+		if value == "" {
+			missing = append(missing, name)
+		}
+	}
+
+	switch s.Type {
+	case StorageTypeLocal:
+		if runtime.GOOS == "windows" {
+			require("storage.local.windows_path", s.Local.WindowsPath)
+		} else {
+			require("storage.local.linux_path", s.Local.LinuxPath)
+		}
+		require("storage.local.base_url", s.Local.BaseURL)
+		require("storage.local.signing_key", s.Local.SigningKey)
+	case StorageTypeS3:
+		require("storage.s3.endpoint", s.S3.Endpoint)
+		require("storage.s3.bucket", s.S3.Bucket)
+		require("storage.s3.region", s.S3.Region)
+		require("storage.s3.access_key", s.S3.AccessKey)
+		require("storage.s3.secret_key", s.S3.SecretKey)
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("storage type %q requires %s", s.Type, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
 type StorageLocalConfig struct {
 	WindowsPath string `mapstructure:"windows_path"`
 	LinuxPath   string `mapstructure:"linux_path"`
+	BaseURL     string `mapstructure:"base_url"`
+	SigningKey  string `mapstructure:"signing_key"`
+}
+
+// Path returns the storage directory for the current operating system.
+func (s *StorageLocalConfig) Path() string {
+	if runtime.GOOS == "windows" {
+		return s.WindowsPath
+	}
+	return s.LinuxPath
 }
 
 type StorageS3Config struct {
+	Endpoint  string `mapstructure:"endpoint"`
+	UseSSL    bool   `mapstructure:"use_ssl"`
+	PathStyle bool   `mapstructure:"path_style"`
 	Bucket    string `mapstructure:"bucket"`
 	Region    string `mapstructure:"region"`
 	AccessKey string `mapstructure:"access_key"`
 	SecretKey string `mapstructure:"secret_key"`
 }
 
+type FeedConfig struct {
+	Algorithmic AlgorithmicFeedConfig `mapstructure:"algorithmic"`
+	Explore     ExploreFeedConfig     `mapstructure:"explore"`
+}
+
+// AlgorithmicFeedConfig holds the ranking weights of the algorithmic feed.
+type AlgorithmicFeedConfig struct {
+	CandidateWindow    time.Duration `mapstructure:"candidate_window" validate:"required"`
+	CandidateLimit     int           `mapstructure:"candidate_limit" validate:"required,min=1"`
+	RecencyHalfLife    time.Duration `mapstructure:"recency_half_life" validate:"required"`
+	LikeWeight         float64       `mapstructure:"like_weight"`
+	ReplyWeight        float64       `mapstructure:"reply_weight"`
+	RepostWeight       float64       `mapstructure:"repost_weight"`
+	AffinityWeight     float64       `mapstructure:"affinity_weight"`
+	AffinityWindow     time.Duration `mapstructure:"affinity_window" validate:"required"`
+	SecondDegreeWeight float64       `mapstructure:"second_degree_weight"`
+	AuthorDecay        float64       `mapstructure:"author_decay" validate:"min=0,max=1"`
+	MaxPerAuthor       int           `mapstructure:"max_per_author" validate:"min=0"`
+}
+
+// ExploreFeedConfig controls how popular posts are picked for the explore
+// feed and how often the picks are recomputed.
+type ExploreFeedConfig struct {
+	Window          time.Duration `mapstructure:"window" validate:"required"`
+	CandidateLimit  int           `mapstructure:"candidate_limit" validate:"required,min=1"`
+	RefreshInterval time.Duration `mapstructure:"refresh_interval" validate:"required"`
+	MinEngagement   float64       `mapstructure:"min_engagement"`
+	LikeWeight      float64       `mapstructure:"like_weight"`
+	ReplyWeight     float64       `mapstructure:"reply_weight"`
+	RepostWeight    float64       `mapstructure:"repost_weight"`
+}
+
+// TimelineConfig controls the materialized home timelines. Posts by
+// accounts with at least FanoutThreshold followers are not copied into
+// timelines but merged in when a timeline is read.
+type TimelineConfig struct {
+	Store           string        `mapstructure:"store" validate:"required,oneof=memory postgres"`
+	MaxEntries      int           `mapstructure:"max_entries" validate:"required,min=1"`
+	FanoutThreshold int           `mapstructure:"fanout_threshold" validate:"required,min=1"`
+	Workers         int           `mapstructure:"workers" validate:"required,min=1"`
+	QueueSize       int           `mapstructure:"queue_size" validate:"min=0"`
+	TrimInterval    time.Duration `mapstructure:"trim_interval" validate:"required"`
+}
+
 func (c *Config) Validate() error {
 	validate := validator.New()
-	return validate.Struct(c)
+	if err := validate.Struct(c); err != nil {
+		return err
+	}
+	if err := c.Storage.Validate(); err != nil {
+		return err
+	}
+	return c.Mail.Validate()
 }
 
 func Load() (*Config, error) {
@@ -32,10 +32,31 @@ func New(config *config.DatabaseConfig) (*Database, error) {
 	db.Conn.LogMode(config.LogMode)
 
 	if config.DevMode {
-		db.Conn.DropTableIfExists(&models.Block{}, &models.Bookmark{}, &models.Follow{}, &models.Like{}, &models.Media{}, &models.Post{}, &models.User{})
+		db.Conn.DropTableIfExists(&models.Blob{}, &models.Block{}, &models.Bookmark{}, &models.BookmarkCollection{}, &models.CustomEmoji{}, &models.EmailPreference{}, &models.Follow{}, &models.KeywordFilter{}, &models.Like{}, &models.Media{}, &models.Mute{}, &models.Notification{}, &models.NotificationActor{}, &models.Post{}, &models.PushSubscription{}, &models.Reaction{}, &models.Upload{}, &models.User{}, &models.Webhook{}, &models.WebhookDelivery{})
+		db.Conn.DropTableIfExists("timeline_entries", "timelines")
 	}
 
-	db.Conn.AutoMigrate(&models.Block{}, &models.Bookmark{}, &models.Follow{}, &models.Like{}, &models.Media{}, &models.Post{}, &models.User{})
+	db.Conn.AutoMigrate(&models.Blob{}, &models.Block{}, &models.Bookmark{}, &models.BookmarkCollection{}, &models.CustomEmoji{}, &models.EmailPreference{}, &models.Follow{}, &models.KeywordFilter{}, &models.Like{}, &models.Media{}, &models.Mute{}, &models.Notification{}, &models.NotificationActor{}, &models.Post{}, &models.PushSubscription{}, &models.Reaction{}, &models.Upload{}, &models.User{}, &models.Webhook{}, &models.WebhookDelivery{})
+
+	// Posts created before privacy was defaulted were stored with an empty
+	// privacy level. Treat them as public like every new post.
+	err = db.Conn.Model(&models.Post{}).Where("privacy = ?", "").Update("privacy", models.PrivacyPublic).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to backfill post privacy: %v", err)
+	}
+
+	// Media used to require a post. It is now uploaded before the post
+	// it's attached to is created.
+	err = db.Conn.Exec("ALTER TABLE media ALTER COLUMN post_id DROP NOT NULL").Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to make media post optional: %v", err)
+	}
+
+	// Only unread notifications are grouped, so read ones can share a key
+	err = db.Conn.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_notification_user_open_group ON notifications (user_id, group_key) WHERE read_at IS NULL").Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to add unique index for Notification: %v", err)
+	}
 
 	err = db.Conn.Model(&models.Block{}).AddUniqueIndex("idx_block_user_blocked", "user_id", "blocked_id").Error
 	if err != nil {
@@ -47,6 +68,11 @@ func New(config *config.DatabaseConfig) (*Database, error) {
 		return nil, fmt.Errorf("failed to add unique index for Bookmark: %v", err)
 	}
 
+	err = db.Conn.Model(&models.BookmarkCollection{}).AddUniqueIndex("idx_bookmark_collection_user_name", "user_id", "name").Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to add unique index for BookmarkCollection: %v", err)
+	}
+
 	err = db.Conn.Model(&models.Follow{}).AddUniqueIndex("idx_follow_user_followed", "user_id", "followed_id").Error
 	if err != nil {
 		return nil, fmt.Errorf("failed to add unique index for Follow: %v", err)
@@ -57,5 +83,20 @@ func New(config *config.DatabaseConfig) (*Database, error) {
 		return nil, fmt.Errorf("failed to add unique index for Like: %v", err)
 	}
 
+	err = db.Conn.Model(&models.Mute{}).AddUniqueIndex("idx_mute_user_muted", "user_id", "muted_id").Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to add unique index for Mute: %v", err)
+	}
+
+	err = db.Conn.Model(&models.Reaction{}).AddUniqueIndex("idx_reaction_post_user_emoji", "post_id", "user_id", "emoji").Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to add unique index for Reaction: %v", err)
+	}
+
+	err = db.Conn.Model(&models.KeywordFilter{}).AddUniqueIndex("idx_keyword_filter_user_keyword", "user_id", "keyword").Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to add unique index for KeywordFilter: %v", err)
+	}
+
 	return &db, nil
 }
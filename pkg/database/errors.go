@@ -0,0 +1,57 @@
+package database
+
+import (
+	"errors"
+
+	"github.com/lib/pq"
+)
+
+// Kinds of constraint violations, matched with errors.Is.
+var (
+	ErrUniqueViolation     = errors.New("unique constraint violated")
+	ErrForeignKeyViolation = errors.New("foreign key constraint violated")
+)
+
+// Postgres error codes of constraint violations.
+const (
+	uniqueViolation     pq.ErrorCode = "23505"
+	foreignKeyViolation pq.ErrorCode = "23503"
+)
+
+// ConstraintError is a query error caused by a violated constraint.
+type ConstraintError struct {
+	Kind       error  // ErrUniqueViolation or ErrForeignKeyViolation
+	Constraint string // Name of the violated constraint or index
+	Err        error  // The original error
+}
+
+func (e *ConstraintError) Error() string {
+	return e.Kind.Error() + ": " + e.Constraint
+}
+
+func (e *ConstraintError) Is(target error) bool {
+	return target == e.Kind
+}
+
+func (e *ConstraintError) Unwrap() error {
+	return e.Err
+}
+
+// MapError translates Postgres constraint violations into a ConstraintError,
+// so callers can tell them apart from other failures without depending on
+// the driver. Other errors, and nil, are returned unchanged.
+func MapError(err error) error {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return err
+	}
+
+	switch pqErr.Code {
+	case uniqueViolation:
+		return &ConstraintError{Kind: ErrUniqueViolation, Constraint: pqErr.Constraint, Err: err}
+	case foreignKeyViolation:
+		return &ConstraintError{Kind: ErrForeignKeyViolation, Constraint: pqErr.Constraint, Err: err}
+	default:
+		return err
+	}
+}
@@ -0,0 +1,131 @@
+// Package events lets the services react to what happens elsewhere in the
+// application without calling each other directly. Publishers describe what
+// happened in an Event, and every subscriber interested in its type gets a
+// copy.
+package events
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Type names what happened.
+type Type string
+
+const (
+	PostCreated         Type = "post.created"
+	PostDeleted         Type = "post.deleted"
+	PostLiked           Type = "post.liked"
+	PostReacted         Type = "post.reacted"
+	UserFollowed        Type = "user.followed"
+	UserRegistered      Type = "user.registered"
+	NotificationCreated Type = "notification.created"
+)
+
+// Event is something a user did. ActorID is the user who did it. Which of
+// the other fields are set depends on the type: PostID is the post created
+// or acted on, UserID the user acted on and Emoji the reaction. For
+// NotificationCreated, UserID is the user notified and NotificationID the
+// notification, which is also sent when a grouped notification gains an
+// actor. For PostDeleted, Privacy is the privacy the post had, as the post
+// can't be looked up anymore.
+type Event struct {
+	Type           Type
+	Time           time.Time
+	ActorID        uint32
+	PostID         uint32
+	UserID         uint32
+	Emoji          string
+	NotificationID uint32
+	Privacy        string
+}
+
+// Handler processes an event.
+type Handler func(Event)
+
+// Bus delivers published events to the subscribers of their type.
+type Bus interface {
+	// Publish hands the event to the subscribers. It should be called once
+	// the change it describes is committed.
+	Publish(event Event)
+
+	// Subscribe registers a handler for events of the given types, or all
+	// events if no type is given. The name identifies the subscriber in logs.
+	Subscribe(name string, handler Handler, types ...Type)
+}
+
+// Local is a Bus delivering events within the process. Every subscriber has
+// its own queue and processes its events in order, one at a time. Publishing
+// never blocks, as it happens while handling requests: events for a
+// subscriber whose queue is full are dropped and logged.
+type Local struct {
+	queueSize int
+
+	mu          sync.RWMutex
+	subscribers []*subscriber
+}
+
+type subscriber struct {
+	name    string
+	types   map[Type]bool
+	handler Handler
+	queue   chan Event
+}
+
+// NewLocal creates a Local bus. Each subscriber queues up to queueSize
+// events.
+func NewLocal(queueSize int) *Local {
+	return &Local{queueSize: queueSize}
+}
+
+func (l *Local) Publish(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, s := range l.subscribers {
+		if len(s.types) == 0 || s.types[event.Type] {
+			select {
+			case s.queue <- event:
+			default:
+				log.Printf("Event subscriber %s is falling behind, dropped %s", s.name, event.Type)
+			}
+		}
+	}
+}
+
+func (l *Local) Subscribe(name string, handler Handler, types ...Type) {
+	s := &subscriber{
+		name:    name,
+		types:   make(map[Type]bool, len(types)),
+		handler: handler,
+		queue:   make(chan Event, l.queueSize),
+	}
+	for _, t := range types {
+		s.types[t] = true
+	}
+	go s.run()
+
+	l.mu.Lock()
+	l.subscribers = append(l.subscribers, s)
+	l.mu.Unlock()
+}
+
+func (s *subscriber) run() {
+	for event := range s.queue {
+		s.handle(event)
+	}
+}
+
+// handle runs the handler, keeping the subscriber alive if it panics.
+func (s *subscriber) handle(event Event) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Event subscriber %s failed to handle %s: %v", s.name, event.Type, r)
+		}
+	}()
+	s.handler(event)
+}
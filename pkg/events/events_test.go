@@ -0,0 +1,51 @@
+package events
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLocalDelivers(t *testing.T) {
+	bus := NewLocal(10)
+	got := make(chan Event, 10)
+	bus.Subscribe("likes", func(e Event) { got <- e }, PostLiked)
+
+	bus.Publish(Event{Type: PostCreated, PostID: 1})
+	bus.Publish(Event{Type: PostLiked, PostID: 2})
+
+	select {
+	case e := <-got:
+		if e.Type != PostLiked || e.PostID != 2 || e.Time.IsZero() {
+			t.Errorf("got %+v, want the like of post 2 with a time", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the event was not delivered")
+	}
+	select {
+	case e := <-got:
+		t.Errorf("got %+v, which the subscriber did not subscribe to", e)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+// TestLocalPublishDoesNotBlock checks that a stuck subscriber doesn't hold
+// up publishers once its queue is full.
+func TestLocalPublishDoesNotBlock(t *testing.T) {
+	bus := NewLocal(1)
+	release := make(chan struct{})
+	defer close(release)
+	bus.Subscribe("stuck", func(Event) { <-release })
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			bus.Publish(Event{Type: PostCreated})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Publish blocked on a full queue")
+	}
+}
@@ -0,0 +1,177 @@
+package imageproc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+
+	"github.com/buckket/go-blurhash"
+	"github.com/bwoff11/frens/pkg/config"
+	"github.com/disintegration/imaging"
+	_ "golang.org/x/image/webp"
+)
+
+// Names of the variants produced for every image.
+const (
+	VariantThumbnail = "thumbnail"
+	VariantSmall     = "small"
+	VariantOriginal  = "original"
+)
+
+var (
+	// ErrInvalidImage is returned for data that cannot be decoded.
+	ErrInvalidImage = errors.New("invalid image")
+
+	// ErrTooManyPixels is returned for images larger than allowed, which
+	// would take too much memory to decode.
+	ErrTooManyPixels = errors.New("image has too many pixels")
+)
+
+// Variant is an encoded rendition of an image.
+type Variant struct {
+	Name        string
+	Data        []byte
+	ContentType string
+	Width       int
+	Height      int
+}
+
+// Result is a processed image. Width and Height are those of the original
+// variant.
+type Result struct {
+	Width    int
+	Height   int
+	Blurhash string
+	Variants []Variant
+}
+
+type job struct {
+	data   []byte
+	result chan<- jobResult
+}
+
+type jobResult struct {
+	result *Result
+	err    error
+}
+
+// Processor decodes uploaded images and re-encodes them into resized
+// variants. Decoding and re-encoding drops all metadata, including EXIF and
+// GPS data. At most Workers images are processed at a time so that large
+// uploads cannot exhaust the server's memory.
+type Processor struct {
+	config *config.ImageConfig
+	jobs   chan job
+}
+
+// NewProcessor creates a processor and starts its workers.
+func NewProcessor(config *config.ImageConfig) *Processor {
+	p := &Processor{
+		config: config,
+		jobs:   make(chan job),
+	}
+	for i := 0; i < config.Workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// Process waits for a free worker and processes the image with it.
+func (p *Processor) Process(ctx context.Context, data []byte) (*Result, error) {
+	results := make(chan jobResult, 1)
+
+	select {
+	case p.jobs <- job{data: data, result: results}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	select {
+	case r := <-results:
+		return r.result, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (p *Processor) work() {
+	for j := range p.jobs {
+		result, err := p.process(j.data)
+		j.result <- jobResult{result: result, err: err}
+	}
+}
+
+func (p *Processor) process(data []byte) (*Result, error) {
+	// Check the dimensions before decoding the whole image
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrInvalidImage
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > p.config.MaxPixels {
+		return nil, ErrTooManyPixels
+	}
+
+	// Decoding applies the EXIF orientation and leaves the metadata behind
+	img, err := imaging.Decode(bytes.NewReader(data), imaging.AutoOrientation(true))
+	if err != nil {
+		return nil, ErrInvalidImage
+	}
+
+	// Keep PNGs lossless since they may be transparent; everything else
+	// becomes a JPEG
+	encoding, contentType := imaging.JPEG, "image/jpeg"
+	if format == "png" {
+		encoding, contentType = imaging.PNG, "image/png"
+	}
+
+	sizes := []struct {
+		name string
+		max  int
+	}{
+		{VariantThumbnail, p.config.ThumbnailSize},
+		{VariantSmall, p.config.SmallSize},
+		{VariantOriginal, p.config.OriginalMaxSize},
+	}
+
+	result := &Result{}
+	var thumbnail image.Image
+	for _, size := range sizes {
+		resized := img
+		bounds := img.Bounds()
+		if bounds.Dx() > size.max || bounds.Dy() > size.max {
+			resized = imaging.Fit(img, size.max, size.max, imaging.Lanczos)
+		}
+
+		var buf bytes.Buffer
+		if err := imaging.Encode(&buf, resized, encoding, imaging.JPEGQuality(p.config.JPEGQuality)); err != nil {
+			return nil, err
+		}
+
+		variant := Variant{
+			Name:        size.name,
+			Data:        buf.Bytes(),
+			ContentType: contentType,
+			Width:       resized.Bounds().Dx(),
+			Height:      resized.Bounds().Dy(),
+		}
+		result.Variants = append(result.Variants, variant)
+
+		if size.name == VariantThumbnail {
+			thumbnail = resized
+		}
+		if size.name == VariantOriginal {
+			result.Width, result.Height = variant.Width, variant.Height
+		}
+	}
+
+	// The thumbnail has plenty of detail for a blurred placeholder
+	result.Blurhash, err = blurhash.Encode(4, 3, thumbnail)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
@@ -0,0 +1,40 @@
+// Package mailer sends email through a configurable backend.
+package mailer
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/bwoff11/frens/pkg/config"
+)
+
+// Message is an email to a single recipient, with a plain text and an HTML
+// body.
+type Message struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+
+	// UnsubscribeURL is where the recipient unsubscribes from emails like
+	// this one with a single POST request (RFC 8058). Empty if the message
+	// isn't part of a list.
+	UnsubscribeURL string
+}
+
+// Mailer sends email.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// New creates the backend selected in the configuration.
+func New(config *config.MailConfig) (Mailer, error) {
+	switch config.Backend {
+	case "smtp":
+		return NewSMTP(config.SMTP.Host, config.SMTP.Port, config.SMTP.Username, config.SMTP.Password, config.From)
+	case "log":
+		return &Log{From: config.From}, nil
+	default:
+		return nil, fmt.Errorf("unknown mail backend %q", config.Backend)
+	}
+}
@@ -0,0 +1,167 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SMTP sends messages through an SMTP server. The connection is upgraded
+// with STARTTLS when the server supports it, which net/smtp requires before
+// it sends a password to a server that isn't on localhost.
+type SMTP struct {
+	host     string
+	addr     string
+	username string
+	password string
+	from     *mail.Address
+}
+
+// NewSMTP creates a backend sending through the server at host and port.
+// Username and password may be empty if the server doesn't require
+// authentication. From is the sender, like "frens <noreply@example.com>".
+func NewSMTP(host string, port int, username, password, from string) (*SMTP, error) {
+	sender, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sender address: %w", err)
+	}
+	return &SMTP{
+		host:     host,
+		addr:     net.JoinHostPort(host, strconv.Itoa(port)),
+		username: username,
+		password: password,
+		from:     sender,
+	}, nil
+}
+
+func (s *SMTP) Send(ctx context.Context, msg Message) error {
+	recipient, err := mail.ParseAddress(msg.To)
+	if err != nil {
+		return fmt.Errorf("invalid recipient address: %w", err)
+	}
+	data, err := s.build(msg, recipient)
+	if err != nil {
+		return err
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	client, err := smtp.NewClient(conn, s.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: s.host}); err != nil {
+			return err
+		}
+	}
+	if s.username != "" {
+		if err := client.Auth(smtp.PlainAuth("", s.username, s.password, s.host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(s.from.Address); err != nil {
+		return err
+	}
+	if err := client.Rcpt(recipient.Address); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// build encodes the message as a multipart/alternative MIME message with
+// the plain text body first, so clients prefer the HTML one.
+func (s *SMTP) build(msg Message, recipient *mail.Address) ([]byte, error) {
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+	for _, part := range []struct {
+		contentType string
+		content     string
+	}{
+		{"text/plain; charset=utf-8", msg.Text},
+		{"text/html; charset=utf-8", msg.HTML},
+	} {
+		w, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write([]byte(part.content)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+
+	messageID, err := s.messageID()
+	if err != nil {
+		return nil, err
+	}
+	var header bytes.Buffer
+	write := func(name, value string) {
+		fmt.Fprintf(&header, "%s: %s\r\n", name, value)
+	}
+	write("From", s.from.String())
+	write("To", recipient.String())
+	write("Subject", mime.QEncoding.Encode("utf-8", msg.Subject))
+	write("Date", time.Now().Format(time.RFC1123Z))
+	write("Message-ID", messageID)
+	write("MIME-Version", "1.0")
+	if msg.UnsubscribeURL != "" {
+		write("List-Unsubscribe", "<"+msg.UnsubscribeURL+">")
+		write("List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
+	}
+	write("Content-Type", "multipart/alternative; boundary="+parts.Boundary())
+	header.WriteString("\r\n")
+
+	return append(header.Bytes(), body.Bytes()...), nil
+}
+
+// messageID returns a unique Message-ID in the domain of the sender.
+func (s *SMTP) messageID() (string, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	domain := s.from.Address[strings.LastIndex(s.from.Address, "@")+1:]
+	return "<" + hex.EncodeToString(random) + "@" + domain + ">", nil
+}
@@ -0,0 +1,201 @@
+// Package pubsub delivers messages published on a topic to whoever is
+// subscribed to the topic at that moment. Unlike the event bus it's meant
+// for many short lived subscribers, like streaming connections, and never
+// lets them hold up publishers: a subscriber that falls behind is dropped.
+//
+// Local keeps everything in the process. Running more than one instance of
+// the application needs a PubSub backed by a message broker instead.
+package pubsub
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrSlowSubscriber is the reason a subscription was closed when it didn't
+// keep up with the messages published to it.
+var ErrSlowSubscriber = errors.New("subscriber fell behind")
+
+// Message is the data published on a topic.
+type Message struct {
+	Topic string
+	Data  []byte
+}
+
+// PubSub delivers published messages to the subscribers of their topic.
+type PubSub interface {
+	// Publish sends the data to the current subscribers of the topic. It
+	// doesn't wait for them to receive it.
+	Publish(topic string, data []byte) error
+
+	// Subscribe creates a subscription to the topics, which buffers up to
+	// bufferSize messages.
+	Subscribe(bufferSize int, topics ...string) (Subscription, error)
+}
+
+// Subscription receives the messages published on its topics.
+type Subscription interface {
+	// Add subscribes to more topics.
+	Add(topics ...string) error
+
+	// Remove unsubscribes from the topics.
+	Remove(topics ...string) error
+
+	// Messages returns the channel messages are delivered on. It is closed
+	// when the subscription is.
+	Messages() <-chan Message
+
+	// Err returns why the subscription was closed by the PubSub, or nil if
+	// it's open or was closed with Close.
+	Err() error
+
+	// Close ends the subscription.
+	Close()
+}
+
+// Local is a PubSub within the process.
+type Local struct {
+	mu     sync.RWMutex
+	topics map[string]map[*localSubscription]struct{}
+}
+
+// NewLocal creates a Local PubSub.
+func NewLocal() *Local {
+	return &Local{topics: make(map[string]map[*localSubscription]struct{})}
+}
+
+func (l *Local) Publish(topic string, data []byte) error {
+	msg := Message{Topic: topic, Data: data}
+
+	var dropped []*localSubscription
+	l.mu.RLock()
+	for s := range l.topics[topic] {
+		if !s.deliver(msg) {
+			dropped = append(dropped, s)
+		}
+	}
+	l.mu.RUnlock()
+
+	// Subscriptions are removed once the read lock is released
+	for _, s := range dropped {
+		l.remove(s)
+	}
+	return nil
+}
+
+func (l *Local) Subscribe(bufferSize int, topics ...string) (Subscription, error) {
+	s := &localSubscription{
+		local:    l,
+		topics:   make(map[string]struct{}),
+		messages: make(chan Message, bufferSize),
+	}
+	return s, s.Add(topics...)
+}
+
+// remove unsubscribes the subscription from all of its topics.
+func (l *Local) remove(s *localSubscription) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for topic := range s.topics {
+		l.unsubscribe(s, topic)
+	}
+}
+
+// unsubscribe removes the subscription from the topic. Both locks must be
+// held.
+func (l *Local) unsubscribe(s *localSubscription, topic string) {
+	delete(s.topics, topic)
+	delete(l.topics[topic], s)
+	if len(l.topics[topic]) == 0 {
+		delete(l.topics, topic)
+	}
+}
+
+type localSubscription struct {
+	local *Local
+
+	mu       sync.Mutex
+	topics   map[string]struct{}
+	messages chan Message
+	closed   bool
+	err      error
+}
+
+func (s *localSubscription) Add(topics ...string) error {
+	s.local.mu.Lock()
+	defer s.local.mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	for _, topic := range topics {
+		if s.local.topics[topic] == nil {
+			s.local.topics[topic] = make(map[*localSubscription]struct{})
+		}
+		s.local.topics[topic][s] = struct{}{}
+		s.topics[topic] = struct{}{}
+	}
+	return nil
+}
+
+func (s *localSubscription) Remove(topics ...string) error {
+	s.local.mu.Lock()
+	defer s.local.mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, topic := range topics {
+		s.local.unsubscribe(s, topic)
+	}
+	return nil
+}
+
+func (s *localSubscription) Messages() <-chan Message {
+	return s.messages
+}
+
+func (s *localSubscription) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *localSubscription) Close() {
+	s.local.remove(s)
+	s.close(nil)
+}
+
+// deliver queues the message without blocking. If the buffer is full, the
+// subscription is closed with ErrSlowSubscriber and deliver returns false.
+func (s *localSubscription) deliver(msg Message) bool {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return false
+	}
+	select {
+	case s.messages <- msg:
+		s.mu.Unlock()
+		return true
+	default:
+		s.mu.Unlock()
+		s.close(ErrSlowSubscriber)
+		return false
+	}
+}
+
+func (s *localSubscription) close(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.err = err
+	close(s.messages)
+}
@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLocalVerify(t *testing.T) {
+	l := &Local{BaseURL: "https://example.com/files", SigningKey: []byte("secret")}
+	future := time.Now().Add(time.Hour).Unix()
+	past := time.Now().Add(-time.Minute).Unix()
+
+	for _, test := range []struct {
+		name      string
+		key       string
+		expires   string
+		signature string
+		want      bool
+	}{
+		{"valid", "media/1/a.png", strconv.FormatInt(future, 10), l.sign("media/1/a.png", future), true},
+		{"leading slash", "/media/1/a.png", strconv.FormatInt(future, 10), l.sign("media/1/a.png", future), true},
+		{"expired", "media/1/a.png", strconv.FormatInt(past, 10), l.sign("media/1/a.png", past), false},
+		{"other key", "media/2/a.png", strconv.FormatInt(future, 10), l.sign("media/1/a.png", future), false},
+		{"extended expiry", "media/1/a.png", strconv.FormatInt(future+1, 10), l.sign("media/1/a.png", future), false},
+		{"other signing key", "media/1/a.png", strconv.FormatInt(future, 10),
+			(&Local{SigningKey: []byte("other")}).sign("media/1/a.png", future), false},
+		{"invalid expiry", "media/1/a.png", "soon", l.sign("media/1/a.png", future), false},
+		{"empty signature", "media/1/a.png", strconv.FormatInt(future, 10), "", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if got := l.Verify(test.key, test.expires, test.signature); got != test.want {
+				t.Errorf("Verify = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// TestLocalSignedURL checks that the URLs made by SignedURL pass Verify.
+func TestLocalSignedURL(t *testing.T) {
+	l := &Local{BaseURL: "https://example.com/files", SigningKey: []byte("secret")}
+
+	signed, err := l.SignedURL(context.Background(), "media/1/a.png", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(signed, "https://example.com/files/media/1/a.png?") {
+		t.Fatalf("SignedURL = %q, want it below the base URL", signed)
+	}
+
+	query, err := url.ParseQuery(signed[strings.Index(signed, "?")+1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !l.Verify("media/1/a.png", query.Get("expires"), query.Get("signature")) {
+		t.Error("the signed URL does not verify")
+	}
+}
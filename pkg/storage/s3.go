@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"time"
+
+	"github.com/bwoff11/frens/pkg/config"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3 stores objects in a bucket of an S3 compatible service such as AWS S3
+// or MinIO.
+type S3 struct {
+	Client *minio.Client
+	Bucket string
+}
+
+// NewS3 connects to the configured service. The bucket must already exist.
+func NewS3(config *config.StorageS3Config) (*S3, error) {
+	lookup := minio.BucketLookupAuto
+	if config.PathStyle {
+		lookup = minio.BucketLookupPath
+	}
+
+	client, err := minio.New(config.Endpoint, &minio.Options{
+		Creds:        credentials.NewStaticV4(config.AccessKey, config.SecretKey, ""),
+		Secure:       config.UseSSL,
+		Region:       config.Region,
+		BucketLookup: lookup,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &S3{Client: client, Bucket: config.Bucket}, nil
+}
+
+func (s *S3) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	_, err := s.Client.PutObject(ctx, s.Bucket, key, r, size, minio.PutObjectOptions{
+		ContentType: contentType,
+	})
+	return err
+}
+
+func (s *S3) Get(ctx context.Context, key string) (io.ReadCloser, *Object, error) {
+	object, err := s.Client.GetObject(ctx, s.Bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, nil, s.mapError(err)
+	}
+
+	// GetObject is lazy, so errors such as a missing key show up here
+	info, err := object.Stat()
+	if err != nil {
+		object.Close()
+		return nil, nil, s.mapError(err)
+	}
+	return object, objectFromInfo(info), nil
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	return s.Client.RemoveObject(ctx, s.Bucket, key, minio.RemoveObjectOptions{})
+}
+
+func (s *S3) Stat(ctx context.Context, key string) (*Object, error) {
+	info, err := s.Client.StatObject(ctx, s.Bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return nil, s.mapError(err)
+	}
+	return objectFromInfo(info), nil
+}
+
+func (s *S3) List(ctx context.Context, prefix string, fn func(Object) error) error {
+	// Stop the listing when returning early
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for info := range s.Client.ListObjects(ctx, s.Bucket, minio.ListObjectsOptions{
+		Prefix:    prefix,
+		Recursive: true,
+	}) {
+		if info.Err != nil {
+			return info.Err
+		}
+		if err := fn(Object{Key: info.Key, Size: info.Size, LastModified: info.LastModified}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *S3) SignedURL(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	signed, err := s.Client.PresignedGetObject(ctx, s.Bucket, key, expiry, url.Values{})
+	if err != nil {
+		return "", err
+	}
+	return signed.String(), nil
+}
+
+func (s *S3) mapError(err error) error {
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return ErrNotFound
+	}
+	return err
+}
+
+func objectFromInfo(info minio.ObjectInfo) *Object {
+	return &Object{
+		Key:          info.Key,
+		Size:         info.Size,
+		ContentType:  info.ContentType,
+		LastModified: info.LastModified,
+	}
+}
@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bwoff11/frens/pkg/config"
+	"github.com/minio/minio-go/v7"
+)
+
+// TestS3 runs against the S3 compatible service in FRENS_TEST_S3_ENDPOINT,
+// like localhost:9000 for a local MinIO, and is skipped if it isn't set.
+// FRENS_TEST_S3_BUCKET (default frens-test), FRENS_TEST_S3_ACCESS_KEY,
+// FRENS_TEST_S3_SECRET_KEY and FRENS_TEST_S3_USE_SSL configure the rest. The
+// bucket is created if it doesn't exist.
+func TestS3(t *testing.T) {
+	endpoint := os.Getenv("FRENS_TEST_S3_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("FRENS_TEST_S3_ENDPOINT is not set")
+	}
+	bucket := os.Getenv("FRENS_TEST_S3_BUCKET")
+	if bucket == "" {
+		bucket = "frens-test"
+	}
+	useSSL, _ := strconv.ParseBool(os.Getenv("FRENS_TEST_S3_USE_SSL"))
+
+	s, err := NewS3(&config.StorageS3Config{
+		Endpoint:  endpoint,
+		UseSSL:    useSSL,
+		PathStyle: true,
+		Bucket:    bucket,
+		AccessKey: os.Getenv("FRENS_TEST_S3_ACCESS_KEY"),
+		SecretKey: os.Getenv("FRENS_TEST_S3_SECRET_KEY"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	exists, err := s.Client.BucketExists(ctx, bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists {
+		if err := s.Client.MakeBucket(ctx, bucket, minio.MakeBucketOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	key := "test/" + strconv.FormatInt(time.Now().UnixNano(), 10) + "/object.txt"
+	content := []byte("hello from frens")
+	defer s.Delete(context.Background(), key)
+
+	if err := s.Put(ctx, key, bytes.NewReader(content), int64(len(content)), "text/plain"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	object, err := s.Stat(ctx, key)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if object.Key != key || object.Size != int64(len(content)) || object.ContentType != "text/plain" {
+		t.Errorf("Stat = %+v, want key %q, size %d and type text/plain", object, key, len(content))
+	}
+
+	r, object, err := s.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	got, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) || object.Size != int64(len(content)) {
+		t.Errorf("Get = %q (size %d), want %q", got, object.Size, content)
+	}
+
+	signed, err := s.SignedURL(ctx, key, time.Minute)
+	if err != nil {
+		t.Fatalf("SignedURL: %v", err)
+	}
+	resp, err := http.Get(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(got, content) {
+		t.Errorf("GET of the signed URL = %d %q, want 200 %q", resp.StatusCode, got, content)
+	}
+
+	if err := s.Delete(ctx, key); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := s.Stat(ctx, key); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Stat after Delete = %v, want ErrNotFound", err)
+	}
+	if _, _, err := s.Get(ctx, key); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get after Delete = %v, want ErrNotFound", err)
+	}
+
+	// Deleting a missing object is not an error
+	if err := s.Delete(ctx, key); err != nil {
+		t.Errorf("Delete of a missing object: %v", err)
+	}
+}
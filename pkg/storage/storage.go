@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/bwoff11/frens/pkg/config"
+)
+
+// ErrNotFound is returned when an object does not exist.
+var ErrNotFound = errors.New("object not found")
+
+// Object describes a stored object.
+type Object struct {
+	Key          string
+	Size         int64
+	ContentType  string
+	LastModified time.Time
+}
+
+// Storage is a place to keep uploaded files. Keys are slash separated paths
+// such as "media/12/avatar.png".
+type Storage interface {
+	// Put stores size bytes read from r under key, replacing any existing
+	// object.
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+
+	// Get opens the object stored under key. The caller must close it.
+	Get(ctx context.Context, key string) (io.ReadCloser, *Object, error)
+
+	// Delete removes the object stored under key. Deleting a missing
+	// object is not an error.
+	Delete(ctx context.Context, key string) error
+
+	// Stat describes the object stored under key.
+	Stat(ctx context.Context, key string) (*Object, error)
+
+	// List calls fn for every object whose key starts with prefix, in no
+	// particular order. The content type of listed objects is not set. An
+	// error returned by fn stops the listing and is returned.
+	List(ctx context.Context, prefix string, fn func(Object) error) error
+
+	// SignedURL returns a URL granting read access to the object until the
+	// expiry has passed.
+	SignedURL(ctx context.Context, key string, expiry time.Duration) (string, error)
+}
+
+// New creates the backend selected in the configuration.
+func New(config *config.StorageConfig) (Storage, error) {
+	switch config.Type {
+	case "local":
+		return NewLocal(config.Local.Path(), config.Local.BaseURL, []byte(config.Local.SigningKey))
+	case "s3":
+		return NewS3(&config.S3)
+	default:
+		return nil, fmt.Errorf("unknown storage type %q", config.Type)
+	}
+}
@@ -0,0 +1,128 @@
+package timeline
+
+import (
+	"sort"
+	"sync"
+)
+
+// MemoryStore keeps timelines in process memory. Timelines are lost on
+// restart and rebuilt when they are next read.
+type MemoryStore struct {
+	mu        sync.RWMutex
+	max       int
+	timelines map[uint32][]Entry
+}
+
+// NewMemoryStore creates a store keeping at most max entries per timeline.
+func NewMemoryStore(max int) *MemoryStore {
+	return &MemoryStore{
+		max:       max,
+		timelines: make(map[uint32][]Entry),
+	}
+}
+
+func (ms *MemoryStore) Add(userIDs []uint32, entry Entry) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	for _, userID := range userIDs {
+		// Timelines that were never read are built when they are first read
+		entries, ok := ms.timelines[userID]
+		if !ok {
+			continue
+		}
+
+		i := sort.Search(len(entries), func(i int) bool {
+			return !entries[i].Before(entry)
+		})
+		if i < len(entries) && entries[i].PostID == entry.PostID {
+			continue
+		}
+
+		entries = append(entries, Entry{})
+		copy(entries[i+1:], entries[i:])
+		entries[i] = entry
+		if ms.max > 0 && len(entries) > ms.max {
+			entries = entries[:ms.max]
+		}
+		ms.timelines[userID] = entries
+	}
+	return nil
+}
+
+func (ms *MemoryStore) Range(userID uint32, from *Entry, newer bool, limit int) ([]Entry, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	entries := ms.timelines[userID]
+	var page []Entry
+
+	switch {
+	case from == nil:
+		if limit > len(entries) {
+			limit = len(entries)
+		}
+		page = append(page, entries[:limit]...)
+	case newer:
+		end := sort.Search(len(entries), func(i int) bool {
+			return !entries[i].Before(*from)
+		})
+		for i := end - 1; i >= 0 && len(page) < limit; i-- {
+			page = append(page, entries[i])
+		}
+	default:
+		start := sort.Search(len(entries), func(i int) bool {
+			return from.Before(entries[i])
+		})
+		for i := start; i < len(entries) && len(page) < limit; i++ {
+			page = append(page, entries[i])
+		}
+	}
+	return page, nil
+}
+
+func (ms *MemoryStore) Replace(userID uint32, entries []Entry) error {
+	sorted := make([]Entry, len(entries))
+	copy(sorted, entries)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Before(sorted[j])
+	})
+	if ms.max > 0 && len(sorted) > ms.max {
+		sorted = sorted[:ms.max]
+	}
+
+	ms.mu.Lock()
+	ms.timelines[userID] = sorted
+	ms.mu.Unlock()
+	return nil
+}
+
+func (ms *MemoryStore) Materialized(userID uint32) (bool, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	_, ok := ms.timelines[userID]
+	return ok, nil
+}
+
+func (ms *MemoryStore) Invalidate(userIDs []uint32) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	for _, userID := range userIDs {
+		delete(ms.timelines, userID)
+	}
+	return nil
+}
+
+func (ms *MemoryStore) Trim(max int) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	for userID, entries := range ms.timelines {
+		if len(entries) > max {
+			ms.timelines[userID] = entries[:max]
+		}
+	}
+	return nil
+}
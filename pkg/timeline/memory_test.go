@@ -0,0 +1,36 @@
+package timeline
+
+import "testing"
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore(10))
+}
+
+func TestMemoryStoreMax(t *testing.T) {
+	store := NewMemoryStore(3)
+	entries := testEntries(5)
+
+	if err := store.Replace(1, entries); err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.Range(1, nil, false, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint32{5, 4, 3}; !equalIDs(postIDs(got), want) {
+		t.Errorf("Range after Replace = %v, want %v", postIDs(got), want)
+	}
+
+	// Adding a newer entry pushes out the oldest one
+	newest := Entry{PostID: 6, AuthorID: 1, CreatedAt: entries[0].CreatedAt.Add(1)}
+	if err := store.Add([]uint32{1}, newest); err != nil {
+		t.Fatal(err)
+	}
+	got, err = store.Range(1, nil, false, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint32{6, 5, 4}; !equalIDs(postIDs(got), want) {
+		t.Errorf("Range after Add = %v, want %v", postIDs(got), want)
+	}
+}
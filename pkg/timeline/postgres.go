@@ -0,0 +1,154 @@
+package timeline
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// postgresEntry is a row of a materialized timeline.
+type postgresEntry struct {
+	UserID    uint32    `gorm:"primary_key;auto_increment:false"`
+	PostID    uint32    `gorm:"primary_key;auto_increment:false"`
+	AuthorID  uint32    `gorm:"not null"`
+	CreatedAt time.Time `gorm:"not null"`
+}
+
+func (postgresEntry) TableName() string { return "timeline_entries" }
+
+// postgresTimeline records that a user's timeline has been materialized.
+type postgresTimeline struct {
+	UserID    uint32 `gorm:"primary_key;auto_increment:false"`
+	RebuiltAt time.Time
+}
+
+func (postgresTimeline) TableName() string { return "timelines" }
+
+// addBatchSize limits how many timelines a single fan-out insert touches.
+const addBatchSize = 1000
+
+// PostgresStore keeps timelines in the database so they survive restarts
+// and can be shared between instances.
+type PostgresStore struct {
+	DB *gorm.DB
+}
+
+// NewPostgresStore creates a store on the given connection, creating its
+// tables if needed.
+func NewPostgresStore(db *gorm.DB) (*PostgresStore, error) {
+	if err := db.AutoMigrate(&postgresEntry{}, &postgresTimeline{}).Error; err != nil {
+		return nil, err
+	}
+	if err := db.Model(&postgresEntry{}).
+		AddIndex("idx_timeline_entries_user_created", "user_id", "created_at", "post_id").Error; err != nil {
+		return nil, err
+	}
+	return &PostgresStore{DB: db}, nil
+}
+
+func (ps *PostgresStore) Add(userIDs []uint32, entry Entry) error {
+	for start := 0; start < len(userIDs); start += addBatchSize {
+		end := start + addBatchSize
+		if end > len(userIDs) {
+			end = len(userIDs)
+		}
+
+		// Timelines that were never read are built when they are first read
+		if err := ps.DB.Exec(`
+			INSERT INTO timeline_entries (user_id, post_id, author_id, created_at)
+			SELECT user_id, ?, ?, ? FROM timelines WHERE user_id IN (?)
+			ON CONFLICT DO NOTHING`,
+			entry.PostID, entry.AuthorID, entry.CreatedAt, userIDs[start:end],
+		).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ps *PostgresStore) Range(userID uint32, from *Entry, newer bool, limit int) ([]Entry, error) {
+	query := ps.DB.Where("user_id = ?", userID)
+	switch {
+	case from == nil:
+		query = query.Order("created_at DESC, post_id DESC")
+	case newer:
+		query = query.Where("(created_at, post_id) > (?, ?)", from.CreatedAt, from.PostID).
+			Order("created_at ASC, post_id ASC")
+	default:
+		query = query.Where("(created_at, post_id) < (?, ?)", from.CreatedAt, from.PostID).
+			Order("created_at DESC, post_id DESC")
+	}
+
+	var rows []postgresEntry
+	if err := query.Limit(limit).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	entries := make([]Entry, len(rows))
+	for i, row := range rows {
+		entries[i] = Entry{PostID: row.PostID, AuthorID: row.AuthorID, CreatedAt: row.CreatedAt}
+	}
+	return entries, nil
+}
+
+func (ps *PostgresStore) Replace(userID uint32, entries []Entry) error {
+	return ps.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Delete(&postgresEntry{}).Error; err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			if err := tx.Create(&postgresEntry{
+				UserID:    userID,
+				PostID:    entry.PostID,
+				AuthorID:  entry.AuthorID,
+				CreatedAt: entry.CreatedAt,
+			}).Error; err != nil {
+				return err
+			}
+		}
+
+		return tx.Save(&postgresTimeline{UserID: userID, RebuiltAt: time.Now()}).Error
+	})
+}
+
+func (ps *PostgresStore) Materialized(userID uint32) (bool, error) {
+	var count int
+	if err := ps.DB.Model(&postgresTimeline{}).Where("user_id = ?", userID).Count(&count).Error; err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func (ps *PostgresStore) Invalidate(userIDs []uint32) error {
+	for start := 0; start < len(userIDs); start += addBatchSize {
+		end := start + addBatchSize
+		if end > len(userIDs) {
+			end = len(userIDs)
+		}
+
+		if err := ps.DB.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Where("user_id IN (?)", userIDs[start:end]).Delete(&postgresTimeline{}).Error; err != nil {
+				return err
+			}
+			return tx.Where("user_id IN (?)", userIDs[start:end]).Delete(&postgresEntry{}).Error
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ps *PostgresStore) Trim(max int) error {
+	return ps.DB.Exec(`
+		DELETE FROM timeline_entries AS t
+		USING (
+			SELECT user_id, post_id, row_number() OVER (
+				PARTITION BY user_id ORDER BY created_at DESC, post_id DESC
+			) AS position
+			FROM timeline_entries
+		) AS ranked
+		WHERE t.user_id = ranked.user_id AND t.post_id = ranked.post_id AND ranked.position > ?`,
+		max,
+	).Error
+}
@@ -0,0 +1,154 @@
+package timeline
+
+import (
+	"testing"
+	"time"
+)
+
+// testEntries returns count entries of distinct posts, newest first.
+func testEntries(count int) []Entry {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	entries := make([]Entry, count)
+	for i := range entries {
+		entries[i] = Entry{
+			PostID:    uint32(count - i),
+			AuthorID:  1,
+			CreatedAt: base.Add(time.Duration(count-i) * time.Minute),
+		}
+	}
+	return entries
+}
+
+func postIDs(entries []Entry) []uint32 {
+	ids := make([]uint32, len(entries))
+	for i, entry := range entries {
+		ids[i] = entry.PostID
+	}
+	return ids
+}
+
+func equalIDs(a, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// testStore checks the behaviour every Store must have. The store must be
+// empty and keep at least 10 entries per timeline.
+func testStore(t *testing.T, store Store) {
+	entries := testEntries(5) // Posts 5 to 1
+
+	t.Run("unmaterialized", func(t *testing.T) {
+		if ok, err := store.Materialized(1); err != nil || ok {
+			t.Fatalf("Materialized = %v, %v, want false", ok, err)
+		}
+
+		// Adding to a timeline that was never built does nothing
+		if err := store.Add([]uint32{1}, entries[0]); err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := store.Materialized(1); err != nil || ok {
+			t.Fatalf("Materialized after Add = %v, %v, want false", ok, err)
+		}
+	})
+
+	t.Run("replace", func(t *testing.T) {
+		// Out of order on purpose
+		if err := store.Replace(1, []Entry{entries[3], entries[1], entries[4]}); err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := store.Materialized(1); err != nil || !ok {
+			t.Fatalf("Materialized = %v, %v, want true", ok, err)
+		}
+		got, err := store.Range(1, nil, false, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []uint32{4, 2, 1}; !equalIDs(postIDs(got), want) {
+			t.Errorf("Range = %v, want %v", postIDs(got), want)
+		}
+	})
+
+	t.Run("add", func(t *testing.T) {
+		// Post 2 is already there and must not be duplicated
+		for _, entry := range []Entry{entries[0], entries[2], entries[3]} {
+			if err := store.Add([]uint32{1, 2}, entry); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got, err := store.Range(1, nil, false, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []uint32{5, 4, 3, 2, 1}; !equalIDs(postIDs(got), want) {
+			t.Errorf("Range = %v, want %v", postIDs(got), want)
+		}
+
+		// User 2 never had a timeline
+		if ok, err := store.Materialized(2); err != nil || ok {
+			t.Errorf("Materialized(2) = %v, %v, want false", ok, err)
+		}
+	})
+
+	t.Run("range", func(t *testing.T) {
+		from := entries[2] // Post 3
+		for _, test := range []struct {
+			name  string
+			from  *Entry
+			newer bool
+			limit int
+			want  []uint32
+		}{
+			{"newest", nil, false, 2, []uint32{5, 4}},
+			{"older", &from, false, 10, []uint32{2, 1}},
+			{"older limited", &from, false, 1, []uint32{2}},
+			{"newer", &from, true, 10, []uint32{4, 5}},
+			{"newer limited", &from, true, 1, []uint32{4}},
+		} {
+			t.Run(test.name, func(t *testing.T) {
+				got, err := store.Range(1, test.from, test.newer, test.limit)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !equalIDs(postIDs(got), test.want) {
+					t.Errorf("Range = %v, want %v", postIDs(got), test.want)
+				}
+			})
+		}
+	})
+
+	t.Run("trim", func(t *testing.T) {
+		if err := store.Trim(3); err != nil {
+			t.Fatal(err)
+		}
+		got, err := store.Range(1, nil, false, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []uint32{5, 4, 3}; !equalIDs(postIDs(got), want) {
+			t.Errorf("Range = %v, want %v", postIDs(got), want)
+		}
+	})
+
+	t.Run("invalidate", func(t *testing.T) {
+		if err := store.Invalidate([]uint32{1}); err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := store.Materialized(1); err != nil || ok {
+			t.Fatalf("Materialized = %v, %v, want false", ok, err)
+		}
+		got, err := store.Range(1, nil, false, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 0 {
+			t.Errorf("Range = %v, want nothing", postIDs(got))
+		}
+	})
+}
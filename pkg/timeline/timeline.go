@@ -0,0 +1,65 @@
+package timeline
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bwoff11/frens/pkg/config"
+	"github.com/jinzhu/gorm"
+)
+
+// Entry is a post in a user's home timeline. Timelines are ordered newest
+// first by CreatedAt, with PostID breaking ties.
+type Entry struct {
+	PostID    uint32
+	AuthorID  uint32
+	CreatedAt time.Time
+}
+
+// Before reports whether e comes before other in timeline order, i.e. is
+// newer.
+func (e Entry) Before(other Entry) bool {
+	if !e.CreatedAt.Equal(other.CreatedAt) {
+		return e.CreatedAt.After(other.CreatedAt)
+	}
+	return e.PostID > other.PostID
+}
+
+// Store holds materialized home timelines.
+type Store interface {
+	// Add inserts the entry into the timelines of the given users.
+	Add(userIDs []uint32, entry Entry) error
+
+	// Range returns up to limit entries of the user's timeline. Without a
+	// starting entry it returns the newest entries. Otherwise it returns
+	// the entries older than from, newest first, or if newer is set the
+	// entries newer than from, oldest first.
+	Range(userID uint32, from *Entry, newer bool, limit int) ([]Entry, error)
+
+	// Replace overwrites the user's timeline with the given entries and
+	// marks it as materialized.
+	Replace(userID uint32, entries []Entry) error
+
+	// Materialized reports whether the user's timeline has been built. A
+	// timeline that was never built must be rebuilt before it is read.
+	Materialized(userID uint32) (bool, error)
+
+	// Invalidate drops the timelines of the given users, so they are
+	// rebuilt when they are next read.
+	Invalidate(userIDs []uint32) error
+
+	// Trim drops all but the newest max entries of every timeline.
+	Trim(max int) error
+}
+
+// New creates the store selected in the configuration.
+func New(config *config.TimelineConfig, db *gorm.DB) (Store, error) {
+	switch config.Store {
+	case "memory":
+		return NewMemoryStore(config.MaxEntries), nil
+	case "postgres":
+		return NewPostgresStore(db)
+	default:
+		return nil, fmt.Errorf("unknown timeline store %q", config.Store)
+	}
+}
@@ -0,0 +1,57 @@
+package transcode
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"time"
+)
+
+// Fake pretends to transcode without running anything. The input is
+// returned as is, with the configured duration and dimensions and a plain
+// poster frame. If Err is set, it is returned instead. It is meant for tests
+// and for development without ffmpeg.
+type Fake struct {
+	Duration time.Duration // Defaults to a second
+	Width    int           // Defaults to 16
+	Height   int           // Defaults to 16
+	Err      error
+}
+
+func (f *Fake) Transcode(ctx context.Context, src io.Reader, kind Kind) (*Result, error) {
+	if f.Err != nil {
+		return nil, f.Err
+	}
+
+	data, err := io.ReadAll(src)
+	if err != nil {
+		return nil, err
+	}
+	result := &Result{Data: data, ContentType: "video/mp4", Duration: f.Duration}
+	if result.Duration == 0 {
+		result.Duration = time.Second
+	}
+
+	if kind == KindAudio {
+		result.ContentType = "audio/mp4"
+		return result, nil
+	}
+
+	result.Width, result.Height = f.Width, f.Height
+	if result.Width == 0 || result.Height == 0 {
+		result.Width, result.Height = 16, 16
+	}
+	poster := image.NewGray(image.Rect(0, 0, result.Width, result.Height))
+	for i := range poster.Pix {
+		poster.Pix[i] = color.Gray{Y: 128}.Y
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, poster, nil); err != nil {
+		return nil, err
+	}
+	result.Poster = buf.Bytes()
+	return result, nil
+}
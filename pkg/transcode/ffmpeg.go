@@ -0,0 +1,172 @@
+package transcode
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FFmpeg transcodes with the ffmpeg and ffprobe binaries. Video becomes
+// H.264 and audio AAC, both in MP4 containers that can be streamed before
+// they are fully downloaded.
+type FFmpeg struct {
+	Path      string
+	ProbePath string
+}
+
+// NewFFmpeg creates a transcoder running the binaries at the given paths,
+// or looking them up in PATH if they are empty.
+func NewFFmpeg(path, probePath string) *FFmpeg {
+	if path == "" {
+		path = "ffmpeg"
+	}
+	if probePath == "" {
+		probePath = "ffprobe"
+	}
+	return &FFmpeg{Path: path, ProbePath: probePath}
+}
+
+func (f *FFmpeg) Transcode(ctx context.Context, src io.Reader, kind Kind) (*Result, error) {
+	dir, err := os.MkdirTemp("", "frens-transcode-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	input := filepath.Join(dir, "input")
+	if err := writeFile(input, src); err != nil {
+		return nil, err
+	}
+
+	output := filepath.Join(dir, "output.mp4")
+	args := []string{"-i", input, "-map_metadata", "-1"}
+	result := &Result{ContentType: "video/mp4"}
+	switch kind {
+	case KindVideo:
+		args = append(args, videoArgs...)
+		args = append(args, audioArgs...)
+	case KindGIF:
+		args = append(args, videoArgs...)
+		args = append(args, "-an")
+	case KindAudio:
+		args = append(args, "-vn")
+		args = append(args, audioArgs...)
+		result.ContentType = "audio/mp4"
+	default:
+		return nil, fmt.Errorf("unknown kind %q", kind)
+	}
+	args = append(args, "-movflags", "+faststart", output)
+	if err := f.run(ctx, args...); err != nil {
+		return nil, err
+	}
+
+	if err := f.probe(ctx, output, result); err != nil {
+		return nil, err
+	}
+
+	if kind != KindAudio {
+		// The very first frame is often black, so take one a bit later
+		seek := result.Duration / 2
+		if seek > time.Second {
+			seek = time.Second
+		}
+		poster := filepath.Join(dir, "poster.jpg")
+		err := f.run(ctx, "-ss", strconv.FormatFloat(seek.Seconds(), 'f', 3, 64), "-i", output,
+			"-frames:v", "1", "-q:v", "2", poster)
+		if err != nil {
+			return nil, err
+		}
+		if result.Poster, err = os.ReadFile(poster); err != nil {
+			return nil, err
+		}
+	}
+
+	if result.Data, err = os.ReadFile(output); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+var (
+	// Browsers only play 4:2:0 H.264, which needs even dimensions
+	videoArgs = []string{
+		"-c:v", "libx264", "-preset", "veryfast", "-crf", "23", "-pix_fmt", "yuv420p",
+		"-vf", "scale=trunc(iw/2)*2:trunc(ih/2)*2",
+	}
+	audioArgs = []string{"-c:a", "aac", "-b:a", "128k"}
+)
+
+// run runs ffmpeg. Failures caused by the input are returned as
+// ErrInvalidMedia.
+func (f *FFmpeg) run(ctx context.Context, args ...string) error {
+	args = append([]string{"-hide_banner", "-nostdin", "-loglevel", "error", "-y"}, args...)
+	cmd := exec.CommandContext(ctx, f.Path, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && ctx.Err() == nil {
+		return fmt.Errorf("%w: %s", ErrInvalidMedia, strings.TrimSpace(stderr.String()))
+	}
+	return err
+}
+
+// probe fills in the duration and dimensions of the file.
+func (f *FFmpeg) probe(ctx context.Context, path string, result *Result) error {
+	cmd := exec.CommandContext(ctx, f.ProbePath, "-v", "error", "-print_format", "json",
+		"-show_entries", "format=duration:stream=codec_type,width,height", path)
+	out, err := cmd.Output()
+	if err != nil {
+		return err
+	}
+
+	var probed struct {
+		Format struct {
+			Duration string `json:"duration"`
+		} `json:"format"`
+		Streams []struct {
+			CodecType string `json:"codec_type"`
+			Width     int    `json:"width"`
+			Height    int    `json:"height"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(out, &probed); err != nil {
+		return err
+	}
+
+	seconds, err := strconv.ParseFloat(probed.Format.Duration, 64)
+	if err != nil {
+		return fmt.Errorf("%w: unknown duration", ErrInvalidMedia)
+	}
+	result.Duration = time.Duration(seconds * float64(time.Second))
+
+	for _, stream := range probed.Streams {
+		if stream.CodecType == "video" {
+			result.Width, result.Height = stream.Width, stream.Height
+			break
+		}
+	}
+	return nil
+}
+
+func writeFile(path string, src io.Reader) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, src)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
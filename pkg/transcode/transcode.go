@@ -0,0 +1,52 @@
+package transcode
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/bwoff11/frens/pkg/config"
+)
+
+// Kind is the kind of media being transcoded.
+type Kind string
+
+const (
+	KindVideo Kind = "video"
+	KindGIF   Kind = "gif" // Animated GIFs, which become silent videos
+	KindAudio Kind = "audio"
+)
+
+// ErrInvalidMedia is returned when the input can't be transcoded.
+var ErrInvalidMedia = errors.New("invalid media")
+
+// Result is a transcoded file along with what was learned about it.
+type Result struct {
+	Data        []byte
+	ContentType string
+	Duration    time.Duration
+	Width       int    // Zero for audio
+	Height      int    // Zero for audio
+	Poster      []byte // A frame of the video as a JPEG, nil for audio
+}
+
+// Transcoder converts video and audio into formats every browser plays.
+// Metadata of the input, such as the location a video was recorded at, is
+// not carried over.
+type Transcoder interface {
+	Transcode(ctx context.Context, src io.Reader, kind Kind) (*Result, error)
+}
+
+// New creates the transcoder selected in the configuration.
+func New(config *config.TranscodeConfig) (Transcoder, error) {
+	switch config.Transcoder {
+	case "ffmpeg":
+		return NewFFmpeg(config.FFmpegPath, config.FFprobePath), nil
+	case "fake":
+		return &Fake{}, nil
+	default:
+		return nil, fmt.Errorf("unknown transcoder %q", config.Transcoder)
+	}
+}
@@ -0,0 +1,296 @@
+// Package webpush sends Web Push messages (RFC 8030). Payloads are encrypted
+// for the subscription (RFC 8291) and requests are signed with the
+// application server's VAPID key (RFC 8292).
+package webpush
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/hkdf"
+)
+
+// recordSize is the size of the single record a payload is encrypted into.
+// Push services must accept at least 4096 bytes.
+const recordSize = 4096
+
+// MaxPayloadSize is the largest payload that fits in a message, leaving
+// room for the encryption header, the padding delimiter and the tag.
+const MaxPayloadSize = recordSize - 86 - 1 - 16
+
+var (
+	// ErrGone is returned when the push service reports that the
+	// subscription expired or was removed. It should not be used again.
+	ErrGone = errors.New("push subscription is gone")
+
+	errInvalidVAPIDKey = errors.New("the VAPID private key must be a base64url encoded P-256 private key")
+
+	// ErrInvalidKeys is returned for subscriptions whose keys aren't a P-256
+	// public key and a 16 byte authentication secret.
+	ErrInvalidKeys = errors.New("invalid push subscription keys")
+)
+
+// StatusError is returned when the push service rejects a message.
+type StatusError struct {
+	StatusCode int
+
+	// RetryAfter is how long the push service asked to wait before trying
+	// again, or zero if it didn't.
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("push service responded with %d", e.StatusCode)
+}
+
+// Temporary reports whether sending the message again later may succeed.
+func (e *StatusError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// Subscription is where a user agent receives messages, as returned by
+// PushManager.subscribe() in the browser. The keys are base64url encoded.
+type Subscription struct {
+	Endpoint string
+	P256dh   string
+	Auth     string
+}
+
+// Validate checks that the subscription's keys can be encrypted for.
+func (s Subscription) Validate() error {
+	_, _, err := s.keys()
+	return err
+}
+
+func (s Subscription) keys() (*ecdh.PublicKey, []byte, error) {
+	rawKey, err := decode(s.P256dh)
+	if err != nil {
+		return nil, nil, ErrInvalidKeys
+	}
+	key, err := ecdh.P256().NewPublicKey(rawKey)
+	if err != nil {
+		return nil, nil, ErrInvalidKeys
+	}
+	auth, err := decode(s.Auth)
+	if err != nil || len(auth) != 16 {
+		return nil, nil, ErrInvalidKeys
+	}
+	return key, auth, nil
+}
+
+// Message is a notification to send.
+type Message struct {
+	Payload []byte
+
+	// TTL is how long the push service keeps the message while the user
+	// agent is offline.
+	TTL time.Duration
+
+	// Urgency is very-low, low, normal or high. Empty means normal.
+	Urgency string
+}
+
+// Client sends messages to push services.
+type Client struct {
+	key       *ecdsa.PrivateKey
+	publicKey string
+	subject   string
+	baseURL   *url.URL
+	http      *http.Client
+}
+
+// NewClient creates a client signing with the VAPID private key, a base64url
+// encoded P-256 scalar. The subject is a mailto: or https: URL push services
+// can use to contact the operator. If baseURL is set, messages are sent there
+// instead of to the scheme and host of the subscription's endpoint, keeping
+// its path, so tests can use a local push service. Messages are sent with
+// httpClient, which should keep endpoints from reaching private networks.
+func NewClient(privateKey, subject, baseURL string, httpClient *http.Client) (*Client, error) {
+	raw, err := decode(privateKey)
+	if err != nil {
+		return nil, errInvalidVAPIDKey
+	}
+	ecdhKey, err := ecdh.P256().NewPrivateKey(raw)
+	if err != nil {
+		return nil, errInvalidVAPIDKey
+	}
+	key := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(raw)}
+	key.Curve = elliptic.P256()
+	key.X, key.Y = key.Curve.ScalarBaseMult(raw)
+
+	client := &Client{
+		key:       key,
+		publicKey: base64.RawURLEncoding.EncodeToString(ecdhKey.PublicKey().Bytes()),
+		subject:   subject,
+		http:      httpClient,
+	}
+	if baseURL != "" {
+		if client.baseURL, err = url.Parse(baseURL); err != nil {
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
+// PublicKey returns the VAPID public key, base64url encoded, which user
+// agents need to subscribe.
+func (c *Client) PublicKey() string {
+	return c.publicKey
+}
+
+// Send encrypts the message for the subscription and delivers it to the
+// push service.
+func (c *Client) Send(ctx context.Context, sub Subscription, msg Message) error {
+	if len(msg.Payload) > MaxPayloadSize {
+		return fmt.Errorf("payload of %d bytes is larger than %d bytes", len(msg.Payload), MaxPayloadSize)
+	}
+	body, err := encrypt(sub, msg.Payload)
+	if err != nil {
+		return err
+	}
+
+	endpoint, err := url.Parse(sub.Endpoint)
+	if err != nil {
+		return err
+	}
+	if c.baseURL != nil {
+		endpoint.Scheme = c.baseURL.Scheme
+		endpoint.Host = c.baseURL.Host
+	}
+
+	// The token is for the push service the message is sent to
+	token, err := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.RegisteredClaims{
+		Audience:  jwt.ClaimStrings{endpoint.Scheme + "://" + endpoint.Host},
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(12 * time.Hour)),
+		Subject:   c.subject,
+	}).SignedString(c.key)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("TTL", strconv.Itoa(int(msg.TTL.Seconds())))
+	if msg.Urgency != "" {
+		req.Header.Set("Urgency", msg.Urgency)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("vapid t=%s, k=%s", token, c.PublicKey()))
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return ErrGone
+	}
+	statusErr := &StatusError{StatusCode: resp.StatusCode}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		statusErr.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	return statusErr
+}
+
+// encrypt encrypts the payload into a single aes128gcm record as described
+// in RFC 8291, preceded by the header with the salt and the application
+// server's ephemeral public key.
+func encrypt(sub Subscription, payload []byte) ([]byte, error) {
+	uaPublic, authSecret, err := sub.keys()
+	if err != nil {
+		return nil, err
+	}
+
+	asPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := asPrivate.PublicKey().Bytes()
+	sharedSecret, err := asPrivate.ECDH(uaPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	// Combine the shared secret with the subscription's authentication
+	// secret, then derive the content encryption key and nonce
+	keyInfo := append(append([]byte("WebPush: info\x00"), uaPublic.Bytes()...), asPublic...)
+	ikm, err := expand(hkdf.Extract(sha256.New, sharedSecret, authSecret), keyInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+	prk := hkdf.Extract(sha256.New, ikm, salt)
+	cek, err := expand(prk, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := expand(prk, []byte("Content-Encoding: nonce\x00"), 12)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, 21+len(asPublic))
+	header = append(header, salt...)
+	header = binary.BigEndian.AppendUint32(header, recordSize)
+	header = append(header, byte(len(asPublic)))
+	header = append(header, asPublic...)
+
+	// The delimiter marks the last and only record
+	plaintext := append(append([]byte{}, payload...), 0x02)
+	return gcm.Seal(header, nonce, plaintext, nil), nil
+}
+
+func expand(prk, info []byte, length int) ([]byte, error) {
+	out := make([]byte, length)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, prk, info), out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// decode decodes base64url, with or without padding, as user agents differ.
+func decode(s string) ([]byte, error) {
+	if raw, err := base64.RawURLEncoding.DecodeString(s); err == nil {
+		return raw, nil
+	}
+	return base64.URLEncoding.DecodeString(s)
+}
@@ -1,11 +1,14 @@
 package service
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"time"
 
 	"github.com/bwoff11/frens/models"
 	"github.com/bwoff11/frens/pkg/database"
+	"github.com/bwoff11/frens/pkg/events"
 	"github.com/gofiber/fiber/v2"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/jsonapi"
@@ -16,6 +19,7 @@ type AuthService struct {
 	Database    *database.Database
 	JWTSecret   []byte
 	JWTDuration int
+	Events      events.Bus
 }
 
 type Token struct {
@@ -39,8 +43,17 @@ func (a *AuthService) Login(c *fiber.Ctx, email, password string) error {
 		})
 	}
 
+	// Each login starts a session, which the tokens refreshed from it keep
+	sessionID, err := newSessionID()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create token",
+		})
+	}
+
 	// Create the Claims
 	claims := jwt.RegisteredClaims{
+		ID:        sessionID,
 		Subject:   fmt.Sprint(user.ID),
 		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute * time.Duration(a.JWTDuration))),
 	}
@@ -75,6 +88,7 @@ func (a *AuthService) Register(c *fiber.Ctx, username, email, password string) e
 		Username: username,
 		Email:    email,
 		Password: string(hashedPassword),
+		Role:     models.RoleUser,
 	}
 
 	if err := a.Database.Conn.Create(&newUser).Error; err != nil {
@@ -83,6 +97,7 @@ func (a *AuthService) Register(c *fiber.Ctx, username, email, password string) e
 			"error": "Failed to create user",
 		})
 	}
+	a.Events.Publish(events.Event{Type: events.UserRegistered, ActorID: newUser.ID})
 
 	// Prepare the response
 	c.Response().Header.Set(fiber.HeaderContentType, jsonapi.MediaType)
@@ -103,6 +118,9 @@ func (a *AuthService) Refresh(c *fiber.Ctx) error {
 		"sub": userID,
 		"exp": time.Now().Add(time.Hour * time.Duration(a.JWTDuration)).Unix(),
 	}
+	if sessionID, err := getSessionID(c); err == nil {
+		newClaims["jti"] = sessionID
+	}
 
 	// Create token
 	newToken := jwt.NewWithClaims(jwt.SigningMethodHS256, newClaims)
@@ -120,3 +138,12 @@ func (a *AuthService) Refresh(c *fiber.Ctx) error {
 	// Respond with the user
 	return jsonapi.MarshalPayload(c.Response().BodyWriter(), &Token{ID: encryptedToken})
 }
+
+// newSessionID creates the random ID of a login session.
+func newSessionID() (string, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(random), nil
+}
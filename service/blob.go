@@ -0,0 +1,169 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+
+	"github.com/bwoff11/frens/models"
+	"github.com/bwoff11/frens/pkg/imageproc"
+	"github.com/jinzhu/gorm"
+)
+
+// createFromBlob creates the media as another reference to the stored blob
+// with the given hash. It reports false, without creating anything, if no
+// such blob exists.
+func (ms *MediaService) createFromBlob(media *models.Media, hash string) (bool, error) {
+	created := false
+	err := ms.Database.Conn.Transaction(func(tx *gorm.DB) error {
+		// Waits for a concurrent release of the blob, after which it is gone
+		result := tx.Model(&models.Blob{}).
+			Where("hash = ? AND ref_count > 0", hash).
+			UpdateColumn("ref_count", gorm.Expr("ref_count + 1"))
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+
+		var blob models.Blob
+		if err := tx.Where("hash = ?", hash).First(&blob).Error; err != nil {
+			return err
+		}
+
+		// Like in createWithBlob, the user is locked after the blob
+		if err := ms.checkQuota(tx, media.UserID, blob.Size); err != nil {
+			return err
+		}
+
+		media.SetBlob(&blob)
+		if err := tx.Create(media).Error; err != nil {
+			return err
+		}
+		created = true
+		return nil
+	})
+	return created, err
+}
+
+// createWithBlob stores the variants as a new blob and creates the media
+// referencing it. If an identical upload stored the blob in the meantime,
+// that one is referenced instead.
+func (ms *MediaService) createWithBlob(ctx context.Context, media *models.Media, blob *models.Blob, variants []imageproc.Variant) error {
+	return ms.withNewBlob(ctx, blob, variants, func(tx *gorm.DB) error {
+		if err := ms.checkQuota(tx, media.UserID, blob.Size); err != nil {
+			return err
+		}
+		// The blob is stored by now, so the user is locked after it here
+		media.SetBlob(blob)
+		return tx.Create(media).Error
+	})
+}
+
+// finishWithBlob stores the transcoded variants as a new blob, or references
+// an identical one, and marks the processing media as ready. It returns
+// errMediaGone if the media was deleted in the meantime.
+func (ms *MediaService) finishWithBlob(ctx context.Context, media *models.Media, blob *models.Blob, variants []imageproc.Variant) error {
+	return ms.withNewBlob(ctx, blob, variants, func(tx *gorm.DB) error {
+		media.SetBlob(blob)
+		result := tx.Model(&models.Media{}).
+			Where("id = ? AND state = ?", media.ID, models.MediaStateProcessing).
+			Updates(map[string]interface{}{
+				"key":          media.Key,
+				"blob_hash":    media.BlobHash,
+				"content_type": media.ContentType,
+				"size":         media.Size,
+				"width":        media.Width,
+				"height":       media.Height,
+				"blurhash":     media.Blurhash,
+				"duration":     media.Duration,
+				"state":        media.State,
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errMediaGone
+		}
+		return nil
+	})
+}
+
+// errMediaGone is returned when media was deleted while being processed.
+var errMediaGone = errors.New("media was deleted")
+
+// withNewBlob stores the variants as a new blob and runs reference in the
+// same transaction to make media point at it. If an identical blob was
+// stored in the meantime, its reference count is increased instead.
+func (ms *MediaService) withNewBlob(ctx context.Context, blob *models.Blob, variants []imageproc.Variant, reference func(tx *gorm.DB) error) error {
+	var stored []string
+	err := ms.Database.Conn.Transaction(func(tx *gorm.DB) error {
+		// Concurrent uploads of the same content wait here until the first
+		// one has stored the files
+		var refCount int
+		err := tx.Raw(`
+			INSERT INTO blobs (hash, created_at, content_type, size, width, height, blurhash, kind, duration, ref_count)
+			VALUES (?, NOW(), ?, ?, ?, ?, ?, ?, ?, 1)
+			ON CONFLICT (hash) DO UPDATE SET ref_count = blobs.ref_count + 1
+			RETURNING ref_count`,
+			blob.Hash, blob.ContentType, blob.Size, blob.Width, blob.Height, blob.Blurhash, blob.Kind, blob.Duration,
+		).Row().Scan(&refCount)
+		if err != nil {
+			return err
+		}
+
+		if refCount == 1 {
+			for _, variant := range variants {
+				key := blob.VariantKey(variant.Name)
+				if err := ms.Storage.Put(ctx, key, bytes.NewReader(variant.Data), int64(len(variant.Data)), variant.ContentType); err != nil {
+					return err
+				}
+				stored = append(stored, key)
+			}
+		}
+
+		return reference(tx)
+	})
+	if err != nil {
+		// The blob was rolled back, so its files are not referenced
+		for _, key := range stored {
+			if err := ms.Storage.Delete(ctx, key); err != nil {
+				log.Println("Failed to delete stored media:", err)
+			}
+		}
+	}
+	return err
+}
+
+// releaseBlob drops the media's reference to its blob as part of the
+// transaction deleting the media. The blob and its files are deleted along
+// with the last reference, in which case it reports true.
+func (ms *MediaService) releaseBlob(ctx context.Context, tx *gorm.DB, media *models.Media) (bool, error) {
+	// Media stored before deduplication owns its files
+	if media.BlobHash == "" {
+		ms.deleteFiles(ctx, media)
+		return true, nil
+	}
+
+	var refCount int
+	err := tx.Raw("UPDATE blobs SET ref_count = ref_count - 1 WHERE hash = ? RETURNING ref_count", media.BlobHash).
+		Row().Scan(&refCount)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if refCount > 0 {
+		return false, nil
+	}
+
+	if err := tx.Where("hash = ?", media.BlobHash).Delete(&models.Blob{}).Error; err != nil {
+		return false, err
+	}
+
+	// Uploads of the same content are blocked until the transaction ends,
+	// so the files can't be picked up again while they're being deleted
+	ms.deleteFiles(ctx, media)
+	return true, nil
+}
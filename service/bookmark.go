@@ -1,126 +1,189 @@
 package service
 
 import (
+	"errors"
 	"log"
+	"time"
 
 	"github.com/bwoff11/frens/models"
 	"github.com/bwoff11/frens/pkg/database"
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/jsonapi"
+	"github.com/jinzhu/gorm"
 )
 
-type BookmarkService struct{ Database *database.Database }
+type BookmarkService struct {
+	Database   *database.Database
+	Visibility *VisibilityPolicy
+	Views      *PostViews
+}
 
+// BookmarkPost bookmarks the post for the user making the request.
+// Bookmarking a post twice is not an error: it responds with 201 Created for
+// a new bookmark and with 200 OK and the existing bookmark otherwise.
 func (bs *BookmarkService) BookmarkPost(c *fiber.Ctx, postID uint32) error {
 	// Get the ID of the user making the request
 	userID, err := getRequestorID(c)
 	if err != nil {
 		// Log and handle error here
 		log.Println(err)
-		return c.Status(fiber.StatusInternalServerError).SendString("Failed to get user ID")
+		return writeError(c, fiber.StatusInternalServerError, "internal_error", "Failed to get user ID", "", nil)
 	}
 
 	// Check if the post exists
 	var post models.Post
 	if err := bs.Database.Conn.First(&post, postID).Error; err != nil {
 		// Post does not exist
-		return c.Status(fiber.StatusNotFound).SendString("Post not found")
+		return writeError(c, fiber.StatusNotFound, "post_not_found", "Post not found", "", nil)
 	}
 
-	// Check if the user exists
-	var user models.User
-	if err := bs.Database.Conn.First(&user, userID).Error; err != nil {
-		// User does not exist
-		return c.Status(fiber.StatusNotFound).SendString("User not found")
+	// Check if the user is allowed to see the post. Posts the user cannot
+	// see are reported as missing so their existence is not leaked.
+	visible, err := bs.Visibility.CanView(userID, &post)
+	if err != nil {
+		return writeError(c, fiber.StatusInternalServerError, "internal_error", "Failed to check post visibility", "", nil)
 	}
-
-	// Create new Bookmark
-	newBookmark := models.Bookmark{
-		UserID: userID,
-		PostID: postID,
+	if !visible {
+		return writeError(c, fiber.StatusNotFound, "post_not_found", "Post not found", "", nil)
 	}
 
-	// Save the bookmark to the database
-	if err := bs.Database.Conn.Create(&newBookmark).Error; err != nil {
-		// Log and handle error here
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create a bookmark",
-		})
+	// Look for an existing bookmark and create it if there is none, counting it
+	// on the post
+	bookmark := models.Bookmark{UserID: userID, PostID: postID}
+	created := false
+	err = bs.Database.Conn.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("user_id = ? AND post_id = ?", userID, postID).First(&bookmark).Error
+		if !gorm.IsRecordNotFoundError(err) {
+			return err
+		}
+		if err := tx.Create(&bookmark).Error; err != nil {
+			return database.MapError(err)
+		}
+		created = true
+		return adjustCount(tx, postID, bookmarkCount, 1)
+	})
+	if errors.Is(err, database.ErrUniqueViolation) {
+		// A concurrent request bookmarked the post first
+		err = bs.Database.Conn.Where("user_id = ? AND post_id = ?", userID, postID).First(&bookmark).Error
 	}
-
-	// Preload User and Post on the newly created Bookmark
-	if err := bs.Database.Conn.
-		Preload("User").
-		Preload("Post").
-		Preload("Post.User").
-		First(&newBookmark, newBookmark.ID).
-		Error; err != nil {
-		// Log and handle error here
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to retrieve the bookmark",
-		})
+	if errors.Is(err, database.ErrForeignKeyViolation) {
+		// The post was deleted in the meantime
+		return writeError(c, fiber.StatusNotFound, "post_not_found", "Post not found", "", nil)
 	}
-
-	// Set the content type to application/vnd.api+json
-	c.Response().Header.Set(fiber.HeaderContentType, jsonapi.MediaType)
-
-	// Marshal the bookmark into JSON API format
-	if err := jsonapi.MarshalPayload(c.Response().BodyWriter(), &newBookmark); err != nil {
+	if err != nil {
 		// Log and handle error here
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to marshal the bookmark",
-		})
+		return writeError(c, fiber.StatusInternalServerError, "internal_error", "Failed to create a bookmark", "", nil)
 	}
 
-	// Set the status code to 201 Created
-	c.Status(fiber.StatusCreated)
-
-	return nil
+	status := fiber.StatusOK
+	if created {
+		status = fiber.StatusCreated
+	}
+	return bs.writeBookmark(c, status, &bookmark)
 }
 
+// UnbookmarkPost removes the bookmark of the user making the request from the
+// post. Unbookmarking a post that isn't bookmarked is not an error: it
+// responds with 200 OK and the removed bookmark, or with 204 No Content if
+// there was none.
 func (bs *BookmarkService) UnbookmarkPost(c *fiber.Ctx, postID uint32) error {
 	// Get the ID of the user making the request
 	userID, err := getRequestorID(c)
 	if err != nil {
 		// Log and handle error here
 		log.Println(err)
-		return c.Status(fiber.StatusInternalServerError).SendString("Failed to get user ID")
+		return writeError(c, fiber.StatusInternalServerError, "internal_error", "Failed to get user ID", "", nil)
 	}
 
-	// Find the Bookmark in the database
-	var existingBookmark models.Bookmark
-	if err := bs.Database.Conn.
-		Preload("User").
-		Preload("Post").
-		Preload("Post.User").
-		Where("user_id = ? AND post_id = ?", userID, postID).First(&existingBookmark).Error; err != nil {
+	// Delete the bookmark if there is one, no longer counting it on the post
+	var bookmark models.Bookmark
+	deleted := false
+	err = bs.Database.Conn.Transaction(func(tx *gorm.DB) error {
+		err := tx.Set("gorm:query_option", "FOR UPDATE").
+			Where("user_id = ? AND post_id = ?", userID, postID).
+			First(&bookmark).Error
+		if gorm.IsRecordNotFoundError(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := tx.Delete(&bookmark).Error; err != nil {
+			return err
+		}
+		deleted = true
+		return adjustCount(tx, postID, bookmarkCount, -1)
+	})
+	if err != nil {
 		// Log and handle error here
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to find the bookmark",
-		})
+		return writeError(c, fiber.StatusInternalServerError, "internal_error", "Failed to unbookmark a post", "", nil)
+	}
+	if !deleted {
+		return c.SendStatus(fiber.StatusNoContent)
 	}
 
-	// Set the content type to application/vnd.api+json
+	return bs.writeBookmark(c, fiber.StatusOK, &bookmark)
+}
+
+// writeBookmark responds with the bookmark, which may already be deleted,
+// including its user and post.
+func (bs *BookmarkService) writeBookmark(c *fiber.Ctx, status int, bookmark *models.Bookmark) error {
+	bookmark.User, bookmark.Post = &models.User{}, &models.Post{}
+	if err := bs.Database.Conn.First(bookmark.User, bookmark.UserID).Error; err != nil {
+		return writeError(c, fiber.StatusInternalServerError, "internal_error", "Failed to retrieve the bookmark", "", nil)
+	}
+	if err := bs.Database.Conn.Preload("User").Preload("Media").First(bookmark.Post, bookmark.PostID).Error; err != nil {
+		return writeError(c, fiber.StatusInternalServerError, "internal_error", "Failed to retrieve the bookmark", "", nil)
+	}
+
+	if err := bs.Views.Prepare(c, bookmark.Post); err != nil {
+		return writeError(c, fiber.StatusInternalServerError, "internal_error", "Failed to prepare the posts", "", nil)
+	}
+
+	// Set the content type to application/vnd.api+json and the status before
+	// writing the body
 	c.Response().Header.Set(fiber.HeaderContentType, jsonapi.MediaType)
+	c.Status(status)
 
 	// Marshal the bookmark into JSON API format
-	if err := jsonapi.MarshalPayload(c.Response().BodyWriter(), &existingBookmark); err != nil {
+	if err := jsonapi.MarshalPayload(c.Response().BodyWriter(), bookmark); err != nil {
 		// Log and handle error here
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to marshal the bookmark",
-		})
+		return writeError(c, fiber.StatusInternalServerError, "internal_error", "Failed to marshal the bookmark", "", nil)
 	}
+	return nil
+}
 
-	// Delete the bookmark from the database
-	if err := bs.Database.Conn.Delete(&existingBookmark).Error; err != nil {
+// List returns the posts the user bookmarked, most recently bookmarked first.
+// Bookmarked posts the user can no longer see are left out.
+func (bs *BookmarkService) List(c *fiber.Ctx, page Page) error {
+	// Get the ID of the user making the request
+	userID, err := getRequestorID(c)
+	if err != nil {
 		// Log and handle error here
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to unbookmark a post",
-		})
+		log.Println(err)
+		return writeError(c, fiber.StatusInternalServerError, "internal_error", "Failed to get user ID", "", nil)
 	}
 
-	// Set the status code to 200 OK
-	c.Status(fiber.StatusOK)
+	query := bs.Database.Conn.
+		Select("bookmarks.*").
+		Joins("JOIN posts ON posts.id = bookmarks.post_id").
+		Scopes(bs.Visibility.Scope(userID)).
+		Where("bookmarks.user_id = ?", userID).
+		Preload("Post").
+		Preload("Post.User").
+		Preload("Post.Media")
+	bookmarks, next, prev, err := paginate(query, page, "bookmarks.created_at", "bookmarks.id",
+		func(b *models.Bookmark) (time.Time, uint32) { return b.CreatedAt, b.ID })
+	if err == errInvalidCursor {
+		return writeError(c, fiber.StatusBadRequest, "invalid_cursor", "Invalid cursor parameter", "", nil)
+	}
+	if err != nil {
+		return writeError(c, fiber.StatusInternalServerError, "internal_error", "Failed to get the bookmarks", "", nil)
+	}
 
-	return nil
+	posts := make([]*models.Post, len(bookmarks))
+	for i, bookmark := range bookmarks {
+		posts[i] = bookmark.Post
+	}
+	return writePostPage(c, bs.Views, posts, next, prev)
 }
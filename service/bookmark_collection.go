@@ -0,0 +1,358 @@
+package service
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/bwoff11/frens/models"
+	"github.com/bwoff11/frens/pkg/database"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/jsonapi"
+	"github.com/jinzhu/gorm"
+)
+
+var (
+	// errCollectionNotFound is returned when a collection does not exist or
+	// belongs to someone else.
+	errCollectionNotFound = errors.New("bookmark collection not found")
+
+	// errCollectionNameTaken is returned when the user already has a
+	// collection with the given name.
+	errCollectionNameTaken = errors.New("bookmark collection name taken")
+)
+
+// ListCollections returns the user's bookmark collections in their order.
+func (bs *BookmarkService) ListCollections(c *fiber.Ctx) error {
+	// Get the ID of the user making the request
+	userID, err := getRequestorID(c)
+	if err != nil {
+		// Log and handle error here
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to get user ID")
+	}
+
+	collections := []*models.BookmarkCollection{}
+	if err := bs.Database.Conn.Where("user_id = ?", userID).Order("position").Find(&collections).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get the bookmark collections",
+		})
+	}
+
+	// Set the content type to application/vnd.api+json
+	c.Response().Header.Set(fiber.HeaderContentType, jsonapi.MediaType)
+
+	// Marshal the collections into JSON API format
+	if err := jsonapi.MarshalPayload(c.Response().BodyWriter(), collections); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to marshal the bookmark collections",
+		})
+	}
+	return nil
+}
+
+// CreateCollection creates a collection after the user's existing ones.
+func (bs *BookmarkService) CreateCollection(c *fiber.Ctx, name string) error {
+	// Get the ID of the user making the request
+	userID, err := getRequestorID(c)
+	if err != nil {
+		// Log and handle error here
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to get user ID")
+	}
+
+	collection := models.BookmarkCollection{UserID: userID, Name: name}
+	err = bs.Database.Conn.Transaction(func(tx *gorm.DB) error {
+		collections, err := lockCollections(tx, userID)
+		if err != nil {
+			return err
+		}
+		for _, other := range collections {
+			if other.Name == name {
+				return errCollectionNameTaken
+			}
+		}
+
+		collection.Position = len(collections)
+		return database.MapError(tx.Create(&collection).Error)
+	})
+	if err == errCollectionNameTaken || errors.Is(err, database.ErrUniqueViolation) {
+		return c.Status(fiber.StatusConflict).SendString("A collection with this name already exists")
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create the bookmark collection",
+		})
+	}
+
+	return writeCollection(c, fiber.StatusCreated, &collection)
+}
+
+// UpdateCollection renames the collection and moves it to another position,
+// shifting the collections in between. Fields that are nil are left
+// unchanged.
+func (bs *BookmarkService) UpdateCollection(c *fiber.Ctx, collectionID uint32, name *string, position *int) error {
+	// Get the ID of the user making the request
+	userID, err := getRequestorID(c)
+	if err != nil {
+		// Log and handle error here
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to get user ID")
+	}
+
+	var collection *models.BookmarkCollection
+	err = bs.Database.Conn.Transaction(func(tx *gorm.DB) error {
+		collections, err := lockCollections(tx, userID)
+		if err != nil {
+			return err
+		}
+		collection = findCollection(collections, collectionID)
+		if collection == nil {
+			return errCollectionNotFound
+		}
+
+		changes := map[string]interface{}{}
+		if name != nil && *name != collection.Name {
+			for _, other := range collections {
+				if other.Name == *name {
+					return errCollectionNameTaken
+				}
+			}
+			changes["name"] = *name
+		}
+
+		if position != nil {
+			// Positions past the end move the collection to the end
+			to := *position
+			if to >= len(collections) {
+				to = len(collections) - 1
+			}
+			if err := moveCollection(tx, userID, collection.Position, to); err != nil {
+				return err
+			}
+			changes["position"] = to
+		}
+
+		if len(changes) == 0 {
+			return nil
+		}
+		return database.MapError(tx.Model(collection).Updates(changes).Error)
+	})
+	if err == errCollectionNotFound {
+		return c.Status(fiber.StatusNotFound).SendString("Collection not found")
+	}
+	if err == errCollectionNameTaken || errors.Is(err, database.ErrUniqueViolation) {
+		return c.Status(fiber.StatusConflict).SendString("A collection with this name already exists")
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update the bookmark collection",
+		})
+	}
+
+	return writeCollection(c, fiber.StatusOK, collection)
+}
+
+// DeleteCollection deletes the collection. Its bookmarks are kept and no
+// longer belong to a collection.
+func (bs *BookmarkService) DeleteCollection(c *fiber.Ctx, collectionID uint32) error {
+	// Get the ID of the user making the request
+	userID, err := getRequestorID(c)
+	if err != nil {
+		// Log and handle error here
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to get user ID")
+	}
+
+	err = bs.Database.Conn.Transaction(func(tx *gorm.DB) error {
+		collections, err := lockCollections(tx, userID)
+		if err != nil {
+			return err
+		}
+		collection := findCollection(collections, collectionID)
+		if collection == nil {
+			return errCollectionNotFound
+		}
+
+		if err := tx.Model(&models.Bookmark{}).
+			Where("collection_id = ?", collection.ID).
+			UpdateColumn("collection_id", nil).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(collection).Error; err != nil {
+			return err
+		}
+
+		// Close the gap left in the order
+		return tx.Model(&models.BookmarkCollection{}).
+			Where("user_id = ? AND position > ?", userID, collection.Position).
+			UpdateColumn("position", gorm.Expr("position - 1")).Error
+	})
+	if err == errCollectionNotFound {
+		return c.Status(fiber.StatusNotFound).SendString("Collection not found")
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete the bookmark collection",
+		})
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// ListCollection returns the bookmarks in the collection, most recently
+// bookmarked first. Unlike the list of all bookmarks, the bookmarks
+// themselves are returned so their notes are included, with the posts in
+// the included resources.
+func (bs *BookmarkService) ListCollection(c *fiber.Ctx, collectionID uint32, page Page) error {
+	// Get the ID of the user making the request
+	userID, err := getRequestorID(c)
+	if err != nil {
+		// Log and handle error here
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to get user ID")
+	}
+
+	var collection models.BookmarkCollection
+	if err := bs.Database.Conn.Where("id = ? AND user_id = ?", collectionID, userID).First(&collection).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).SendString("Collection not found")
+	}
+
+	query := bs.Database.Conn.
+		Select("bookmarks.*").
+		Joins("JOIN posts ON posts.id = bookmarks.post_id").
+		Scopes(bs.Visibility.Scope(userID)).
+		Where("bookmarks.user_id = ? AND bookmarks.collection_id = ?", userID, collection.ID).
+		Preload("Post").
+		Preload("Post.User").
+		Preload("Post.Media")
+	bookmarks, next, prev, err := paginate(query, page, "bookmarks.created_at", "bookmarks.id",
+		func(b *models.Bookmark) (time.Time, uint32) { return b.CreatedAt, b.ID })
+	if err == errInvalidCursor {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid cursor parameter")
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get the bookmarks",
+		})
+	}
+
+	posts := make([]*models.Post, len(bookmarks))
+	for i, bookmark := range bookmarks {
+		posts[i] = bookmark.Post
+	}
+	if err := bs.Views.Prepare(c, posts...); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to prepare the posts",
+		})
+	}
+
+	return writePage(c, bookmarks, next, prev)
+}
+
+// UpdateBookmark moves the user's bookmark of the post to another collection
+// and changes its note. A collection ID of zero takes the bookmark out of its
+// collection. Fields that are nil are left unchanged.
+func (bs *BookmarkService) UpdateBookmark(c *fiber.Ctx, postID uint32, collectionID *uint32, note *string) error {
+	// Get the ID of the user making the request
+	userID, err := getRequestorID(c)
+	if err != nil {
+		// Log and handle error here
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to get user ID")
+	}
+
+	var bookmark models.Bookmark
+	if err := bs.Database.Conn.Where("user_id = ? AND post_id = ?", userID, postID).First(&bookmark).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).SendString("Bookmark not found")
+	}
+
+	changes := map[string]interface{}{}
+	if collectionID != nil {
+		if *collectionID == 0 {
+			changes["collection_id"] = nil
+		} else {
+			// Bookmarks can only be moved into the user's own collections
+			var count int
+			if err := bs.Database.Conn.Model(&models.BookmarkCollection{}).
+				Where("id = ? AND user_id = ?", *collectionID, userID).
+				Count(&count).Error; err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": "Failed to get the bookmark collection",
+				})
+			}
+			if count == 0 {
+				return c.Status(fiber.StatusNotFound).SendString("Collection not found")
+			}
+			changes["collection_id"] = *collectionID
+		}
+	}
+	if note != nil {
+		changes["note"] = *note
+	}
+	if err := bs.Database.Conn.Model(&bookmark).Updates(changes).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update the bookmark",
+		})
+	}
+
+	return bs.writeBookmark(c, fiber.StatusOK, &bookmark)
+}
+
+// lockCollections loads the user's collections in their order and locks them
+// until the end of the transaction, so concurrent changes to the order are
+// applied one after another. The user is locked first, as locking the
+// collections alone doesn't stop concurrent requests from creating one at
+// the same position.
+func lockCollections(tx *gorm.DB, userID uint32) ([]*models.BookmarkCollection, error) {
+	if err := tx.Set("gorm:query_option", "FOR UPDATE").Select("id").First(&models.User{}, userID).Error; err != nil {
+		return nil, err
+	}
+
+	var collections []*models.BookmarkCollection
+	err := tx.Set("gorm:query_option", "FOR UPDATE").
+		Where("user_id = ?", userID).
+		Order("position").
+		Find(&collections).Error
+	return collections, err
+}
+
+func findCollection(collections []*models.BookmarkCollection, id uint32) *models.BookmarkCollection {
+	for _, collection := range collections {
+		if collection.ID == id {
+			return collection
+		}
+	}
+	return nil
+}
+
+// moveCollection shifts the collections between the positions from and to by
+// one, making room at to for the collection being moved away from from.
+func moveCollection(tx *gorm.DB, userID uint32, from, to int) error {
+	query := tx.Model(&models.BookmarkCollection{}).Where("user_id = ?", userID)
+	switch {
+	case to > from:
+		return query.Where("position > ? AND position <= ?", from, to).
+			UpdateColumn("position", gorm.Expr("position - 1")).Error
+	case to < from:
+		return query.Where("position >= ? AND position < ?", to, from).
+			UpdateColumn("position", gorm.Expr("position + 1")).Error
+	default:
+		return nil
+	}
+}
+
+// writeCollection responds with the collection as JSON API.
+func writeCollection(c *fiber.Ctx, status int, collection *models.BookmarkCollection) error {
+	// Set the content type to application/vnd.api+json
+	c.Response().Header.Set(fiber.HeaderContentType, jsonapi.MediaType)
+	c.Status(status)
+
+	// Marshal the collection into JSON API format
+	if err := jsonapi.MarshalPayload(c.Response().BodyWriter(), collection); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to marshal the bookmark collection",
+		})
+	}
+	return nil
+}
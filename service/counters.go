@@ -0,0 +1,100 @@
+package service
+
+import (
+	"log"
+	"time"
+
+	"github.com/bwoff11/frens/models"
+	"github.com/bwoff11/frens/pkg/config"
+	"github.com/bwoff11/frens/pkg/database"
+	"github.com/jinzhu/gorm"
+)
+
+// Columns of the engagement counters of posts.
+const (
+	likeCount     = "like_count"
+	bookmarkCount = "bookmark_count"
+	replyCount    = "reply_count"
+	repostCount   = "repost_count"
+)
+
+// adjustCount changes a counter of the post by delta. It should run in the
+// transaction adding or removing what is counted, so the two can't diverge.
+func adjustCount(tx *gorm.DB, postID uint32, column string, delta int) error {
+	return tx.Model(&models.Post{}).
+		Where("id = ?", postID).
+		UpdateColumn(column, gorm.Expr(column+" + ?", delta)).Error
+}
+
+// CounterService recounts the engagement counters of posts in the
+// background. Counters are adjusted along with every change, so this only
+// fixes counters that drifted, like after rows were removed by hand, and
+// fills them in for posts created before they existed.
+type CounterService struct {
+	Database *database.Database
+	Config   *config.CountersConfig
+}
+
+func (cs *CounterService) loop() {
+	ticker := time.NewTicker(cs.Config.ReconcileInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		fixed, err := cs.reconcile()
+		if err != nil {
+			log.Println("Failed to reconcile post counters:", err)
+			continue
+		}
+		if fixed > 0 {
+			log.Printf("Reconciled the counters of %d posts", fixed)
+		}
+	}
+}
+
+// recount sets the counters of the posts with IDs in the given range to the
+// actual numbers, skipping posts that are already correct.
+const recount = `
+	UPDATE posts SET
+		like_count = actual.likes,
+		bookmark_count = actual.bookmarks,
+		reply_count = actual.replies,
+		repost_count = actual.reposts
+	FROM (
+		SELECT posts.id,
+			(SELECT COUNT(*) FROM likes WHERE likes.post_id = posts.id) AS likes,
+			(SELECT COUNT(*) FROM bookmarks WHERE bookmarks.post_id = posts.id) AS bookmarks,
+			(SELECT COUNT(*) FROM posts replies WHERE replies.reply_to_id = posts.id) AS replies,
+			(SELECT COUNT(*) FROM posts reposts WHERE reposts.repost_of_id = posts.id) AS reposts
+		FROM posts WHERE posts.id BETWEEN ? AND ?
+	) actual
+	WHERE posts.id = actual.id AND
+		(posts.like_count, posts.bookmark_count, posts.reply_count, posts.repost_count) IS DISTINCT FROM
+		(actual.likes, actual.bookmarks, actual.replies, actual.reposts)`
+
+// reconcile recounts all posts in batches and returns how many had wrong
+// counters. Each batch is recounted in its own statement, so concurrent
+// changes are only held up by the batch they fall into.
+func (cs *CounterService) reconcile() (int, error) {
+	fixed := 0
+	var afterID uint32
+	for {
+		var ids []uint32
+		if err := cs.Database.Conn.Model(&models.Post{}).
+			Where("id > ?", afterID).
+			Order("id").
+			Limit(cs.Config.BatchSize).
+			Pluck("id", &ids).Error; err != nil {
+			return fixed, err
+		}
+		if len(ids) == 0 {
+			return fixed, nil
+		}
+
+		result := cs.Database.Conn.Exec(recount, ids[0], ids[len(ids)-1])
+		if result.Error != nil {
+			return fixed, result.Error
+		}
+		fixed += int(result.RowsAffected)
+		afterID = ids[len(ids)-1]
+	}
+}
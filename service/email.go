@@ -0,0 +1,544 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"errors"
+	htmltemplate "html/template"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/bwoff11/frens/models"
+	"github.com/bwoff11/frens/pkg/config"
+	"github.com/bwoff11/frens/pkg/database"
+	"github.com/bwoff11/frens/pkg/events"
+	"github.com/bwoff11/frens/pkg/mailer"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/jsonapi"
+	"github.com/jinzhu/gorm"
+)
+
+// EmailService manages the email preferences of users, emails new
+// notifications to those who want them and sends daily and weekly digests
+// in the background.
+type EmailService struct {
+	Database   *database.Database
+	Visibility *VisibilityPolicy
+	Events     events.Bus
+	Mailer     mailer.Mailer
+	Config     *config.MailConfig
+
+	jobs chan mailer.Message
+}
+
+//go:embed templates/email
+var emailTemplates embed.FS
+
+var (
+	emailText = texttemplate.Must(texttemplate.ParseFS(emailTemplates, "templates/email/*.txt"))
+	emailHTML = htmltemplate.Must(htmltemplate.ParseFS(emailTemplates, "templates/email/*.html"))
+)
+
+// Lists users can unsubscribe from through the link in an email.
+const (
+	emailListImmediate = "immediate"
+	emailListDigest    = "digest"
+)
+
+// emailListNames describe the lists on the unsubscribe page.
+var emailListNames = map[string]string{
+	emailListImmediate: "an email for each notification",
+	emailListDigest:    "email digests",
+}
+
+// digestPeriods are how much time each digest frequency covers.
+var digestPeriods = map[string]time.Duration{
+	models.DigestDaily:  24 * time.Hour,
+	models.DigestWeekly: 7 * 24 * time.Hour,
+}
+
+// maxEmailExcerptLength is how much of a post's text is emailed, in
+// characters.
+const maxEmailExcerptLength = 280
+
+// EmailPreferenceChanges changes the email preferences of a user. Nil
+// fields are left as they are.
+type EmailPreferenceChanges struct {
+	Immediate *bool
+	Digest    *string
+}
+
+// notificationEmail is the data of the notification templates.
+type notificationEmail struct {
+	Username       string
+	Summary        string
+	Excerpt        string
+	UnsubscribeURL string
+}
+
+// digestEmail is the data of the digest templates.
+type digestEmail struct {
+	Username          string
+	Frequency         string
+	Period            string
+	Notifications     []string
+	MoreNotifications int
+	Followers         []string
+	MoreFollowers     int
+	TopPosts          []digestPost
+	UnsubscribeURL    string
+}
+
+type digestPost struct {
+	Author  string
+	Text    string
+	Likes   int
+	Replies int
+	Reposts int
+}
+
+func (d *digestEmail) empty() bool {
+	return len(d.Notifications) == 0 && len(d.Followers) == 0 && len(d.TopPosts) == 0
+}
+
+// unsubscribePage is the data of the unsubscribe template.
+type unsubscribePage struct {
+	List      string
+	ActionURL string
+	Done      bool
+}
+
+func NewEmailService(db *database.Database, visibility *VisibilityPolicy, bus events.Bus, config *config.MailConfig) (*EmailService, error) {
+	m, err := mailer.New(config)
+	if err != nil {
+		return nil, err
+	}
+	return &EmailService{
+		Database:   db,
+		Visibility: visibility,
+		Events:     bus,
+		Mailer:     m,
+		Config:     config,
+		jobs:       make(chan mailer.Message, config.QueueSize),
+	}, nil
+}
+
+// GetPreferences returns the email preferences of the user making the
+// request.
+func (es *EmailService) GetPreferences(c *fiber.Ctx) error {
+	// Get the ID of the user making the request
+	userID, err := getRequestorID(c)
+	if err != nil {
+		// Log and handle error here
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to get user ID")
+	}
+
+	preference := models.EmailPreference{UserID: userID, Digest: models.DigestOff}
+	if err := es.Database.Conn.Where("user_id = ?", userID).First(&preference).Error; err != nil && !gorm.IsRecordNotFoundError(err) {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get the email preferences",
+		})
+	}
+
+	return writeEmailPreference(c, &preference)
+}
+
+// UpdatePreferences changes the email preferences of the user making the
+// request.
+func (es *EmailService) UpdatePreferences(c *fiber.Ctx, changes EmailPreferenceChanges) error {
+	// Get the ID of the user making the request
+	userID, err := getRequestorID(c)
+	if err != nil {
+		// Log and handle error here
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to get user ID")
+	}
+
+	var preference models.EmailPreference
+	err = es.Database.Conn.Transaction(func(tx *gorm.DB) error {
+		err := tx.Set("gorm:query_option", "FOR UPDATE").Where("user_id = ?", userID).First(&preference).Error
+		if err != nil && !gorm.IsRecordNotFoundError(err) {
+			return err
+		}
+		created := err != nil
+		if created {
+			preference = models.EmailPreference{UserID: userID, Digest: models.DigestOff}
+		}
+
+		if changes.Immediate != nil {
+			preference.Immediate = *changes.Immediate
+		}
+		if changes.Digest != nil {
+			preference.Digest = *changes.Digest
+		}
+		if created {
+			return database.MapError(tx.Create(&preference).Error)
+		}
+		return tx.Save(&preference).Error
+	})
+	if errors.Is(err, database.ErrUniqueViolation) {
+		return c.Status(fiber.StatusConflict).SendString("The email preferences were changed by another request")
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update the email preferences",
+		})
+	}
+
+	return writeEmailPreference(c, &preference)
+}
+
+func writeEmailPreference(c *fiber.Ctx, preference *models.EmailPreference) error {
+	// Set the content type to application/vnd.api+json
+	c.Response().Header.Set(fiber.HeaderContentType, jsonapi.MediaType)
+	c.Status(fiber.StatusOK)
+
+	// Marshal the preferences into JSON API format
+	if err := jsonapi.MarshalPayload(c.Response().BodyWriter(), preference); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to marshal the email preferences",
+		})
+	}
+	return nil
+}
+
+// ConfirmUnsubscribe shows the page an unsubscribe link in an email opens,
+// which asks to confirm. Only the POST of the confirmation, or the one-click
+// POST of the mail client, unsubscribes, so link scanners opening the link
+// don't.
+func (es *EmailService) ConfirmUnsubscribe(c *fiber.Ctx, userID uint32, list, signature string) error {
+	if !es.verify(userID, list, signature) {
+		return c.Status(fiber.StatusForbidden).SendString("Invalid unsubscribe link")
+	}
+
+	return writeUnsubscribePage(c, unsubscribePage{
+		List:      emailListNames[list],
+		ActionURL: es.unsubscribeURL(userID, list),
+	})
+}
+
+// Unsubscribe turns off the emails of the list for the user an unsubscribe
+// link was made for.
+func (es *EmailService) Unsubscribe(c *fiber.Ctx, userID uint32, list, signature string) error {
+	if !es.verify(userID, list, signature) {
+		return c.Status(fiber.StatusForbidden).SendString("Invalid unsubscribe link")
+	}
+
+	updates := map[string]interface{}{}
+	switch list {
+	case emailListImmediate:
+		updates["immediate"] = false
+	case emailListDigest:
+		updates["digest"] = models.DigestOff
+	}
+	if err := es.Database.Conn.Model(&models.EmailPreference{}).Where("user_id = ?", userID).Updates(updates).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to unsubscribe")
+	}
+
+	return writeUnsubscribePage(c, unsubscribePage{List: emailListNames[list], Done: true})
+}
+
+func writeUnsubscribePage(c *fiber.Ctx, page unsubscribePage) error {
+	var body bytes.Buffer
+	if err := emailHTML.ExecuteTemplate(&body, "unsubscribe.html", page); err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to render the page")
+	}
+	c.Type("html", "utf-8")
+	return c.Send(body.Bytes())
+}
+
+// unsubscribeURL returns the signed link that unsubscribes the user from
+// the list. It doesn't expire.
+func (es *EmailService) unsubscribeURL(userID uint32, list string) string {
+	query := url.Values{}
+	query.Set("user", strconv.FormatUint(uint64(userID), 10))
+	query.Set("list", list)
+	query.Set("signature", es.sign(userID, list))
+	return strings.TrimSuffix(es.Config.BaseURL, "/") + "/v1/email/unsubscribe?" + query.Encode()
+}
+
+// verify checks the signature of an unsubscribe link.
+func (es *EmailService) verify(userID uint32, list, signature string) bool {
+	return hmac.Equal([]byte(signature), []byte(es.sign(userID, list)))
+}
+
+func (es *EmailService) sign(userID uint32, list string) string {
+	mac := hmac.New(sha256.New, []byte(es.Config.SigningKey))
+	mac.Write([]byte(strconv.FormatUint(uint64(userID), 10)))
+	mac.Write([]byte{0})
+	mac.Write([]byte(list))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// compose renders the text and HTML templates of the given name into a
+// message.
+func compose(to, subject, name, unsubscribeURL string, data interface{}) (mailer.Message, error) {
+	var text, html bytes.Buffer
+	if err := emailText.ExecuteTemplate(&text, name+".txt", data); err != nil {
+		return mailer.Message{}, err
+	}
+	if err := emailHTML.ExecuteTemplate(&html, name+".html", data); err != nil {
+		return mailer.Message{}, err
+	}
+	return mailer.Message{
+		To:             to,
+		Subject:        subject,
+		Text:           text.String(),
+		HTML:           html.String(),
+		UnsubscribeURL: unsubscribeURL,
+	}, nil
+}
+
+// emailExcerpt is what an email shows of a post. Posts with a content
+// warning only show the warning.
+func emailExcerpt(post *models.Post) string {
+	if post == nil {
+		return ""
+	}
+	if post.ContentWarning != "" {
+		return "Content warning: " + truncate(post.ContentWarning, maxEmailExcerptLength)
+	}
+	return truncate(post.Text, maxEmailExcerptLength)
+}
+
+// start launches the workers and the digest loop, and subscribes to new
+// notifications.
+func (es *EmailService) start() {
+	for i := 0; i < es.Config.Workers; i++ {
+		go es.work()
+	}
+	es.Events.Subscribe("email", es.handle, events.NotificationCreated)
+	go es.digestLoop()
+}
+
+// handle emails a new notification to its user if they want immediate
+// emails. Like pushes, grouped notifications are only emailed for their
+// first actor.
+func (es *EmailService) handle(event events.Event) {
+	var notification models.Notification
+	if err := es.Database.Conn.Preload("Actor").Preload("Post").First(&notification, event.NotificationID).Error; err != nil {
+		if !gorm.IsRecordNotFoundError(err) {
+			log.Println("Failed to get the notification to email:", err)
+		}
+		return
+	}
+	if notification.ActorCount > 1 {
+		return
+	}
+
+	var preference models.EmailPreference
+	if err := es.Database.Conn.Where("user_id = ? AND immediate", notification.UserID).First(&preference).Error; err != nil {
+		if !gorm.IsRecordNotFoundError(err) {
+			log.Println("Failed to get the email preferences:", err)
+		}
+		return
+	}
+	var user models.User
+	if err := es.Database.Conn.First(&user, notification.UserID).Error; err != nil {
+		log.Println("Failed to get the user to email:", err)
+		return
+	}
+
+	summary := describeNotification(&notification)
+	unsubscribeURL := es.unsubscribeURL(user.ID, emailListImmediate)
+	msg, err := compose(user.Email, summary, "notification", unsubscribeURL, notificationEmail{
+		Username:       user.Username,
+		Summary:        summary,
+		Excerpt:        emailExcerpt(notification.Post),
+		UnsubscribeURL: unsubscribeURL,
+	})
+	if err != nil {
+		log.Println("Failed to render the notification email:", err)
+		return
+	}
+	// This runs on the event bus, so it mustn't wait for the workers
+	select {
+	case es.jobs <- msg:
+	default:
+		log.Printf("Email queue is full, dropped the email for notification %d", notification.ID)
+	}
+}
+
+func (es *EmailService) work() {
+	for msg := range es.jobs {
+		ctx, cancel := context.WithTimeout(context.Background(), es.Config.Timeout)
+		if err := es.Mailer.Send(ctx, msg); err != nil {
+			log.Println("Failed to send an email:", err)
+		}
+		cancel()
+	}
+}
+
+func (es *EmailService) digestLoop() {
+	ticker := time.NewTicker(es.Config.DigestInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		sent, err := es.sendDigests(now)
+		if err != nil {
+			log.Println("Failed to send email digests:", err)
+		}
+		if sent > 0 {
+			log.Printf("Sent %d email digests", sent)
+		}
+	}
+}
+
+// sendDigests sends the digests that are due, in batches. Digests that fail
+// are tried again on the next run. It returns how many were sent.
+func (es *EmailService) sendDigests(now time.Time) (int, error) {
+	sent := 0
+	var lastID uint32
+	for {
+		var due []models.EmailPreference
+		err := es.Database.Conn.
+			Where("user_id > ?", lastID).
+			Where(`(digest = ? AND (digest_sent_at IS NULL OR digest_sent_at <= ?)) OR
+				(digest = ? AND (digest_sent_at IS NULL OR digest_sent_at <= ?))`,
+				models.DigestDaily, now.Add(-digestPeriods[models.DigestDaily]),
+				models.DigestWeekly, now.Add(-digestPeriods[models.DigestWeekly])).
+			Order("user_id").
+			Limit(es.Config.BatchSize).
+			Find(&due).Error
+		if err != nil {
+			return sent, err
+		}
+
+		for i := range due {
+			lastID = due[i].UserID
+			ok, err := es.sendDigest(&due[i], now)
+			if err != nil {
+				log.Printf("Failed to send the email digest of user %d: %v", due[i].UserID, err)
+				continue
+			}
+			if ok {
+				sent++
+			}
+		}
+		if len(due) < es.Config.BatchSize {
+			return sent, nil
+		}
+	}
+}
+
+// sendDigest sends the digest of a user, covering the time since the last
+// one but no more than its period. Nothing is sent if nothing happened. It
+// reports whether an email was sent.
+func (es *EmailService) sendDigest(preference *models.EmailPreference, now time.Time) (bool, error) {
+	since := now.Add(-digestPeriods[preference.Digest])
+	if preference.DigestSentAt != nil && preference.DigestSentAt.After(since) {
+		since = *preference.DigestSentAt
+	}
+
+	var user models.User
+	if err := es.Database.Conn.First(&user, preference.UserID).Error; err != nil {
+		return false, err
+	}
+	digest, err := es.gatherDigest(&user, since)
+	if err != nil {
+		return false, err
+	}
+
+	if !digest.empty() {
+		digest.Frequency = preference.Digest
+		digest.Period = "day"
+		if preference.Digest == models.DigestWeekly {
+			digest.Period = "week"
+		}
+		digest.UnsubscribeURL = es.unsubscribeURL(user.ID, emailListDigest)
+
+		msg, err := compose(user.Email, "Your "+preference.Digest+" digest", "digest", digest.UnsubscribeURL, digest)
+		if err != nil {
+			return false, err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), es.Config.Timeout)
+		defer cancel()
+		if err := es.Mailer.Send(ctx, msg); err != nil {
+			return false, err
+		}
+	}
+
+	// Only the frequency the digest was sent for is marked, in case the
+	// user changed it in the meantime
+	err = es.Database.Conn.Model(&models.EmailPreference{}).
+		Where("user_id = ? AND digest = ?", preference.UserID, preference.Digest).
+		UpdateColumn("digest_sent_at", now).Error
+	return !digest.empty(), err
+}
+
+// gatherDigest collects what happened for the user since the given time:
+// their unread notifications, new followers and the most engaging posts of
+// the accounts they follow.
+func (es *EmailService) gatherDigest(user *models.User, since time.Time) (*digestEmail, error) {
+	digest := &digestEmail{Username: user.Username}
+	limit := es.Config.DigestItems
+
+	notifications := es.Database.Conn.
+		Where("notifications.user_id = ? AND notifications.read_at IS NULL AND notifications.updated_at > ?", user.ID, since).
+		Scopes(hideSilencedActors(user.ID))
+	var notificationCount int
+	if err := notifications.Model(&models.Notification{}).Count(&notificationCount).Error; err != nil {
+		return nil, err
+	}
+	var unread []*models.Notification
+	if err := notifications.Preload("Actor").Order("notifications.updated_at DESC").Limit(limit).Find(&unread).Error; err != nil {
+		return nil, err
+	}
+	for _, notification := range unread {
+		digest.Notifications = append(digest.Notifications, describeNotification(notification))
+	}
+	digest.MoreNotifications = notificationCount - len(unread)
+
+	followers := es.Database.Conn.Table("users").
+		Joins("JOIN follows ON follows.user_id = users.id").
+		Where("follows.followed_id = ? AND follows.created_at > ?", user.ID, since)
+	var followerCount int
+	if err := followers.Count(&followerCount).Error; err != nil {
+		return nil, err
+	}
+	if err := followers.Order("follows.created_at DESC").Limit(limit).Pluck("users.username", &digest.Followers).Error; err != nil {
+		return nil, err
+	}
+	digest.MoreFollowers = followerCount - len(digest.Followers)
+
+	if es.Config.TopPosts > 0 {
+		var posts []*models.Post
+		err := es.Database.Conn.
+			Scopes(es.Visibility.Scope(user.ID)).
+			Where("posts.user_id IN (SELECT followed_id FROM follows WHERE user_id = ?)", user.ID).
+			Where("posts.user_id NOT IN (SELECT muted_id FROM mutes WHERE user_id = ?)", user.ID).
+			Where("posts.created_at > ? AND posts.reply_to_id IS NULL AND posts.repost_of_id IS NULL", since).
+			Where("posts.like_count + posts.reply_count + posts.repost_count > 0").
+			Order("posts.like_count + posts.reply_count + posts.repost_count DESC, posts.id DESC").
+			Limit(es.Config.TopPosts).
+			Preload("User").
+			Find(&posts).Error
+		if err != nil {
+			return nil, err
+		}
+		for _, post := range posts {
+			author := ""
+			if post.User != nil {
+				author = post.User.Username
+			}
+			digest.TopPosts = append(digest.TopPosts, digestPost{
+				Author:  author,
+				Text:    emailExcerpt(post),
+				Likes:   post.LikeCount,
+				Replies: post.ReplyCount,
+				Reposts: post.RepostCount,
+			})
+		}
+	}
+
+	return digest, nil
+}
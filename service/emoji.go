@@ -0,0 +1,220 @@
+package service
+
+import (
+	"errors"
+	"log"
+	"regexp"
+	"unicode"
+
+	"github.com/bwoff11/frens/models"
+	"github.com/bwoff11/frens/pkg/database"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/jsonapi"
+	"github.com/jinzhu/gorm"
+)
+
+// EmojiService manages the custom emoji of the instance.
+type EmojiService struct{ Database *database.Database }
+
+// errEmojiTaken is returned when a custom emoji is created with a shortcode
+// that is already used.
+var errEmojiTaken = errors.New("custom emoji shortcode taken")
+
+// customEmojiPattern matches a custom emoji as used in reactions, with the
+// shortcode in colons.
+var customEmojiPattern = regexp.MustCompile(`^:([a-z0-9_]{2,32}):$`)
+
+// List returns all custom emoji, ordered by shortcode.
+func (es *EmojiService) List(c *fiber.Ctx) error {
+	emoji := []*models.CustomEmoji{}
+	if err := es.Database.Conn.Order("shortcode").Find(&emoji).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get the custom emoji",
+		})
+	}
+
+	// Set the content type to application/vnd.api+json
+	c.Response().Header.Set(fiber.HeaderContentType, jsonapi.MediaType)
+
+	// Marshal the emoji into JSON API format
+	if err := jsonapi.MarshalPayload(c.Response().BodyWriter(), emoji); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to marshal the custom emoji",
+		})
+	}
+	return nil
+}
+
+// Create adds a custom emoji showing an image the admin uploaded and hasn't
+// attached to a post. The image becomes public and is kept for as long as
+// the emoji exists.
+func (es *EmojiService) Create(c *fiber.Ctx, shortcode string, mediaID uint32) error {
+	// Get the ID of the user making the request
+	userID, err := getRequestorID(c)
+	if err != nil {
+		// Log and handle error here
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to get user ID")
+	}
+
+	if !customEmojiPattern.MatchString(":" + shortcode + ":") {
+		return c.Status(fiber.StatusBadRequest).SendString("Shortcodes can only contain lowercase letters, digits and underscores")
+	}
+
+	var media models.Media
+	if err := es.Database.Conn.Where("id = ? AND user_id = ? AND post_id IS NULL", mediaID, userID).First(&media).Error; err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Media not found or attached to a post")
+	}
+	if media.Kind != models.MediaKindImage || media.State != models.MediaStateReady {
+		return c.Status(fiber.StatusBadRequest).SendString("Custom emoji must be images")
+	}
+
+	emoji := models.CustomEmoji{Shortcode: shortcode, MediaID: media.ID}
+	err = es.Database.Conn.Transaction(func(tx *gorm.DB) error {
+		var count int
+		if err := tx.Model(&models.CustomEmoji{}).Where("shortcode = ?", shortcode).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return errEmojiTaken
+		}
+		return database.MapError(tx.Create(&emoji).Error)
+	})
+	if err == errEmojiTaken || errors.Is(err, database.ErrUniqueViolation) {
+		return c.Status(fiber.StatusConflict).SendString("A custom emoji with this shortcode already exists")
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create the custom emoji",
+		})
+	}
+
+	// Set the content type to application/vnd.api+json
+	c.Response().Header.Set(fiber.HeaderContentType, jsonapi.MediaType)
+	c.Status(fiber.StatusCreated)
+
+	// Marshal the emoji into JSON API format
+	if err := jsonapi.MarshalPayload(c.Response().BodyWriter(), &emoji); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to marshal the custom emoji",
+		})
+	}
+	return nil
+}
+
+// Delete removes a custom emoji along with the reactions using it. Its image
+// is left to the media garbage collector.
+func (es *EmojiService) Delete(c *fiber.Ctx, emojiID uint32) error {
+	var emoji models.CustomEmoji
+	if err := es.Database.Conn.First(&emoji, emojiID).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).SendString("Custom emoji not found")
+	}
+
+	err := es.Database.Conn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("emoji = ?", ":"+emoji.Shortcode+":").Delete(&models.Reaction{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&emoji).Error
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete the custom emoji",
+		})
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// resolve checks that the text names a Unicode or custom emoji and returns
+// the form it is stored in. It reports false if it doesn't.
+func (es *EmojiService) resolve(text string) (string, bool, error) {
+	if match := customEmojiPattern.FindStringSubmatch(text); match != nil {
+		var count int
+		if err := es.Database.Conn.Model(&models.CustomEmoji{}).Where("shortcode = ?", match[1]).Count(&count).Error; err != nil {
+			return "", false, err
+		}
+		return text, count > 0, nil
+	}
+
+	emoji, ok := normalizeEmoji(text)
+	return emoji, ok, nil
+}
+
+// Code points that are part of emoji sequences without being emoji
+// themselves.
+const (
+	zeroWidthJoiner   = '\u200d'
+	textPresentation  = '\ufe0e'
+	emojiPresentation = '\ufe0f'
+	combiningKeycap   = '\u20e3'
+)
+
+// normalizeEmoji checks that the text is a single Unicode emoji, which may
+// be a sequence joined by zero width joiners, a flag, a keycap or carry a
+// skin tone. Emoji made of one code point are returned in a single form, so
+// "❤" and "❤️" are the same reaction.
+func normalizeEmoji(text string) (string, bool) {
+	runes := []rune(text)
+	if len(runes) == 0 || len(runes) > 16 {
+		return "", false
+	}
+
+	var core []rune
+	for _, r := range runes {
+		if r != textPresentation && r != emojiPresentation {
+			core = append(core, r)
+		}
+	}
+
+	// Count the emoji that are not joined to the one before them
+	emoji, flags := 0, 0
+	joined := false
+	for i, r := range core {
+		switch {
+		case r == zeroWidthJoiner:
+			if i == 0 || joined {
+				return "", false
+			}
+			joined = true
+			continue
+		case r == combiningKeycap, r >= 0x1F3FB && r <= 0x1F3FF, r >= 0xE0020 && r <= 0xE007F:
+			// Keycaps, skin tones and tag sequences modify the emoji before them
+			if i == 0 || joined {
+				return "", false
+			}
+		case r >= 0x1F1E6 && r <= 0x1F1FF:
+			// Flags are a pair of regional indicators
+			flags++
+			if flags > 2 {
+				return "", false
+			}
+			if flags == 1 {
+				emoji++
+			}
+		case r == '#' || r == '*' || (r >= '0' && r <= '9'):
+			if i+1 >= len(core) || core[i+1] != combiningKeycap {
+				return "", false
+			}
+			emoji++
+		case unicode.Is(unicode.So, r), r == '‼', r == '⁉', r == '〰':
+			if !joined {
+				emoji++
+			}
+		default:
+			return "", false
+		}
+		joined = false
+	}
+	if joined || emoji != 1 || flags == 1 {
+		return "", false
+	}
+
+	if len(core) == 1 {
+		// Emoji from before the emoji blocks are shown as text by default
+		if core[0] < 0x1F000 {
+			return string(core[0]) + string(emojiPresentation), true
+		}
+		return string(core[0]), true
+	}
+	return text, true
+}
@@ -0,0 +1,27 @@
+package service
+
+import (
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/jsonapi"
+)
+
+// writeError responds with a single JSON:API error object. Code is a stable
+// identifier clients can match on; title and detail are for humans.
+func writeError(c *fiber.Ctx, status int, code, title, detail string, meta map[string]interface{}) error {
+	// Set the content type to application/vnd.api+json
+	c.Response().Header.Set(fiber.HeaderContentType, jsonapi.MediaType)
+	c.Status(status)
+
+	object := &jsonapi.ErrorObject{
+		Status: strconv.Itoa(status),
+		Code:   code,
+		Title:  title,
+		Detail: detail,
+	}
+	if meta != nil {
+		object.Meta = &meta
+	}
+	return jsonapi.MarshalErrors(c.Response().BodyWriter(), []*jsonapi.ErrorObject{object})
+}
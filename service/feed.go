@@ -1,59 +1,103 @@
 package service
 
 import (
-	"time"
-
 	"github.com/bwoff11/frens/models"
+	"github.com/bwoff11/frens/pkg/config"
 	"github.com/bwoff11/frens/pkg/database"
+	"github.com/bwoff11/frens/pkg/timeline"
 	"github.com/gofiber/fiber/v2"
-	"github.com/google/jsonapi"
 )
 
-type FeedService struct{ Database *database.Database }
-
-func (f *FeedService) GetChronological(c *fiber.Ctx, count uint8, cursor uint32) error {
+type FeedService struct {
+	Database    *database.Database
+	Visibility  *VisibilityPolicy
+	Timelines   *TimelineService
+	Views       *PostViews
+	Algorithmic *config.AlgorithmicFeedConfig
+	Explore     *config.ExploreFeedConfig
 
-	// Set default values for count and cursor if they are not provided
-	if count == 0 {
-		count = 10
-	}
-	if cursor == 0 {
-		cursor = uint32(time.Now().Unix())
-	}
+	explore exploreCache
+}
 
+func (f *FeedService) GetChronological(c *fiber.Ctx, page Page) error {
 	// get the user ID from the context
 	userID, err := getRequestorID(c)
 	if err != nil {
 		return err
 	}
 
-	// get the IDs of all users the current user is following
-	var follows []models.Follow
-	f.Database.Conn.Where("user_id = ?", userID).Find(&follows)
-
-	followedIDs := make([]uint32, len(follows))
-	for i, follow := range follows {
-		followedIDs[i] = follow.FollowedID
+	position, err := parsePageCursor(page)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid cursor parameter")
 	}
 
-	// add the current user's ID to the list
-	followedIDs = append(followedIDs, userID)
+	// get the page of the user's home timeline
+	var from *timeline.Entry
+	newer := false
+	if position != nil {
+		from = &timeline.Entry{CreatedAt: position.Time, PostID: position.ID}
+		newer = position.Backward
+	}
+	entries, more, err := f.Timelines.Page(userID, from, newer, page.size())
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get the feed",
+		})
+	}
+	if len(entries) == 0 {
+		return writePage(c, []*models.Post{}, "", "")
+	}
 
-	// get all posts from these users, before the cursor date
-	var posts []*models.Post
-	f.Database.Conn.
-		Preload("User").
-		Where("user_id IN (?) AND created_at < ?", followedIDs, time.Unix(int64(cursor), 0)).
-		Order("created_at desc").
-		Limit(int(count)).
-		Find(&posts)
+	// The cursors follow the timeline entries, so pages stay consistent
+	// even if some of the posts can no longer be shown
+	first, last := entries[0], entries[len(entries)-1]
+	next, prev, err := pageCursors(position, more,
+		pageCursor{Time: first.CreatedAt, ID: first.PostID},
+		pageCursor{Time: last.CreatedAt, ID: last.PostID})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create the cursor",
+		})
+	}
 
-	// render the posts as JSON API
-	c.Response().Header.Set(fiber.HeaderContentType, jsonapi.MediaType)
-	if err := jsonapi.MarshalPayload(c.Response().BodyWriter(), posts); err != nil {
+	// get the posts the user may still see
+	postIDs := make([]uint32, len(entries))
+	for i, entry := range entries {
+		postIDs[i] = entry.PostID
+	}
+	posts, err := f.visiblePosts(userID, postIDs)
+	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to marshal the posts",
+			"error": "Failed to get the feed",
 		})
 	}
-	return nil
+
+	// render the posts as JSON API
+	return writePostPage(c, f.Views, posts, next, prev)
+}
+
+// visiblePosts loads the given posts in the given order, leaving out the
+// ones that were deleted or that the viewer may not see.
+func (f *FeedService) visiblePosts(viewerID uint32, postIDs []uint32) ([]*models.Post, error) {
+	var found []*models.Post
+	if err := f.Database.Conn.
+		Preload("User").
+		Preload("Media").
+		Scopes(f.Visibility.Scope(viewerID)).
+		Where("id IN (?)", postIDs).
+		Find(&found).Error; err != nil {
+		return nil, err
+	}
+
+	byID := make(map[uint32]*models.Post, len(found))
+	for _, post := range found {
+		byID[post.ID] = post
+	}
+	posts := make([]*models.Post, 0, len(found))
+	for _, id := range postIDs {
+		if post, ok := byID[id]; ok {
+			posts = append(posts, post)
+		}
+	}
+	return posts, nil
 }
@@ -0,0 +1,240 @@
+package service
+
+import (
+	"sort"
+	"time"
+
+	"github.com/bwoff11/frens/models"
+	"github.com/gofiber/fiber/v2"
+)
+
+// algorithmicCursor marks a position in a ranked feed. Snapshot pins the
+// moment the feed was ranked so that every page is ranked the same way and
+// pagination stays stable while new posts and engagement come in.
+type algorithmicCursor struct {
+	Snapshot int64   `json:"t"`
+	Score    float64 `json:"s"`
+	ID       uint32  `json:"id"`
+}
+
+// after reports whether the candidate comes after the cursor position.
+func (ac *algorithmicCursor) after(c *rankedPost) bool {
+	if c.Score != ac.Score {
+		return c.Score < ac.Score
+	}
+	return c.Post.ID < ac.ID
+}
+
+func (f *FeedService) GetAlgorithmic(c *fiber.Ctx, page Page) error {
+	count := page.size()
+
+	// get the user ID from the context
+	userID, err := getRequestorID(c)
+	if err != nil {
+		return err
+	}
+
+	// Rank the feed as of now, or as of the first page if a cursor is given
+	snapshot := time.Unix(time.Now().Unix(), 0)
+	var position *algorithmicCursor
+	if page.Cursor != "" {
+		position = &algorithmicCursor{}
+		if err := decodeCursor(page.Cursor, position); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid cursor parameter")
+		}
+		snapshot = time.Unix(position.Snapshot, 0)
+	}
+
+	candidates, err := f.algorithmicCandidates(userID, snapshot)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get the feed",
+		})
+	}
+	scoreCandidates(candidates, f.Algorithmic, snapshot)
+	ranked := diversify(candidates, f.Algorithmic)
+
+	// Skip everything up to and including the cursor position
+	start := 0
+	if position != nil {
+		start = sort.Search(len(ranked), func(i int) bool {
+			return position.after(ranked[i])
+		})
+	}
+	end := start + count
+	if end > len(ranked) {
+		end = len(ranked)
+	}
+	top := ranked[start:end]
+
+	posts := make([]*models.Post, len(top))
+	for i, candidate := range top {
+		posts[i] = candidate.Post
+	}
+
+	// Only hand out a cursor if there is something after this page
+	var next string
+	if end < len(ranked) {
+		last := top[len(top)-1]
+		next, err = encodeCursor(&algorithmicCursor{
+			Snapshot: snapshot.Unix(),
+			Score:    last.Score,
+			ID:       last.Post.ID,
+		})
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to create the cursor",
+			})
+		}
+	}
+
+	return writePostPage(c, f.Views, posts, next, "")
+}
+
+// algorithmicCandidates collects the posts eligible for the user's ranked
+// feed along with their engagement as of the snapshot. Candidates come from
+// the user, the accounts they follow and the accounts those accounts follow.
+func (f *FeedService) algorithmicCandidates(userID uint32, snapshot time.Time) ([]*rankedPost, error) {
+	db := f.Database.Conn
+
+	// First degree: the user and everyone they follow
+	var firstDegree []uint32
+	if err := db.Model(&models.Follow{}).
+		Where("user_id = ?", userID).
+		Pluck("followed_id", &firstDegree).Error; err != nil {
+		return nil, err
+	}
+	firstDegree = append(firstDegree, userID)
+
+	// Second degree: the accounts followed by the user's follows
+	var secondDegree []uint32
+	if err := db.Model(&models.Follow{}).
+		Where("user_id IN (?) AND followed_id NOT IN (?)", firstDegree, firstDegree).
+		Pluck("DISTINCT followed_id", &secondDegree).Error; err != nil {
+		return nil, err
+	}
+
+	isSecondDegree := make(map[uint32]bool, len(secondDegree))
+	for _, id := range secondDegree {
+		isSecondDegree[id] = true
+	}
+
+	// Get the most recent posts of all these users the user may see
+	var posts []*models.Post
+	if err := db.
+		Preload("User").
+		Preload("Media").
+		Scopes(f.Visibility.Scope(userID)).
+		Where("user_id IN (?) AND created_at > ? AND created_at <= ?",
+			append(firstDegree, secondDegree...),
+			snapshot.Add(-f.Algorithmic.CandidateWindow),
+			snapshot).
+		Order("created_at desc").
+		Limit(f.Algorithmic.CandidateLimit).
+		Find(&posts).Error; err != nil {
+		return nil, err
+	}
+	if len(posts) == 0 {
+		return nil, nil
+	}
+
+	postIDs := make([]uint32, len(posts))
+	for i, post := range posts {
+		postIDs[i] = post.ID
+	}
+
+	likes, err := f.countByPost("likes", "post_id", postIDs, snapshot)
+	if err != nil {
+		return nil, err
+	}
+	replies, err := f.countByPost("posts", "reply_to_id", postIDs, snapshot)
+	if err != nil {
+		return nil, err
+	}
+	reposts, err := f.countByPost("posts", "repost_of_id", postIDs, snapshot)
+	if err != nil {
+		return nil, err
+	}
+	affinity, err := f.affinity(userID, snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := make([]*rankedPost, len(posts))
+	for i, post := range posts {
+		candidates[i] = &rankedPost{
+			Post:         post,
+			Likes:        likes[post.ID],
+			Replies:      replies[post.ID],
+			Reposts:      reposts[post.ID],
+			Affinity:     affinity[post.UserID],
+			SecondDegree: isSecondDegree[post.UserID],
+		}
+	}
+	return candidates, nil
+}
+
+// countByPost counts the rows of a table referencing each of the given posts
+// through column, ignoring rows created after the snapshot.
+func (f *FeedService) countByPost(table, column string, postIDs []uint32, snapshot time.Time) (map[uint32]int, error) {
+	var rows []struct {
+		PostID uint32
+		Count  int
+	}
+	if err := f.Database.Conn.
+		Table(table).
+		Select(column+" AS post_id, count(*) AS count").
+		Where(column+" IN (?) AND created_at <= ?", postIDs, snapshot).
+		Group(column).
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	counts := make(map[uint32]int, len(rows))
+	for _, row := range rows {
+		counts[row.PostID] = row.Count
+	}
+	return counts, nil
+}
+
+// affinity counts the user's recent likes of and replies to each author.
+func (f *FeedService) affinity(userID uint32, snapshot time.Time) (map[uint32]int, error) {
+	since := snapshot.Add(-f.Algorithmic.AffinityWindow)
+
+	var likes []struct {
+		UserID uint32
+		Count  int
+	}
+	if err := f.Database.Conn.
+		Table("likes").
+		Select("posts.user_id, count(*) AS count").
+		Joins("JOIN posts ON posts.id = likes.post_id").
+		Where("likes.user_id = ? AND likes.created_at > ? AND likes.created_at <= ?", userID, since, snapshot).
+		Group("posts.user_id").
+		Scan(&likes).Error; err != nil {
+		return nil, err
+	}
+
+	var replies []struct {
+		UserID uint32
+		Count  int
+	}
+	if err := f.Database.Conn.
+		Table("posts AS replies").
+		Select("parents.user_id, count(*) AS count").
+		Joins("JOIN posts AS parents ON parents.id = replies.reply_to_id").
+		Where("replies.user_id = ? AND replies.created_at > ? AND replies.created_at <= ?", userID, since, snapshot).
+		Group("parents.user_id").
+		Scan(&replies).Error; err != nil {
+		return nil, err
+	}
+
+	affinity := make(map[uint32]int, len(likes)+len(replies))
+	for _, row := range likes {
+		affinity[row.UserID] += row.Count
+	}
+	for _, row := range replies {
+		affinity[row.UserID] += row.Count
+	}
+	return affinity, nil
+}
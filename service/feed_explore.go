@@ -0,0 +1,226 @@
+package service
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwoff11/frens/models"
+	"github.com/gofiber/fiber/v2"
+)
+
+// exploreCandidate is a popular public post remembered by the explore cache.
+type exploreCandidate struct {
+	PostID uint32
+	UserID uint32
+	Text   string
+	Score  float64
+}
+
+// exploreCache holds the current explore candidates sorted by descending
+// score. The slice is replaced on every refresh and never modified in place,
+// so readers may keep using it after releasing the lock.
+type exploreCache struct {
+	mu         sync.RWMutex
+	candidates []exploreCandidate
+}
+
+// exploreCursor marks a position in the explore feed.
+type exploreCursor struct {
+	Score float64 `json:"s"`
+	ID    uint32  `json:"id"`
+}
+
+// after reports whether the candidate comes after the cursor position.
+func (ec *exploreCursor) after(c *exploreCandidate) bool {
+	if c.Score != ec.Score {
+		return c.Score < ec.Score
+	}
+	return c.PostID < ec.ID
+}
+
+// exploreFilter hides candidates a viewer should not see in their explore
+// feed: their own posts, posts of people they follow, block or mute and
+// posts matching their keyword filters.
+type exploreFilter struct {
+	hidden   map[uint32]bool
+	keywords []string
+}
+
+func (ef *exploreFilter) allows(c *exploreCandidate) bool {
+	if ef.hidden[c.UserID] {
+		return false
+	}
+
+	text := strings.ToLower(c.Text)
+	for _, keyword := range ef.keywords {
+		if strings.Contains(text, keyword) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *FeedService) GetExplore(c *fiber.Ctx, page Page) error {
+	count := page.size()
+
+	// The explore feed can be used without logging in
+	userID, err := getOptionalRequestorID(c)
+	if err != nil {
+		return err
+	}
+
+	var position *exploreCursor
+	if page.Cursor != "" {
+		position = &exploreCursor{}
+		if err := decodeCursor(page.Cursor, position); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid cursor parameter")
+		}
+	}
+
+	filter, err := f.exploreFilter(userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get the feed",
+		})
+	}
+
+	f.explore.mu.RLock()
+	candidates := f.explore.candidates
+	f.explore.mu.RUnlock()
+
+	// Skip everything up to and including the cursor position
+	start := 0
+	if position != nil {
+		start = sort.Search(len(candidates), func(i int) bool {
+			return position.after(&candidates[i])
+		})
+	}
+
+	// Walk the candidates in batches until one more post than requested is
+	// found, to know if there is a next page. Candidates whose posts were
+	// deleted or hidden since the cache was computed are skipped, so they
+	// don't leave the page short.
+	var posts []*models.Post
+	byPostID := make(map[uint32]*exploreCandidate)
+	for i := start; i < len(candidates) && len(posts) <= count; {
+		var postIDs []uint32
+		for ; i < len(candidates) && len(postIDs) <= count-len(posts); i++ {
+			if filter.allows(&candidates[i]) {
+				postIDs = append(postIDs, candidates[i].PostID)
+				byPostID[candidates[i].PostID] = &candidates[i]
+			}
+		}
+		if len(postIDs) == 0 {
+			break
+		}
+
+		found, err := f.visiblePosts(userID, postIDs)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to get the feed",
+			})
+		}
+		posts = append(posts, found...)
+	}
+
+	var next string
+	if len(posts) > count {
+		posts = posts[:count]
+		last := byPostID[posts[len(posts)-1].ID]
+		next, err = encodeCursor(&exploreCursor{Score: last.Score, ID: last.PostID})
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to create the cursor",
+			})
+		}
+	}
+
+	return writePostPage(c, f.Views, posts, next, "")
+}
+
+// exploreFilter loads what the viewer must not see in their explore feed.
+// Anonymous viewers see everything.
+func (f *FeedService) exploreFilter(viewerID uint32) (*exploreFilter, error) {
+	filter := &exploreFilter{hidden: make(map[uint32]bool)}
+	if viewerID == 0 {
+		return filter, nil
+	}
+	filter.hidden[viewerID] = true
+
+	var hidden []uint32
+	queries := []struct {
+		model  interface{}
+		column string
+		where  string
+	}{
+		{&models.Follow{}, "followed_id", "user_id = ?"},
+		{&models.Block{}, "blocked_id", "user_id = ?"},
+		{&models.Block{}, "user_id", "blocked_id = ?"},
+		{&models.Mute{}, "muted_id", "user_id = ?"},
+	}
+	for _, q := range queries {
+		if err := f.Database.Conn.Model(q.model).Where(q.where, viewerID).Pluck(q.column, &hidden).Error; err != nil {
+			return nil, err
+		}
+		for _, id := range hidden {
+			filter.hidden[id] = true
+		}
+		hidden = hidden[:0]
+	}
+
+	var keywords []string
+	if err := f.Database.Conn.Model(&models.KeywordFilter{}).Where("user_id = ?", viewerID).Pluck("keyword", &keywords).Error; err != nil {
+		return nil, err
+	}
+	for _, keyword := range keywords {
+		filter.keywords = append(filter.keywords, strings.ToLower(keyword))
+	}
+
+	return filter, nil
+}
+
+// RefreshExplore recomputes the explore candidates: the public posts with
+// the most engagement within the configured window.
+func (f *FeedService) RefreshExplore() error {
+	var candidates []exploreCandidate
+	if err := f.Database.Conn.Raw(`
+		SELECT id AS post_id, user_id, text, score FROM (
+			SELECT posts.id, posts.user_id, posts.text,
+				? * (SELECT count(*) FROM likes WHERE likes.post_id = posts.id) +
+				? * (SELECT count(*) FROM posts AS replies WHERE replies.reply_to_id = posts.id) +
+				? * (SELECT count(*) FROM posts AS reposts WHERE reposts.repost_of_id = posts.id) AS score
+			FROM posts
+			WHERE posts.privacy = ? AND posts.repost_of_id IS NULL AND posts.created_at > ?
+		) AS ranked
+		WHERE score >= ?
+		ORDER BY score DESC, id DESC
+		LIMIT ?`,
+		f.Explore.LikeWeight, f.Explore.ReplyWeight, f.Explore.RepostWeight,
+		models.PrivacyPublic, time.Now().Add(-f.Explore.Window),
+		f.Explore.MinEngagement, f.Explore.CandidateLimit,
+	).Scan(&candidates).Error; err != nil {
+		return err
+	}
+
+	f.explore.mu.Lock()
+	f.explore.candidates = candidates
+	f.explore.mu.Unlock()
+	return nil
+}
+
+// refreshExploreLoop keeps the explore cache fresh for the lifetime of the
+// process.
+func (f *FeedService) refreshExploreLoop() {
+	ticker := time.NewTicker(f.Explore.RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := f.RefreshExplore(); err != nil {
+			log.Println("Failed to refresh the explore feed:", err)
+		}
+		<-ticker.C
+	}
+}
@@ -0,0 +1,110 @@
+package service
+
+import (
+	"errors"
+	"log"
+	"strings"
+
+	"github.com/bwoff11/frens/models"
+	"github.com/bwoff11/frens/pkg/database"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/jsonapi"
+)
+
+// FilterService manages the keyword filters users hide posts from their
+// explore feed with.
+type FilterService struct {
+	Database *database.Database
+}
+
+// List returns the keyword filters of the user making the request in
+// alphabetical order.
+func (fs *FilterService) List(c *fiber.Ctx) error {
+	// Get the ID of the user making the request
+	userID, err := getRequestorID(c)
+	if err != nil {
+		// Log and handle error here
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to get user ID")
+	}
+
+	filters := []*models.KeywordFilter{}
+	if err := fs.Database.Conn.Where("user_id = ?", userID).Order("keyword").Find(&filters).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get the keyword filters",
+		})
+	}
+
+	// Set the content type to application/vnd.api+json
+	c.Response().Header.Set(fiber.HeaderContentType, jsonapi.MediaType)
+
+	// Marshal the filters into JSON API format
+	if err := jsonapi.MarshalPayload(c.Response().BodyWriter(), filters); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to marshal the keyword filters",
+		})
+	}
+	return nil
+}
+
+// Create adds a keyword filter for the user making the request. Keywords
+// match case-insensitively, so they are stored in lower case and a keyword
+// that differs from an existing one only in case is a conflict.
+func (fs *FilterService) Create(c *fiber.Ctx, keyword string) error {
+	// Get the ID of the user making the request
+	userID, err := getRequestorID(c)
+	if err != nil {
+		// Log and handle error here
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to get user ID")
+	}
+
+	keyword = strings.ToLower(strings.TrimSpace(keyword))
+	if keyword == "" {
+		return c.Status(fiber.StatusBadRequest).SendString("Keyword cannot be empty")
+	}
+
+	filter := models.KeywordFilter{UserID: userID, Keyword: keyword}
+	err = database.MapError(fs.Database.Conn.Create(&filter).Error)
+	if errors.Is(err, database.ErrUniqueViolation) {
+		return c.Status(fiber.StatusConflict).SendString("This keyword is already filtered")
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create the keyword filter",
+		})
+	}
+
+	// Set the content type to application/vnd.api+json
+	c.Response().Header.Set(fiber.HeaderContentType, jsonapi.MediaType)
+	c.Status(fiber.StatusCreated)
+
+	// Marshal the filter into JSON API format
+	return jsonapi.MarshalPayload(c.Response().BodyWriter(), &filter)
+}
+
+// Delete removes a keyword filter of the user making the request.
+func (fs *FilterService) Delete(c *fiber.Ctx, filterID uint32) error {
+	// Get the ID of the user making the request
+	userID, err := getRequestorID(c)
+	if err != nil {
+		// Log and handle error here
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to get user ID")
+	}
+
+	// Filters of other users are reported as missing
+	var filter models.KeywordFilter
+	if err := fs.Database.Conn.Where("id = ? AND user_id = ?", filterID, userID).First(&filter).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).SendString("Keyword filter not found")
+	}
+
+	if err := fs.Database.Conn.Delete(&filter).Error; err != nil {
+		// Log and handle error here
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete the keyword filter",
+		})
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
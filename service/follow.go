@@ -1,5 +1,125 @@
 package service
 
-import "github.com/bwoff11/frens/pkg/database"
+import (
+	"errors"
+	"log"
 
-type FollowService struct{ Database *database.Database }
+	"github.com/bwoff11/frens/models"
+	"github.com/bwoff11/frens/pkg/database"
+	"github.com/bwoff11/frens/pkg/events"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/jsonapi"
+	"github.com/jinzhu/gorm"
+)
+
+type FollowService struct {
+	Database  *database.Database
+	Timelines *TimelineService
+	Events    events.Bus
+}
+
+func (fs *FollowService) Follow(c *fiber.Ctx, followedID uint32) error {
+	// Get the ID of the user making the request
+	userID, err := getRequestorID(c)
+	if err != nil {
+		// Log and handle error here
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to get user ID")
+	}
+
+	if userID == followedID {
+		return c.Status(fiber.StatusBadRequest).SendString("Users cannot follow themselves")
+	}
+
+	// Check if the user to follow exists
+	var followed models.User
+	if err := fs.Database.Conn.First(&followed, followedID).Error; err != nil {
+		// User does not exist
+		return c.Status(fiber.StatusNotFound).SendString("User not found")
+	}
+
+	// Users who blocked each other cannot follow each other
+	var blocks int
+	if err := fs.Database.Conn.Model(&models.Block{}).
+		Where("(user_id = ? AND blocked_id = ?) OR (user_id = ? AND blocked_id = ?)", userID, followedID, followedID, userID).
+		Count(&blocks).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to check blocks",
+		})
+	}
+	if blocks > 0 {
+		return c.Status(fiber.StatusNotFound).SendString("User not found")
+	}
+
+	// Create the follow unless it already exists
+	follow := models.Follow{UserID: userID, FollowedID: followedID}
+	created := false
+	err = fs.Database.Conn.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where(follow).First(&follow).Error
+		if !gorm.IsRecordNotFoundError(err) {
+			return err
+		}
+		created = true
+		return database.MapError(tx.Create(&follow).Error)
+	})
+	if errors.Is(err, database.ErrUniqueViolation) {
+		// A concurrent request created the follow first
+		created = false
+		err = fs.Database.Conn.Where(follow).First(&follow).Error
+	}
+	if err != nil {
+		// Log and handle error here
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to follow the user",
+		})
+	}
+	if created {
+		fs.Events.Publish(events.Event{Type: events.UserFollowed, ActorID: userID, UserID: followedID})
+	}
+
+	// The new account's posts belong in the user's timeline now
+	fs.Timelines.Rebuild(userID)
+
+	// Set the content type to application/vnd.api+json
+	c.Response().Header.Set(fiber.HeaderContentType, jsonapi.MediaType)
+	c.Status(fiber.StatusCreated)
+
+	// Marshal the follow into JSON API format
+	return jsonapi.MarshalPayload(c.Response().BodyWriter(), &follow)
+}
+
+func (fs *FollowService) Unfollow(c *fiber.Ctx, followedID uint32) error {
+	// Get the ID of the user making the request
+	userID, err := getRequestorID(c)
+	if err != nil {
+		// Log and handle error here
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to get user ID")
+	}
+
+	// Find the Follow in the database
+	var existingFollow models.Follow
+	if err := fs.Database.Conn.
+		Where("user_id = ? AND followed_id = ?", userID, followedID).
+		First(&existingFollow).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).SendString("Follow not found")
+	}
+
+	// Delete the follow from the database
+	if err := fs.Database.Conn.Delete(&existingFollow).Error; err != nil {
+		// Log and handle error here
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to unfollow the user",
+		})
+	}
+
+	// The account's posts no longer belong in the user's timeline
+	fs.Timelines.Rebuild(userID)
+
+	// Set the content type to application/vnd.api+json
+	c.Response().Header.Set(fiber.HeaderContentType, jsonapi.MediaType)
+	c.Status(fiber.StatusOK)
+
+	// Marshal the follow into JSON API format
+	return jsonapi.MarshalPayload(c.Response().BodyWriter(), &existingFollow)
+}
@@ -1,126 +1,206 @@
 package service
 
 import (
+	"errors"
 	"log"
+	"time"
 
 	"github.com/bwoff11/frens/models"
 	"github.com/bwoff11/frens/pkg/database"
+	"github.com/bwoff11/frens/pkg/events"
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/jsonapi"
+	"github.com/jinzhu/gorm"
 )
 
-type LikeService struct{ Database *database.Database }
+type LikeService struct {
+	Database   *database.Database
+	Visibility *VisibilityPolicy
+	Views      *PostViews
+	Events     events.Bus
+}
 
+// LikePost likes the post for the user making the request. Liking a post
+// twice is not an error: it responds with 201 Created for a new like and
+// with 200 OK and the existing like otherwise.
 func (ls *LikeService) LikePost(c *fiber.Ctx, postID uint32) error {
 	// Get the ID of the user making the request
 	userID, err := getRequestorID(c)
 	if err != nil {
 		// Log and handle error here
 		log.Println(err)
-		return c.Status(fiber.StatusInternalServerError).SendString("Failed to get user ID")
+		return writeError(c, fiber.StatusInternalServerError, "internal_error", "Failed to get user ID", "", nil)
 	}
 
 	// Check if the post exists
 	var post models.Post
 	if err := ls.Database.Conn.First(&post, postID).Error; err != nil {
 		// Post does not exist
-		return c.Status(fiber.StatusNotFound).SendString("Post not found")
+		return writeError(c, fiber.StatusNotFound, "post_not_found", "Post not found", "", nil)
 	}
 
-	// Check if the user exists
-	var user models.User
-	if err := ls.Database.Conn.First(&user, userID).Error; err != nil {
-		// User does not exist
-		return c.Status(fiber.StatusNotFound).SendString("User not found")
+	// Check if the user is allowed to see the post. Posts the user cannot
+	// see are reported as missing so their existence is not leaked.
+	visible, err := ls.Visibility.CanView(userID, &post)
+	if err != nil {
+		return writeError(c, fiber.StatusInternalServerError, "internal_error", "Failed to check post visibility", "", nil)
 	}
-
-	// Create new Like
-	newLike := models.Like{
-		UserID: userID,
-		PostID: postID,
+	if !visible {
+		return writeError(c, fiber.StatusNotFound, "post_not_found", "Post not found", "", nil)
 	}
 
-	// Save the like to the database
-	if err := ls.Database.Conn.Create(&newLike).Error; err != nil {
-		// Log and handle error here
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create a like",
-		})
+	// Look for an existing like and create it if there is none, counting it
+	// on the post
+	like := models.Like{UserID: userID, PostID: postID}
+	created := false
+	err = ls.Database.Conn.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("user_id = ? AND post_id = ?", userID, postID).First(&like).Error
+		if !gorm.IsRecordNotFoundError(err) {
+			return err
+		}
+		if err := tx.Create(&like).Error; err != nil {
+			return database.MapError(err)
+		}
+		created = true
+		return adjustCount(tx, postID, likeCount, 1)
+	})
+	if errors.Is(err, database.ErrUniqueViolation) {
+		// A concurrent request liked the post first
+		err = ls.Database.Conn.Where("user_id = ? AND post_id = ?", userID, postID).First(&like).Error
 	}
-
-	// Preload User and Post on the newly created Like
-	if err := ls.Database.Conn.
-		Preload("User").
-		Preload("Post").
-		Preload("Post.User").
-		First(&newLike, newLike.ID).
-		Error; err != nil {
-		// Log and handle error here
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to retrieve the like",
-		})
+	if errors.Is(err, database.ErrForeignKeyViolation) {
+		// The post was deleted in the meantime
+		return writeError(c, fiber.StatusNotFound, "post_not_found", "Post not found", "", nil)
 	}
-
-	// Set the content type to application/vnd.api+json
-	c.Response().Header.Set(fiber.HeaderContentType, jsonapi.MediaType)
-
-	// Marshal the like into JSON API format
-	if err := jsonapi.MarshalPayload(c.Response().BodyWriter(), &newLike); err != nil {
+	if err != nil {
 		// Log and handle error here
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to marshal the like",
-		})
+		return writeError(c, fiber.StatusInternalServerError, "internal_error", "Failed to create a like", "", nil)
 	}
 
-	// Set the status code to 201 Created
-	c.Status(fiber.StatusCreated)
-
-	return nil
+	status := fiber.StatusOK
+	if created {
+		status = fiber.StatusCreated
+		ls.Events.Publish(events.Event{Type: events.PostLiked, ActorID: userID, PostID: postID})
+	}
+	return ls.writeLike(c, status, &like)
 }
 
+// UnlikePost removes the like of the user making the request from the post.
+// Unliking a post that isn't liked is not an error: it responds with 200 OK
+// and the removed like, or with 204 No Content if there was none.
 func (ls *LikeService) UnlikePost(c *fiber.Ctx, postID uint32) error {
 	// Get the ID of the user making the request
 	userID, err := getRequestorID(c)
 	if err != nil {
 		// Log and handle error here
 		log.Println(err)
-		return c.Status(fiber.StatusInternalServerError).SendString("Failed to get user ID")
+		return writeError(c, fiber.StatusInternalServerError, "internal_error", "Failed to get user ID", "", nil)
 	}
 
-	// Find the Like in the database
-	var existingLike models.Like
-	if err := ls.Database.Conn.
-		Preload("User").
-		Preload("Post").
-		Preload("Post.User").
-		Where("user_id = ? AND post_id = ?", userID, postID).First(&existingLike).Error; err != nil {
+	// Delete the like if there is one, no longer counting it on the post
+	var like models.Like
+	deleted := false
+	err = ls.Database.Conn.Transaction(func(tx *gorm.DB) error {
+		err := tx.Set("gorm:query_option", "FOR UPDATE").
+			Where("user_id = ? AND post_id = ?", userID, postID).
+			First(&like).Error
+		if gorm.IsRecordNotFoundError(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := tx.Delete(&like).Error; err != nil {
+			return err
+		}
+		deleted = true
+		return adjustCount(tx, postID, likeCount, -1)
+	})
+	if err != nil {
 		// Log and handle error here
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to find the like",
-		})
+		return writeError(c, fiber.StatusInternalServerError, "internal_error", "Failed to unlike a post", "", nil)
+	}
+	if !deleted {
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+
+	return ls.writeLike(c, fiber.StatusOK, &like)
+}
+
+// writeLike responds with the like, which may already be deleted, including
+// its user and post.
+func (ls *LikeService) writeLike(c *fiber.Ctx, status int, like *models.Like) error {
+	like.User, like.Post = &models.User{}, &models.Post{}
+	if err := ls.Database.Conn.First(like.User, like.UserID).Error; err != nil {
+		return writeError(c, fiber.StatusInternalServerError, "internal_error", "Failed to retrieve the like", "", nil)
+	}
+	if err := ls.Database.Conn.Preload("User").Preload("Media").First(like.Post, like.PostID).Error; err != nil {
+		return writeError(c, fiber.StatusInternalServerError, "internal_error", "Failed to retrieve the like", "", nil)
 	}
 
-	// Set the content type to application/vnd.api+json
+	if err := ls.Views.Prepare(c, like.Post); err != nil {
+		return writeError(c, fiber.StatusInternalServerError, "internal_error", "Failed to prepare the posts", "", nil)
+	}
+
+	// Set the content type to application/vnd.api+json and the status before
+	// writing the body
 	c.Response().Header.Set(fiber.HeaderContentType, jsonapi.MediaType)
+	c.Status(status)
 
 	// Marshal the like into JSON API format
-	if err := jsonapi.MarshalPayload(c.Response().BodyWriter(), &existingLike); err != nil {
+	if err := jsonapi.MarshalPayload(c.Response().BodyWriter(), like); err != nil {
 		// Log and handle error here
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to marshal the like",
-		})
+		return writeError(c, fiber.StatusInternalServerError, "internal_error", "Failed to marshal the like", "", nil)
+	}
+	return nil
+}
+
+// ListByUser returns the posts the user liked, most recently liked first. The
+// list is subject to the user's likes privacy, and liked posts the viewer may
+// not see are left out.
+func (ls *LikeService) ListByUser(c *fiber.Ctx, userID uint32, page Page) error {
+	// Likes can be listed without logging in if the user allows it
+	viewerID, err := getOptionalRequestorID(c)
+	if err != nil {
+		return err
 	}
 
-	// Delete the like from the database
-	if err := ls.Database.Conn.Delete(&existingLike).Error; err != nil {
-		// Log and handle error here
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to unlike a post",
-		})
+	var user models.User
+	if err := ls.Database.Conn.First(&user, userID).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return writeError(c, fiber.StatusNotFound, "user_not_found", "User not found", "", nil)
+		}
+		return writeError(c, fiber.StatusInternalServerError, "internal_error", "Failed to get the user", "", nil)
 	}
 
-	// Set the status code to 200 OK
-	c.Status(fiber.StatusOK)
+	allowed, err := ls.Visibility.CanViewLikes(viewerID, &user)
+	if err != nil {
+		return writeError(c, fiber.StatusInternalServerError, "internal_error", "Failed to check likes visibility", "", nil)
+	}
+	if !allowed {
+		return writeError(c, fiber.StatusForbidden, "likes_not_visible", "The user's likes are not visible", "", nil)
+	}
 
-	return nil
+	query := ls.Database.Conn.
+		Select("likes.*").
+		Joins("JOIN posts ON posts.id = likes.post_id").
+		Scopes(ls.Visibility.Scope(viewerID)).
+		Where("likes.user_id = ?", userID).
+		Preload("Post").
+		Preload("Post.User").
+		Preload("Post.Media")
+	likes, next, prev, err := paginate(query, page, "likes.created_at", "likes.id",
+		func(l *models.Like) (time.Time, uint32) { return l.CreatedAt, l.ID })
+	if err == errInvalidCursor {
+		return writeError(c, fiber.StatusBadRequest, "invalid_cursor", "Invalid cursor parameter", "", nil)
+	}
+	if err != nil {
+		return writeError(c, fiber.StatusInternalServerError, "internal_error", "Failed to get the likes", "", nil)
+	}
+
+	posts := make([]*models.Post, len(likes))
+	for i, like := range likes {
+		posts[i] = like.Post
+	}
+	return writePostPage(c, ls.Views, posts, next, prev)
 }
@@ -1,5 +1,461 @@
 package service
 
-import "github.com/bwoff11/frens/pkg/database"
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
-type MediaService struct{ Database *database.Database }
+	"github.com/bwoff11/frens/models"
+	"github.com/bwoff11/frens/pkg/config"
+	"github.com/bwoff11/frens/pkg/database"
+	"github.com/bwoff11/frens/pkg/imageproc"
+	"github.com/bwoff11/frens/pkg/storage"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/jsonapi"
+	"github.com/jinzhu/gorm"
+)
+
+type MediaService struct {
+	Database   *database.Database
+	Storage    storage.Storage
+	Visibility *VisibilityPolicy
+	Images     *imageproc.Processor
+	Transcodes *TranscodeService
+	URLs       *MediaURLs
+	Config     *config.MediaConfig
+
+	// UploadLimiter limits the uploads of each user. Every route uploading
+	// media must use it, so they all count against the same limit.
+	UploadLimiter fiber.Handler
+}
+
+func (ms *MediaService) Upload(c *fiber.Ctx, file *multipart.FileHeader, description string, sensitive bool) error {
+	// Get the ID of the user making the request
+	userID, err := getRequestorID(c)
+	if err != nil {
+		// Log and handle error here
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to get user ID")
+	}
+
+	// Reject files that are too large before reading them
+	if file.Size > ms.maxSize() {
+		return c.Status(fiber.StatusRequestEntityTooLarge).SendString("File is too large")
+	}
+
+	src, err := file.Open()
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Failed to read the file")
+	}
+	defer src.Close()
+
+	media, err := ms.ingest(c.UserContext(), userID, src, file.Size, description, sensitive)
+	if err != nil {
+		var fiberErr *fiber.Error
+		if errors.As(err, &fiberErr) {
+			return c.Status(fiberErr.Code).SendString(fiberErr.Message)
+		}
+		var quotaErr *quotaError
+		if errors.As(err, &quotaErr) {
+			return writeQuotaError(c, quotaErr)
+		}
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to store the media",
+		})
+	}
+
+	// New media is not attached to any post yet, so it's not public
+	return ms.writeMedia(c, fiber.StatusCreated, media, false)
+}
+
+// writeMedia responds with the media in JSON:API format.
+func (ms *MediaService) writeMedia(c *fiber.Ctx, status int, media *models.Media, public bool) error {
+	if err := ms.URLs.Sign(c.UserContext(), media, public); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to sign media URLs",
+		})
+	}
+
+	// Set the content type to application/vnd.api+json
+	c.Response().Header.Set(fiber.HeaderContentType, jsonapi.MediaType)
+	c.Status(status)
+
+	// Marshal the media into JSON API format
+	return jsonapi.MarshalPayload(c.Response().BodyWriter(), media)
+}
+
+// ingest validates an uploaded file of size bytes and stores it as a new
+// media item of the user. Problems with the file itself are returned as
+// *fiber.Error, and a full quota as *quotaError.
+func (ms *MediaService) ingest(ctx context.Context, userID uint32, src io.Reader, size int64, description string, sensitive bool) (*models.Media, error) {
+	// Don't bother reading the file if nothing more fits. The final check
+	// happens when the media is stored.
+	if err := ms.checkQuota(ms.Database.Conn, userID, 1); err != nil {
+		return nil, err
+	}
+	if size == 0 {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "File is empty")
+	}
+
+	// Trust the content rather than the file name or the client
+	head := make([]byte, 512)
+	n, err := io.ReadFull(src, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	head = head[:n]
+	contentType := http.DetectContentType(head)
+	if !ms.allowed(contentType) {
+		return nil, fiber.NewError(fiber.StatusUnsupportedMediaType, "Unsupported file type "+contentType)
+	}
+
+	kind := mediaKind(contentType)
+	maxSize := ms.Config.MaxSize
+	if kind != models.MediaKindImage {
+		maxSize = ms.Config.Transcode.MaxSize
+	}
+	if size > maxSize {
+		return nil, fiber.NewError(fiber.StatusRequestEntityTooLarge, "File is too large")
+	}
+	src = io.LimitReader(io.MultiReader(bytes.NewReader(head), src), size)
+
+	media := &models.Media{
+		UserID:      userID,
+		Description: description,
+		Sensitive:   sensitive,
+	}
+
+	// Video and audio can be large, so they are streamed to storage rather
+	// than read into memory, and take a while, so the client polls until
+	// they're ready
+	if kind != models.MediaKindImage {
+		if err := ms.Transcodes.submit(ctx, media, contentType, src, size); err != nil {
+			return nil, err
+		}
+		return media, nil
+	}
+
+	// Images are decoded in memory anyway, and limited to the smaller size
+	data := make([]byte, size)
+	if _, err := io.ReadFull(src, data); err != nil {
+		return nil, err
+	}
+
+	// Identical uploads share the stored files and skip processing
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	created, err := ms.createFromBlob(media, hash)
+	if err != nil {
+		return nil, err
+	}
+	if created {
+		return media, nil
+	}
+
+	// Never store the upload itself, only re-encoded variants of it
+	processed, err := ms.Images.Process(ctx, data)
+	switch {
+	case errors.Is(err, imageproc.ErrInvalidImage):
+		return nil, fiber.NewError(fiber.StatusUnprocessableEntity, "Invalid image")
+	case errors.Is(err, imageproc.ErrTooManyPixels):
+		return nil, fiber.NewError(fiber.StatusRequestEntityTooLarge, "Image dimensions are too large")
+	case err != nil:
+		return nil, err
+	}
+
+	blob := &models.Blob{
+		Hash:     hash,
+		Kind:     models.MediaKindImage,
+		Width:    processed.Width,
+		Height:   processed.Height,
+		Blurhash: processed.Blurhash,
+	}
+	for _, variant := range processed.Variants {
+		if variant.Name == imageproc.VariantOriginal {
+			blob.ContentType = variant.ContentType
+			blob.Size = int64(len(variant.Data))
+		}
+	}
+
+	if err := ms.createWithBlob(ctx, media, blob, processed.Variants); err != nil {
+		return nil, err
+	}
+
+	return media, nil
+}
+
+// deleteFiles removes all stored variants of the media, and the upload of
+// media that has not been transcoded yet.
+func (ms *MediaService) deleteFiles(ctx context.Context, media *models.Media) {
+	variants := models.MediaVariants
+	if media.State == models.MediaStateProcessing {
+		variants = append(variants[:len(variants):len(variants)], models.MediaSourceVariant)
+	}
+	for _, variant := range variants {
+		if err := ms.Storage.Delete(ctx, media.VariantKey(variant)); err != nil {
+			log.Println("Failed to delete stored media:", err)
+		}
+	}
+}
+
+// maxSize is the size of the largest file that may be uploaded.
+func (ms *MediaService) maxSize() int64 {
+	if ms.Config.Transcode.MaxSize > ms.Config.MaxSize {
+		return ms.Config.Transcode.MaxSize
+	}
+	return ms.Config.MaxSize
+}
+
+func (ms *MediaService) allowed(contentType string) bool {
+	for _, allowed := range ms.Config.AllowedTypes {
+		if allowed == contentType {
+			return true
+		}
+	}
+	return false
+}
+
+func (ms *MediaService) Get(c *fiber.Ctx, mediaID uint32) error {
+	media, public, err := ms.findVisible(c, mediaID)
+	if err != nil || media == nil {
+		return err
+	}
+
+	return ms.writeMedia(c, fiber.StatusOK, media, public)
+}
+
+// GetFile streams a variant of the media to whoever may see it. Files of
+// public media never change, so they may be cached for a long time.
+func (ms *MediaService) GetFile(c *fiber.Ctx, mediaID uint32, variant string) error {
+	media, public, err := ms.findVisible(c, mediaID)
+	if err != nil || media == nil {
+		return err
+	}
+
+	if media.State != models.MediaStateReady {
+		return c.Status(fiber.StatusNotFound).SendString("Media is not ready")
+	}
+
+	reader, object, err := ms.Storage.Get(c.UserContext(), media.VariantKey(variant))
+	if errors.Is(err, storage.ErrNotFound) {
+		return c.Status(fiber.StatusNotFound).SendString("Media not found")
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to read the media",
+		})
+	}
+
+	if public {
+		c.Set(fiber.HeaderCacheControl, "public, max-age=31536000, immutable")
+	} else {
+		// The response depends on who is asking
+		c.Set(fiber.HeaderCacheControl, "private, no-cache")
+		c.Vary(fiber.HeaderAuthorization)
+	}
+	c.Set(fiber.HeaderContentType, object.ContentType)
+	return c.Status(fiber.StatusOK).SendStream(reader, int(object.Size))
+}
+
+// GetSignedFile streams the object stored under key if the signature made
+// for it by the local storage backend is valid and has not expired. Other
+// backends serve signed URLs themselves.
+func (ms *MediaService) GetSignedFile(c *fiber.Ctx, key, expires, signature string) error {
+	local, ok := ms.Storage.(*storage.Local)
+	if !ok || !local.Verify(key, expires, signature) {
+		return c.Status(fiber.StatusNotFound).SendString("File not found")
+	}
+
+	reader, object, err := ms.Storage.Get(c.UserContext(), key)
+	if errors.Is(err, storage.ErrNotFound) {
+		return c.Status(fiber.StatusNotFound).SendString("File not found")
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to read the file",
+		})
+	}
+
+	// Caches must not keep the file longer than the signature is valid
+	unix, _ := strconv.ParseInt(expires, 10, 64)
+	maxAge := time.Until(time.Unix(unix, 0)) / time.Second
+	c.Set(fiber.HeaderCacheControl, "private, max-age="+strconv.FormatInt(int64(maxAge), 10))
+	c.Set(fiber.HeaderContentType, object.ContentType)
+	return c.Status(fiber.StatusOK).SendStream(reader, int(object.Size))
+}
+
+// Update changes the description and sensitive flag of the user's media.
+// Nil values are left unchanged.
+func (ms *MediaService) Update(c *fiber.Ctx, mediaID uint32, description *string, sensitive *bool) error {
+	// Get the ID of the user making the request
+	userID, err := getRequestorID(c)
+	if err != nil {
+		// Log and handle error here
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to get user ID")
+	}
+
+	changes := map[string]interface{}{}
+	if description != nil {
+		changes["description"] = *description
+	}
+	if sensitive != nil {
+		changes["sensitive"] = *sensitive
+	}
+
+	// Only the uploader can edit media
+	var media models.Media
+	err = ms.Database.Conn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Set("gorm:query_option", "FOR UPDATE").
+			Where("id = ? AND user_id = ?", mediaID, userID).
+			First(&media).Error; err != nil {
+			return err
+		}
+
+		// With alt text required, media attached to a post must keep its
+		// description
+		if ms.Config.RequireAltText && media.PostID != nil &&
+			description != nil && strings.TrimSpace(*description) == "" {
+			return errMissingAltText
+		}
+
+		return tx.Model(&media).Updates(changes).Error
+	})
+	if gorm.IsRecordNotFoundError(err) {
+		return c.Status(fiber.StatusNotFound).SendString("Media not found")
+	}
+	if err == errMissingAltText {
+		return c.Status(fiber.StatusBadRequest).SendString("Media attached to a post must have a description")
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update the media",
+		})
+	}
+
+	post, err := ms.postOf(&media)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get the media's post",
+		})
+	}
+
+	return ms.writeMedia(c, fiber.StatusOK, &media, post != nil && post.Privacy == models.PrivacyPublic)
+}
+
+func (ms *MediaService) Delete(c *fiber.Ctx, mediaID uint32) error {
+	// Get the ID of the user making the request
+	userID, err := getRequestorID(c)
+	if err != nil {
+		// Log and handle error here
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to get user ID")
+	}
+
+	// Only the uploader can delete media
+	var media models.Media
+	if err := ms.Database.Conn.Where("id = ? AND user_id = ?", mediaID, userID).First(&media).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).SendString("Media not found")
+	}
+
+	// Custom emoji keep their image until they are deleted
+	var emoji int
+	if err := ms.Database.Conn.Model(&models.CustomEmoji{}).Where("media_id = ?", media.ID).Count(&emoji).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete the media",
+		})
+	}
+	if emoji > 0 {
+		return c.Status(fiber.StatusConflict).SendString("Media is used by a custom emoji")
+	}
+
+	err = ms.Database.Conn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&media).Error; err != nil {
+			return err
+		}
+		_, err := ms.releaseBlob(c.UserContext(), tx, &media)
+		return err
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete the media",
+		})
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// findVisible loads the media if the user making the request, who may be
+// anonymous, may see it, and reports whether it is public. If not, the
+// response has already been written and nil is returned.
+func (ms *MediaService) findVisible(c *fiber.Ctx, mediaID uint32) (*models.Media, bool, error) {
+	userID, err := getOptionalRequestorID(c)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var media models.Media
+	if err := ms.Database.Conn.First(&media, mediaID).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return nil, false, c.Status(fiber.StatusNotFound).SendString("Media not found")
+		}
+		return nil, false, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get the media",
+		})
+	}
+
+	// Images of custom emoji are public
+	var emoji int
+	if err := ms.Database.Conn.Model(&models.CustomEmoji{}).Where("media_id = ?", media.ID).Count(&emoji).Error; err != nil {
+		return nil, false, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to check media visibility",
+		})
+	}
+	if emoji > 0 {
+		return &media, true, nil
+	}
+
+	// Media that is not attached to a post is only visible to its uploader,
+	// attached media to whoever may see the post
+	post, err := ms.postOf(&media)
+	visible := media.UserID == userID
+	if err == nil && post != nil && !visible {
+		visible, err = ms.Visibility.CanView(userID, post)
+	}
+	if err != nil {
+		return nil, false, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to check media visibility",
+		})
+	}
+	if !visible {
+		return nil, false, c.Status(fiber.StatusNotFound).SendString("Media not found")
+	}
+	return &media, post != nil && post.Privacy == models.PrivacyPublic, nil
+}
+
+// postOf loads the post the media is attached to, or returns nil if it is
+// not attached to one.
+func (ms *MediaService) postOf(media *models.Media) (*models.Post, error) {
+	if media.PostID == nil {
+		return nil, nil
+	}
+
+	var post models.Post
+	if err := ms.Database.Conn.First(&post, *media.PostID).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &post, nil
+}
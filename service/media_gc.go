@@ -0,0 +1,297 @@
+package service
+
+import (
+	"context"
+	"log"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwoff11/frens/models"
+	"github.com/bwoff11/frens/pkg/config"
+	"github.com/bwoff11/frens/pkg/database"
+	"github.com/bwoff11/frens/pkg/storage"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/jsonapi"
+	"github.com/jinzhu/gorm"
+)
+
+// unusedMedia matches media that was never attached to a post, or whose
+// post no longer exists, unless it's the image of a custom emoji.
+const unusedMedia = `(post_id IS NULL OR NOT EXISTS (SELECT 1 FROM posts WHERE posts.id = media.post_id)) AND
+	NOT EXISTS (SELECT 1 FROM custom_emojis WHERE custom_emojis.media_id = media.id)`
+
+// MediaGCStats describes what a run of the media garbage collector removed,
+// or would have removed in a dry run. In a dry run, blobs that would be
+// freed by removing media are not counted.
+type MediaGCStats struct {
+	ID             uint32    `jsonapi:"primary,media-gc-run"`
+	StartedAt      time.Time `jsonapi:"attr,startedAt"`
+	FinishedAt     time.Time `jsonapi:"attr,finishedAt"`
+	DryRun         bool      `jsonapi:"attr,dryRun"`
+	MediaDeleted   int       `jsonapi:"attr,mediaDeleted"`
+	BlobsDeleted   int       `jsonapi:"attr,blobsDeleted"`
+	OrphansDeleted int       `jsonapi:"attr,orphansDeleted"` // Stored files without a row
+	BytesReclaimed int64     `jsonapi:"attr,bytesReclaimed"` // Counting original variants only
+	Errors         int       `jsonapi:"attr,errors"`
+}
+
+// MediaGCService removes unused media and stored files nothing refers to.
+type MediaGCService struct {
+	Database *database.Database
+	Storage  storage.Storage
+	Media    *MediaService
+	Config   *config.MediaGCConfig
+
+	running sync.Mutex // Held for the duration of a run
+	mu      sync.RWMutex
+	runs    uint32
+	last    *MediaGCStats
+}
+
+// Stats responds with the stats of the last run.
+func (gs *MediaGCService) Stats(c *fiber.Ctx) error {
+	gs.mu.RLock()
+	stats := gs.last
+	gs.mu.RUnlock()
+
+	if stats == nil {
+		return c.Status(fiber.StatusNotFound).SendString("No collection has run yet")
+	}
+
+	// Set the content type to application/vnd.api+json
+	c.Response().Header.Set(fiber.HeaderContentType, jsonapi.MediaType)
+	c.Status(fiber.StatusOK)
+
+	// Marshal the stats into JSON API format
+	return jsonapi.MarshalPayload(c.Response().BodyWriter(), stats)
+}
+
+// Run collects right away and responds with the stats of the run.
+func (gs *MediaGCService) Run(c *fiber.Ctx, dryRun bool) error {
+	stats, err := gs.collect(c.UserContext(), dryRun)
+	if err != nil {
+		log.Println("Media garbage collection failed:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to collect media",
+		})
+	}
+
+	// Set the content type to application/vnd.api+json
+	c.Response().Header.Set(fiber.HeaderContentType, jsonapi.MediaType)
+	c.Status(fiber.StatusOK)
+
+	// Marshal the stats into JSON API format
+	return jsonapi.MarshalPayload(c.Response().BodyWriter(), stats)
+}
+
+func (gs *MediaGCService) loop() {
+	ticker := time.NewTicker(gs.Config.Interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		stats, err := gs.collect(context.Background(), gs.Config.DryRun)
+		if err != nil {
+			log.Println("Media garbage collection failed:", err)
+			continue
+		}
+		log.Printf("Media garbage collection removed %d media, %d blobs and %d orphaned files (%d bytes, dry run: %t)",
+			stats.MediaDeleted, stats.BlobsDeleted, stats.OrphansDeleted, stats.BytesReclaimed, stats.DryRun)
+	}
+}
+
+// collect runs the collector once. Only one run happens at a time.
+func (gs *MediaGCService) collect(ctx context.Context, dryRun bool) (*MediaGCStats, error) {
+	gs.running.Lock()
+	defer gs.running.Unlock()
+
+	stats := &MediaGCStats{StartedAt: time.Now(), DryRun: dryRun}
+	cutoff := stats.StartedAt.Add(-gs.Config.TTL)
+
+	err := gs.collectMedia(ctx, cutoff, stats)
+	if err == nil {
+		err = gs.collectOrphans(ctx, cutoff, stats)
+	}
+	stats.FinishedAt = time.Now()
+
+	// Partial runs are recorded too, they may have removed something
+	gs.mu.Lock()
+	gs.runs++
+	stats.ID = gs.runs
+	gs.last = stats
+	gs.mu.Unlock()
+
+	return stats, err
+}
+
+// collectMedia removes unused media created before the cutoff.
+func (gs *MediaGCService) collectMedia(ctx context.Context, cutoff time.Time, stats *MediaGCStats) error {
+	var afterID uint32
+	for {
+		var batch []models.Media
+		err := gs.Database.Conn.
+			Where("id > ? AND created_at < ?", afterID, cutoff).
+			Where(unusedMedia).
+			Order("id").
+			Limit(gs.Config.BatchSize).
+			Find(&batch).Error
+		if err != nil {
+			return err
+		}
+
+		for i := range batch {
+			media := &batch[i]
+			afterID = media.ID
+
+			if stats.DryRun {
+				stats.MediaDeleted++
+				stats.BytesReclaimed += media.Size
+				continue
+			}
+
+			deleted, freed := false, false
+			err := gs.Database.Conn.Transaction(func(tx *gorm.DB) error {
+				// The media may have been attached since it was loaded
+				result := tx.Where("id = ?", media.ID).Where(unusedMedia).Delete(&models.Media{})
+				if result.Error != nil || result.RowsAffected == 0 {
+					return result.Error
+				}
+				deleted = true
+
+				var err error
+				freed, err = gs.Media.releaseBlob(ctx, tx, media)
+				return err
+			})
+			if err != nil {
+				log.Println("Failed to collect media:", err)
+				stats.Errors++
+				continue
+			}
+			if deleted {
+				stats.MediaDeleted++
+			}
+			if freed {
+				stats.BlobsDeleted++
+				stats.BytesReclaimed += media.Size
+			}
+		}
+
+		if len(batch) < gs.Config.BatchSize {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+// orphanSource is a part of the storage whose files belong to rows of a
+// table. owner maps the key of a file to the value of column identifying
+// its row.
+type orphanSource struct {
+	prefix string
+	model  interface{}
+	column string
+	owner  func(key string) string
+}
+
+var orphanSources = []orphanSource{
+	{
+		prefix: "blobs/",
+		model:  &models.Blob{},
+		column: "hash",
+		owner: func(key string) string {
+			return strings.TrimPrefix(path.Dir(key), "blobs/")
+		},
+	},
+	{
+		// Chunks of resumable uploads whose removal failed
+		prefix: "uploads/",
+		model:  &models.Upload{},
+		column: "id",
+		owner: func(key string) string {
+			return strings.TrimPrefix(path.Dir(key), "uploads/")
+		},
+	},
+	{
+		// Uploads waiting to be transcoded
+		prefix: "transcode/",
+		model:  &models.Media{},
+		column: "key",
+		owner:  path.Dir,
+	},
+	{
+		// Media stored before deduplication
+		prefix: "media/",
+		model:  &models.Media{},
+		column: "key",
+		owner:  path.Dir,
+	},
+}
+
+// collectOrphans removes stored files modified before the cutoff that no
+// row refers to, such as those left behind by failed deletions. Files of
+// uploads in progress are newer than the cutoff and have no row yet.
+func (gs *MediaGCService) collectOrphans(ctx context.Context, cutoff time.Time, stats *MediaGCStats) error {
+	for _, source := range orphanSources {
+		var batch []storage.Object
+		flush := func() error {
+			if len(batch) == 0 {
+				return nil
+			}
+			defer func() { batch = batch[:0] }()
+
+			owners := make([]string, len(batch))
+			for i, object := range batch {
+				owners[i] = source.owner(object.Key)
+			}
+
+			var known []string
+			err := gs.Database.Conn.Model(source.model).
+				Where(source.column+" IN (?)", owners).
+				Pluck(source.column, &known).Error
+			if err != nil {
+				return err
+			}
+			exists := make(map[string]bool, len(known))
+			for _, owner := range known {
+				exists[owner] = true
+			}
+
+			for i, object := range batch {
+				if exists[owners[i]] {
+					continue
+				}
+				if !stats.DryRun {
+					if err := gs.Storage.Delete(ctx, object.Key); err != nil {
+						log.Println("Failed to delete orphaned file:", err)
+						stats.Errors++
+						continue
+					}
+				}
+				stats.OrphansDeleted++
+				stats.BytesReclaimed += object.Size
+			}
+			return nil
+		}
+
+		err := gs.Storage.List(ctx, source.prefix, func(object storage.Object) error {
+			if !object.LastModified.Before(cutoff) {
+				return nil
+			}
+			batch = append(batch, object)
+			if len(batch) < gs.Config.BatchSize {
+				return nil
+			}
+			return flush()
+		})
+		if err == nil {
+			err = flush()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/bwoff11/frens/models"
+	"github.com/bwoff11/frens/pkg/storage"
+)
+
+// MediaURLs decides where clients download media from. Media of public
+// posts keeps its stable API URLs, which can be cached for a long time.
+// Everything else gets URLs signed by the storage backend that stop working
+// after Expiry, so they are useless to anyone they are passed on to.
+type MediaURLs struct {
+	Storage storage.Storage
+	Expiry  time.Duration
+}
+
+// Sign replaces the URLs of the media with signed ones, unless it's public.
+func (mu *MediaURLs) Sign(ctx context.Context, media *models.Media, public bool) error {
+	if public {
+		return nil
+	}
+
+	urls := []struct {
+		url     *string
+		variant string
+	}{
+		{&media.URL, "original"},
+		{&media.PreviewURL, "small"},
+		{&media.ThumbnailURL, "thumbnail"},
+	}
+	for _, u := range urls {
+		// Variants that can't be downloaded have no URL to begin with
+		if *u.url == "" {
+			continue
+		}
+		signed, err := mu.Storage.SignedURL(ctx, media.VariantKey(u.variant), mu.Expiry)
+		if err != nil {
+			return err
+		}
+		*u.url = signed
+	}
+	return nil
+}
+
+// SignPosts signs the URLs of the media attached to posts that aren't
+// public.
+func (mu *MediaURLs) SignPosts(ctx context.Context, posts ...*models.Post) error {
+	for _, post := range posts {
+		if post == nil {
+			continue
+		}
+		for _, media := range post.Media {
+			if err := mu.Sign(ctx, media, post.Privacy == models.PrivacyPublic); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
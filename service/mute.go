@@ -0,0 +1,144 @@
+package service
+
+import (
+	"errors"
+	"log"
+
+	"github.com/bwoff11/frens/models"
+	"github.com/bwoff11/frens/pkg/database"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/jsonapi"
+	"github.com/jinzhu/gorm"
+)
+
+// MuteService manages the accounts users muted. Muted accounts are left out
+// of the user's explore feed and notifications, without them knowing.
+type MuteService struct {
+	Database *database.Database
+}
+
+// List returns the mutes of the user making the request, most recent first.
+func (ms *MuteService) List(c *fiber.Ctx) error {
+	// Get the ID of the user making the request
+	userID, err := getRequestorID(c)
+	if err != nil {
+		// Log and handle error here
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to get user ID")
+	}
+
+	mutes := []*models.Mute{}
+	if err := ms.Database.Conn.Where("user_id = ?", userID).Order("created_at DESC, id DESC").Find(&mutes).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get the mutes",
+		})
+	}
+
+	// Set the content type to application/vnd.api+json
+	c.Response().Header.Set(fiber.HeaderContentType, jsonapi.MediaType)
+
+	// Marshal the mutes into JSON API format
+	if err := jsonapi.MarshalPayload(c.Response().BodyWriter(), mutes); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to marshal the mutes",
+		})
+	}
+	return nil
+}
+
+// Mute mutes the user for the user making the request. Muting a user twice
+// is not an error: it responds with 201 Created for a new mute and with
+// 200 OK and the existing mute otherwise.
+func (ms *MuteService) Mute(c *fiber.Ctx, mutedID uint32) error {
+	// Get the ID of the user making the request
+	userID, err := getRequestorID(c)
+	if err != nil {
+		// Log and handle error here
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to get user ID")
+	}
+
+	if userID == mutedID {
+		return c.Status(fiber.StatusBadRequest).SendString("Users cannot mute themselves")
+	}
+
+	// Check if the user to mute exists
+	var muted models.User
+	if err := ms.Database.Conn.First(&muted, mutedID).Error; err != nil {
+		// User does not exist
+		return c.Status(fiber.StatusNotFound).SendString("User not found")
+	}
+
+	// Create the mute unless it already exists
+	mute := models.Mute{UserID: userID, MutedID: mutedID}
+	created := false
+	err = ms.Database.Conn.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where(mute).First(&mute).Error
+		if !gorm.IsRecordNotFoundError(err) {
+			return err
+		}
+		created = true
+		return database.MapError(tx.Create(&mute).Error)
+	})
+	if errors.Is(err, database.ErrUniqueViolation) {
+		// A concurrent request created the mute first
+		created = false
+		err = ms.Database.Conn.Where(mute).First(&mute).Error
+	}
+	if errors.Is(err, database.ErrForeignKeyViolation) {
+		// The user was deleted in the meantime
+		return c.Status(fiber.StatusNotFound).SendString("User not found")
+	}
+	if err != nil {
+		// Log and handle error here
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to mute the user",
+		})
+	}
+
+	status := fiber.StatusOK
+	if created {
+		status = fiber.StatusCreated
+	}
+
+	// Set the content type to application/vnd.api+json
+	c.Response().Header.Set(fiber.HeaderContentType, jsonapi.MediaType)
+	c.Status(status)
+
+	// Marshal the mute into JSON API format
+	return jsonapi.MarshalPayload(c.Response().BodyWriter(), &mute)
+}
+
+// Unmute removes the mute of the user making the request from the user.
+func (ms *MuteService) Unmute(c *fiber.Ctx, mutedID uint32) error {
+	// Get the ID of the user making the request
+	userID, err := getRequestorID(c)
+	if err != nil {
+		// Log and handle error here
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to get user ID")
+	}
+
+	// Find the mute in the database
+	var mute models.Mute
+	if err := ms.Database.Conn.
+		Where("user_id = ? AND muted_id = ?", userID, mutedID).
+		First(&mute).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).SendString("Mute not found")
+	}
+
+	// Delete the mute from the database
+	if err := ms.Database.Conn.Delete(&mute).Error; err != nil {
+		// Log and handle error here
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to unmute the user",
+		})
+	}
+
+	// Set the content type to application/vnd.api+json
+	c.Response().Header.Set(fiber.HeaderContentType, jsonapi.MediaType)
+	c.Status(fiber.StatusOK)
+
+	// Marshal the mute into JSON API format
+	return jsonapi.MarshalPayload(c.Response().BodyWriter(), &mute)
+}
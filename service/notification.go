@@ -0,0 +1,382 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"time"
+
+	"github.com/bwoff11/frens/models"
+	"github.com/bwoff11/frens/pkg/database"
+	"github.com/bwoff11/frens/pkg/events"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/jsonapi"
+	"github.com/jinzhu/gorm"
+)
+
+// NotificationService turns events into notifications for the users they
+// concern and lets users read them.
+type NotificationService struct {
+	Database   *database.Database
+	Visibility *VisibilityPolicy
+	Events     events.Bus
+	Views      *PostViews
+}
+
+// mentionPattern matches mentions of users in post text, like @frens.
+var mentionPattern = regexp.MustCompile(`(?:^|[^\w@])@(\w+)`)
+
+// maxMentions is how many users a post can notify by mentioning them.
+const maxMentions = 10
+
+// NotificationFilter selects the notifications to list. Empty Kinds lists
+// all kinds.
+type NotificationFilter struct {
+	Kinds  []string
+	Unread bool
+}
+
+// List returns the notifications of the user making the request, the most
+// recently updated first. Notifications from users they blocked, were
+// blocked by or muted are left out, even if they were created before. The
+// number of unread notifications matching the filter is returned in the
+// document meta.
+func (ns *NotificationService) List(c *fiber.Ctx, filter NotificationFilter, page Page) error {
+	// Get the ID of the user making the request
+	userID, err := getRequestorID(c)
+	if err != nil {
+		// Log and handle error here
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to get user ID")
+	}
+
+	query := ns.Database.Conn.
+		Where("notifications.user_id = ?", userID).
+		Scopes(hideSilencedActors(userID))
+	if len(filter.Kinds) > 0 {
+		query = query.Where("notifications.kind IN (?)", filter.Kinds)
+	}
+
+	var unread int
+	if err := query.Model(&models.Notification{}).Where("notifications.read_at IS NULL").Count(&unread).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to count the notifications",
+		})
+	}
+
+	if filter.Unread {
+		query = query.Where("notifications.read_at IS NULL")
+	}
+	query = query.
+		Preload("Actor").
+		Preload("Post").
+		Preload("Post.User").
+		Preload("Post.Media")
+	notifications, next, prev, err := paginate(query, page, "notifications.updated_at", "notifications.id",
+		func(n *models.Notification) (time.Time, uint32) { return n.UpdatedAt, n.ID })
+	if err == errInvalidCursor {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid cursor parameter")
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get the notifications",
+		})
+	}
+
+	posts := make([]*models.Post, len(notifications))
+	for i, notification := range notifications {
+		posts[i] = notification.Post
+	}
+	if err := ns.Views.Prepare(c, posts...); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to prepare the posts",
+		})
+	}
+
+	return writePageMeta(c, notifications, next, prev, jsonapi.Meta{"unreadCount": unread})
+}
+
+// MarkRead marks the given notifications of the user making the request as
+// read, or all of them if no IDs are given. Read notifications are no longer
+// grouped with new ones.
+func (ns *NotificationService) MarkRead(c *fiber.Ctx, ids []uint32) error {
+	// Get the ID of the user making the request
+	userID, err := getRequestorID(c)
+	if err != nil {
+		// Log and handle error here
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to get user ID")
+	}
+
+	query := ns.Database.Conn.Model(&models.Notification{}).
+		Where("user_id = ? AND read_at IS NULL", userID)
+	if len(ids) > 0 {
+		query = query.Where("id IN (?)", ids)
+	}
+	if err := query.UpdateColumn("read_at", time.Now()).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to mark the notifications as read",
+		})
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// describeNotification summarizes the notification in a sentence, like
+// "@alice and 12 others liked your post". The actor must be loaded.
+func describeNotification(notification *models.Notification) string {
+	actors := "Someone"
+	if notification.Actor != nil {
+		actors = "@" + notification.Actor.Username
+	}
+	switch others := notification.ActorCount - 1; {
+	case others == 1:
+		actors += " and 1 other"
+	case others > 1:
+		actors += fmt.Sprintf(" and %d others", others)
+	}
+
+	switch notification.Kind {
+	case models.NotificationLike:
+		return actors + " liked your post"
+	case models.NotificationReaction:
+		return actors + " reacted " + notification.Emoji + " to your post"
+	case models.NotificationFollow:
+		return actors + " followed you"
+	case models.NotificationMention:
+		return actors + " mentioned you"
+	case models.NotificationReply:
+		return actors + " replied to your post"
+	case models.NotificationRepost:
+		return actors + " reposted your post"
+	}
+	return actors + " interacted with you"
+}
+
+// truncate shortens the text to at most max characters, ending it with an
+// ellipsis if it was cut.
+func truncate(text string, max int) string {
+	runes := []rune(text)
+	if len(runes) <= max {
+		return text
+	}
+	return string(runes[:max-1]) + "…"
+}
+
+// hideSilencedActors restricts a query on notifications to those whose
+// actor the user hasn't blocked or muted, and who hasn't blocked the user.
+func hideSilencedActors(userID uint32) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where(`notifications.actor_id NOT IN (SELECT blocked_id FROM blocks WHERE user_id = ?) AND
+			notifications.actor_id NOT IN (SELECT user_id FROM blocks WHERE blocked_id = ?) AND
+			notifications.actor_id NOT IN (SELECT muted_id FROM mutes WHERE user_id = ?)`, userID, userID, userID)
+	}
+}
+
+// start subscribes to the events that cause notifications.
+func (ns *NotificationService) start() {
+	ns.Events.Subscribe("notifications", ns.handle,
+		events.PostCreated, events.PostLiked, events.PostReacted, events.UserFollowed)
+}
+
+func (ns *NotificationService) handle(event events.Event) {
+	var err error
+	switch event.Type {
+	case events.PostLiked:
+		err = ns.notifyAuthor(event, models.NotificationLike, fmt.Sprintf("like:%d", event.PostID))
+	case events.PostReacted:
+		err = ns.notifyAuthor(event, models.NotificationReaction, fmt.Sprintf("reaction:%d:%s", event.PostID, event.Emoji))
+	case events.UserFollowed:
+		err = ns.notify(&models.Notification{
+			UserID:   event.UserID,
+			Kind:     models.NotificationFollow,
+			GroupKey: "follow",
+			ActorID:  event.ActorID,
+		}, nil)
+	case events.PostCreated:
+		err = ns.notifyPost(event)
+	}
+	if err != nil {
+		log.Printf("Failed to notify about %s: %v", event.Type, err)
+	}
+}
+
+// notifyAuthor notifies the author of the post the event is about.
+func (ns *NotificationService) notifyAuthor(event events.Event, kind, groupKey string) error {
+	var post models.Post
+	if err := ns.Database.Conn.First(&post, event.PostID).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return nil
+		}
+		return err
+	}
+
+	return ns.notify(&models.Notification{
+		UserID:   post.UserID,
+		Kind:     kind,
+		GroupKey: groupKey,
+		ActorID:  event.ActorID,
+		PostID:   &post.ID,
+		Emoji:    event.Emoji,
+	}, &post)
+}
+
+// notifyPost notifies the users a new post replies to, reposts or mentions.
+// A user mentioned in a reply to their own post is only notified of the
+// reply.
+func (ns *NotificationService) notifyPost(event events.Event) error {
+	var post models.Post
+	if err := ns.Database.Conn.First(&post, event.PostID).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return nil
+		}
+		return err
+	}
+
+	notified := map[uint32]bool{post.UserID: true}
+	if post.ReplyToID != nil {
+		var parent models.Post
+		err := ns.Database.Conn.First(&parent, *post.ReplyToID).Error
+		if err != nil && !gorm.IsRecordNotFoundError(err) {
+			return err
+		}
+		if err == nil {
+			notified[parent.UserID] = true
+			if err := ns.notify(&models.Notification{
+				UserID:   parent.UserID,
+				Kind:     models.NotificationReply,
+				GroupKey: fmt.Sprintf("reply:%d", post.ID),
+				ActorID:  post.UserID,
+				PostID:   &post.ID,
+			}, &post); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Reposts are grouped by the original post, which the notification
+	// points to
+	if post.RepostOfID != nil {
+		var original models.Post
+		err := ns.Database.Conn.First(&original, *post.RepostOfID).Error
+		if err != nil && !gorm.IsRecordNotFoundError(err) {
+			return err
+		}
+		if err == nil {
+			if err := ns.notify(&models.Notification{
+				UserID:   original.UserID,
+				Kind:     models.NotificationRepost,
+				GroupKey: fmt.Sprintf("repost:%d", original.ID),
+				ActorID:  post.UserID,
+				PostID:   &original.ID,
+			}, &original); err != nil {
+				return err
+			}
+		}
+	}
+
+	var usernames []string
+	for _, match := range mentionPattern.FindAllStringSubmatch(post.Text, -1) {
+		usernames = append(usernames, match[1])
+		if len(usernames) == maxMentions {
+			break
+		}
+	}
+	if len(usernames) == 0 {
+		return nil
+	}
+
+	var mentioned []models.User
+	if err := ns.Database.Conn.Where("username IN (?)", usernames).Find(&mentioned).Error; err != nil {
+		return err
+	}
+	for _, user := range mentioned {
+		if notified[user.ID] {
+			continue
+		}
+		notified[user.ID] = true
+		if err := ns.notify(&models.Notification{
+			UserID:   user.ID,
+			Kind:     models.NotificationMention,
+			GroupKey: fmt.Sprintf("mention:%d", post.ID),
+			ActorID:  post.UserID,
+			PostID:   &post.ID,
+		}, &post); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openGroup creates the unread notification of a group, or updates the
+// existing one with the latest actor, and returns its ID.
+const openGroup = `
+	INSERT INTO notifications (created_at, updated_at, user_id, kind, group_key, actor_id, actor_count, post_id, emoji)
+	VALUES (NOW(), NOW(), ?, ?, ?, ?, 0, ?, ?)
+	ON CONFLICT (user_id, group_key) WHERE read_at IS NULL
+	DO UPDATE SET updated_at = NOW(), actor_id = EXCLUDED.actor_id
+	RETURNING id`
+
+// notify adds the notification to its group, unless the recipient would
+// not want it: users aren't notified of their own actions, of actions by
+// users they blocked, were blocked by or muted, or about posts they can't
+// see.
+func (ns *NotificationService) notify(notification *models.Notification, post *models.Post) error {
+	if notification.UserID == notification.ActorID {
+		return nil
+	}
+
+	rel, err := ns.Visibility.Relationship(notification.UserID, notification.ActorID)
+	if err != nil || rel.Blocked {
+		return err
+	}
+	var mutes int
+	if err := ns.Database.Conn.Model(&models.Mute{}).
+		Where("user_id = ? AND muted_id = ?", notification.UserID, notification.ActorID).
+		Count(&mutes).Error; err != nil {
+		return err
+	}
+	if mutes > 0 {
+		return nil
+	}
+
+	if post != nil {
+		visible, err := ns.Visibility.CanView(notification.UserID, post)
+		if err != nil || !visible {
+			return err
+		}
+	}
+
+	var id uint32
+	added := false
+	err = ns.Database.Conn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Raw(openGroup,
+			notification.UserID, notification.Kind, notification.GroupKey,
+			notification.ActorID, notification.PostID, notification.Emoji,
+		).Row().Scan(&id); err != nil {
+			return err
+		}
+
+		// Users acting more than once, like liking a post again after
+		// unliking it, are only counted once
+		result := tx.Exec(`
+			INSERT INTO notification_actors (notification_id, actor_id, created_at) VALUES (?, ?, NOW())
+			ON CONFLICT DO NOTHING`, id, notification.ActorID)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		added = true
+		return tx.Model(&models.Notification{}).
+			Where("id = ?", id).
+			UpdateColumn("actor_count", gorm.Expr("actor_count + 1")).Error
+	})
+	if err == nil && added {
+		ns.Events.Publish(events.Event{
+			Type:           events.NotificationCreated,
+			ActorID:        notification.ActorID,
+			UserID:         notification.UserID,
+			NotificationID: id,
+		})
+	}
+	return err
+}
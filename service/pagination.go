@@ -0,0 +1,216 @@
+package service
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"time"
+
+	"github.com/bwoff11/frens/models"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/jsonapi"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	defaultPageSize = 10
+	maxPageSize     = 100
+)
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// Page is the part of a list requested by a client. Cursor is an opaque
+// position taken from the links of a previously returned page.
+type Page struct {
+	Size   int
+	Cursor string
+}
+
+func (p Page) size() int {
+	if p.Size <= 0 {
+		return defaultPageSize
+	}
+	if p.Size > maxPageSize {
+		return maxPageSize
+	}
+	return p.Size
+}
+
+// pageCursor is a position in a list ordered newest first by a timestamp
+// and an ID. The ID breaks ties between items with the same timestamp, so no
+// item is skipped or repeated between pages.
+type pageCursor struct {
+	Time     time.Time `json:"t"`
+	ID       uint32    `json:"id"`
+	Backward bool      `json:"b,omitempty"`
+}
+
+// parsePageCursor decodes the cursor of a page. It returns nil when the
+// first page is requested.
+func parsePageCursor(page Page) (*pageCursor, error) {
+	if page.Cursor == "" {
+		return nil, nil
+	}
+
+	position := &pageCursor{}
+	if err := decodeCursor(page.Cursor, position); err != nil {
+		return nil, errInvalidCursor
+	}
+	return position, nil
+}
+
+// pageCursors returns the cursors of the pages around a non-empty page
+// fetched from position. more reports whether further items were found in
+// the paging direction, and first and last are the keys of the first and
+// last item of the page. The cursors are empty if there is no such page.
+func pageCursors(position *pageCursor, more bool, first, last pageCursor) (next, prev string, err error) {
+	// There is a next page if we could go further forward, or if we came
+	// backwards from it. The same goes the other way for the previous page.
+	hasNext := more
+	hasPrev := position != nil
+	if position != nil && position.Backward {
+		hasNext, hasPrev = true, more
+	}
+
+	if hasNext {
+		if next, err = encodeCursor(&pageCursor{Time: last.Time, ID: last.ID}); err != nil {
+			return "", "", err
+		}
+	}
+	if hasPrev {
+		if prev, err = encodeCursor(&pageCursor{Time: first.Time, ID: first.ID, Backward: true}); err != nil {
+			return "", "", err
+		}
+	}
+	return next, prev, nil
+}
+
+// paginate fetches the page of query described by page. The list is ordered
+// newest first by timeColumn and idColumn, and key returns those values for
+// an item. The returned cursors are empty if there is no next or previous
+// page.
+func paginate[T any](query *gorm.DB, page Page, timeColumn, idColumn string, key func(T) (time.Time, uint32)) (items []T, next, prev string, err error) {
+	position, err := parsePageCursor(page)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	keys := "(" + timeColumn + ", " + idColumn + ")"
+	switch {
+	case position == nil:
+		query = query.Order(timeColumn + " DESC, " + idColumn + " DESC")
+	case position.Backward:
+		query = query.Where(keys+" > (?, ?)", position.Time, position.ID).
+			Order(timeColumn + " ASC, " + idColumn + " ASC")
+	default:
+		query = query.Where(keys+" < (?, ?)", position.Time, position.ID).
+			Order(timeColumn + " DESC, " + idColumn + " DESC")
+	}
+
+	// Fetch one extra item to know if there is more in the paging direction
+	size := page.size()
+	if err := query.Limit(size + 1).Find(&items).Error; err != nil {
+		return nil, "", "", err
+	}
+	more := len(items) > size
+	if more {
+		items = items[:size]
+	}
+
+	if position != nil && position.Backward {
+		for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+			items[i], items[j] = items[j], items[i]
+		}
+	}
+	if len(items) == 0 {
+		return items, "", "", nil
+	}
+
+	var first, last pageCursor
+	first.Time, first.ID = key(items[0])
+	last.Time, last.ID = key(items[len(items)-1])
+	next, prev, err = pageCursors(position, more, first, last)
+	if err != nil {
+		return nil, "", "", err
+	}
+	return items, next, prev, nil
+}
+
+// writePage renders a page of a list as JSON API. The next and previous
+// cursors are exposed both as links and in the document meta.
+func writePage(c *fiber.Ctx, models interface{}, next, prev string) error {
+	return writePageMeta(c, models, next, prev, nil)
+}
+
+// writePageMeta is writePage with additional document meta.
+func writePageMeta(c *fiber.Ctx, models interface{}, next, prev string, extra jsonapi.Meta) error {
+	payload, err := jsonapi.Marshal(models)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to marshal the page",
+		})
+	}
+	many := payload.(*jsonapi.ManyPayload)
+
+	links := jsonapi.Links{"self": c.OriginalURL()}
+	meta := jsonapi.Meta{"count": len(many.Data)}
+	for key, value := range extra {
+		meta[key] = value
+	}
+	if next != "" {
+		links["next"] = pageLink(c, next)
+		meta["nextCursor"] = next
+	}
+	if prev != "" {
+		links["prev"] = pageLink(c, prev)
+		meta["prevCursor"] = prev
+	}
+	many.Links = &links
+	many.Meta = &meta
+
+	c.Response().Header.Set(fiber.HeaderContentType, jsonapi.MediaType)
+	return json.NewEncoder(c.Response().BodyWriter()).Encode(payload)
+}
+
+// writePostPage renders a page of posts, preparing them for the viewer.
+func writePostPage(c *fiber.Ctx, views *PostViews, posts []*models.Post, next, prev string) error {
+	if err := views.Prepare(c, posts...); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to prepare the posts",
+		})
+	}
+
+	return writePage(c, posts, next, prev)
+}
+
+// pageLink returns the URL of the current request pointed at another cursor.
+func pageLink(c *fiber.Ctx, cursor string) string {
+	link, err := url.Parse(c.OriginalURL())
+	if err != nil {
+		return ""
+	}
+	query := link.Query()
+	query.Set("cursor", cursor)
+	link.RawQuery = query.Encode()
+	return link.String()
+}
+
+// encodeCursor turns a pagination position into an opaque string clients
+// can hand back without depending on its contents.
+func encodeCursor(position interface{}) (string, error) {
+	raw, err := json.Marshal(position)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// decodeCursor reverses encodeCursor.
+func decodeCursor(cursor string, position interface{}) error {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, position)
+}
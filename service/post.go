@@ -1,17 +1,49 @@
 package service
 
 import (
+	"errors"
+	"fmt"
 	"log"
 
 	"github.com/bwoff11/frens/models"
+	"github.com/bwoff11/frens/pkg/config"
 	"github.com/bwoff11/frens/pkg/database"
+	"github.com/bwoff11/frens/pkg/events"
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/jsonapi"
+	"github.com/jinzhu/gorm"
 )
 
-type PostService struct{ Database *database.Database }
+type PostService struct {
+	Database   *database.Database
+	Visibility *VisibilityPolicy
+	Timelines  *TimelineService
+	Media      *config.MediaConfig
+	Views      *PostViews
+	Events     events.Bus
+}
+
+var (
+	// errInvalidMedia is returned when a post is created with media that
+	// does not exist, belongs to someone else or is already attached.
+	errInvalidMedia = errors.New("invalid media")
 
-func (ps *PostService) Create(c *fiber.Ctx, text string, privacy string) error {
+	// errMissingAltText is returned when alt text is required and a post is
+	// created with media that has no description.
+	errMissingAltText = errors.New("media is missing alt text")
+)
+
+// NewPost holds the user supplied fields of a post being created.
+type NewPost struct {
+	Text           string
+	Privacy        string
+	ContentWarning string
+	ReplyToID      uint32
+	RepostOfID     uint32
+	MediaIDs       []uint32
+}
+
+func (ps *PostService) Create(c *fiber.Ctx, draft NewPost) error {
 	// Get the ID of the user making the request
 	userID, err := getRequestorID(c)
 	if err != nil {
@@ -29,22 +61,110 @@ func (ps *PostService) Create(c *fiber.Ctx, text string, privacy string) error {
 		})
 	}
 
+	// Posts need text unless they have media or repost another post. The
+	// request validation lets an empty list of media through.
+	if draft.Text == "" && len(draft.MediaIDs) == 0 && draft.RepostOfID == 0 {
+		return c.Status(fiber.StatusBadRequest).SendString("A post needs text or media")
+	}
+
+	// Posts without an explicit privacy level are public
+	if draft.Privacy == "" {
+		draft.Privacy = models.PrivacyPublic
+	}
+
 	// Assign the User to the newPost before saving it to the database
 	newPost := models.Post{
-		UserID:  userID,
-		Text:    text,
-		Privacy: privacy,
-		User:    &user,
+		UserID:         userID,
+		Text:           draft.Text,
+		Privacy:        draft.Privacy,
+		ContentWarning: draft.ContentWarning,
+		User:           &user,
+	}
+
+	// Replies can only be made to posts the user is allowed to see
+	if draft.ReplyToID != 0 {
+		parent, err := ps.findVisible(userID, draft.ReplyToID)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to get the post being replied to",
+			})
+		}
+		if parent == nil {
+			return c.Status(fiber.StatusNotFound).SendString("Post not found")
+		}
+		newPost.ReplyToID = &parent.ID
+	}
+
+	// Only public posts (or the user's own posts) can be reposted, otherwise
+	// a repost would leak the original to a wider audience
+	if draft.RepostOfID != 0 {
+		original, err := ps.findVisible(userID, draft.RepostOfID)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to get the post being reposted",
+			})
+		}
+		if original == nil {
+			return c.Status(fiber.StatusNotFound).SendString("Post not found")
+		}
+		if original.Privacy != models.PrivacyPublic && original.UserID != userID {
+			return c.Status(fiber.StatusForbidden).SendString("Only public posts can be reposted")
+		}
+		newPost.RepostOfID = &original.ID
 	}
 
-	// Save the post to the database
-	if err := ps.Database.Conn.Create(&newPost).Error; err != nil {
+	if len(draft.MediaIDs) > ps.Media.MaxPerPost {
+		return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("A post can have at most %d media", ps.Media.MaxPerPost))
+	}
+
+	// Save the post and attach its media in one transaction so a post is
+	// never left with only part of its media
+	err = ps.Database.Conn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&newPost).Error; err != nil {
+			return err
+		}
+		if newPost.ReplyToID != nil {
+			if err := adjustCount(tx, *newPost.ReplyToID, replyCount, 1); err != nil {
+				return err
+			}
+		}
+		if newPost.RepostOfID != nil {
+			if err := adjustCount(tx, *newPost.RepostOfID, repostCount, 1); err != nil {
+				return err
+			}
+		}
+		return attachMedia(tx, userID, newPost.ID, draft.MediaIDs, ps.Media.RequireAltText)
+	})
+	if err == errInvalidMedia {
+		return c.Status(fiber.StatusBadRequest).SendString("Media not found or already attached")
+	}
+	if err == errMissingAltText {
+		return c.Status(fiber.StatusBadRequest).SendString("All media must have a description")
+	}
+	if err != nil {
 		// Log and handle error here
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to create a post",
 		})
 	}
 
+	// Load the attached media for the response
+	if err := ps.Database.Conn.Where("post_id = ?", newPost.ID).Order("id").Find(&newPost.Media).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get the post's media",
+		})
+	}
+
+	// Deliver the post to the followers' timelines in the background
+	ps.Timelines.FanOut(&newPost)
+	ps.Events.Publish(events.Event{Type: events.PostCreated, ActorID: userID, PostID: newPost.ID})
+
+	if err := ps.Views.Prepare(c, &newPost); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to prepare the posts",
+		})
+	}
+
 	// Set the content type to application/vnd.api+json
 	c.Response().Header.Set(fiber.HeaderContentType, jsonapi.MediaType)
 
@@ -61,3 +181,131 @@ func (ps *PostService) Create(c *fiber.Ctx, text string, privacy string) error {
 
 	return nil
 }
+
+// Delete removes a post of the user making the request along with its likes,
+// reactions, bookmarks and notifications. Replies and reposts of it are kept.
+// Its media is left to the media garbage collector.
+func (ps *PostService) Delete(c *fiber.Ctx, postID uint32) error {
+	// Get the ID of the user making the request
+	userID, err := getRequestorID(c)
+	if err != nil {
+		// Log and handle error here
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to get user ID")
+	}
+
+	post, err := ps.findVisible(userID, postID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get the post",
+		})
+	}
+	if post == nil {
+		return c.Status(fiber.StatusNotFound).SendString("Post not found")
+	}
+	if post.UserID != userID {
+		return c.Status(fiber.StatusForbidden).SendString("Only the author can delete a post")
+	}
+
+	deleted := false
+	err = ps.Database.Conn.Transaction(func(tx *gorm.DB) error {
+		// Lock the post so it's only deleted and uncounted once
+		if err := tx.Set("gorm:query_option", "FOR UPDATE").First(post, postID).Error; err != nil {
+			if gorm.IsRecordNotFoundError(err) {
+				return nil
+			}
+			return err
+		}
+
+		for _, model := range []interface{}{&models.Like{}, &models.Reaction{}, &models.Bookmark{}} {
+			if err := tx.Where("post_id = ?", postID).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Exec("DELETE FROM notification_actors WHERE notification_id IN (SELECT id FROM notifications WHERE post_id = ?)", postID).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("post_id = ?", postID).Delete(&models.Notification{}).Error; err != nil {
+			return err
+		}
+
+		if post.ReplyToID != nil {
+			if err := adjustCount(tx, *post.ReplyToID, replyCount, -1); err != nil {
+				return err
+			}
+		}
+		if post.RepostOfID != nil {
+			if err := adjustCount(tx, *post.RepostOfID, repostCount, -1); err != nil {
+				return err
+			}
+		}
+		deleted = true
+		return tx.Delete(post).Error
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete the post",
+		})
+	}
+
+	// Timelines skip entries whose post no longer exists, so only clients
+	// showing the post need to be told
+	if deleted {
+		ps.Events.Publish(events.Event{Type: events.PostDeleted, ActorID: userID, PostID: postID, Privacy: post.Privacy})
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// findVisible returns the post if it exists and the viewer may see it, or nil
+// otherwise.
+func (ps *PostService) findVisible(viewerID, postID uint32) (*models.Post, error) {
+	var post models.Post
+	if err := ps.Database.Conn.First(&post, postID).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	visible, err := ps.Visibility.CanView(viewerID, &post)
+	if err != nil || !visible {
+		return nil, err
+	}
+	return &post, nil
+}
+
+// attachMedia attaches the user's unattached media to the post. If
+// requireAltText is set, all of the media must have a description.
+func attachMedia(tx *gorm.DB, userID, postID uint32, mediaIDs []uint32, requireAltText bool) error {
+	if len(mediaIDs) == 0 {
+		return nil
+	}
+
+	query := tx.Model(&models.Media{}).
+		Where("id IN (?) AND user_id = ? AND post_id IS NULL", mediaIDs, userID).
+		Where("id NOT IN (SELECT media_id FROM custom_emojis)")
+	if requireAltText {
+		var undescribed int
+		if err := tx.Model(&models.Media{}).
+			Where("id IN (?) AND TRIM(description) = ''", mediaIDs).
+			Count(&undescribed).Error; err != nil {
+			return err
+		}
+		if undescribed > 0 {
+			return errMissingAltText
+		}
+
+		// The description may be cleared in the meantime
+		query = query.Where("TRIM(description) <> ''")
+	}
+
+	result := query.Update("post_id", postID)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected != int64(len(mediaIDs)) {
+		return errInvalidMedia
+	}
+	return nil
+}
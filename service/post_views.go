@@ -0,0 +1,141 @@
+package service
+
+import (
+	"context"
+
+	"github.com/bwoff11/frens/models"
+	"github.com/bwoff11/frens/pkg/database"
+	"github.com/gofiber/fiber/v2"
+)
+
+// PostViews prepares posts for the user they are shown to. Every response
+// containing posts should go through it, so all of them carry the same
+// viewer dependent fields.
+type PostViews struct {
+	Database *database.Database
+	URLs     *MediaURLs
+}
+
+// Prepare signs the media URLs of the posts and fills in their reactions and
+// viewer state for the user making the request, who may be anonymous. Nil
+// posts are skipped.
+func (pv *PostViews) Prepare(c *fiber.Ctx, posts ...*models.Post) error {
+	viewerID, err := getOptionalRequestorID(c)
+	if err != nil {
+		return err
+	}
+	return pv.PrepareFor(c.UserContext(), viewerID, posts...)
+}
+
+// PrepareFor is Prepare outside of a request, for the given viewer.
+func (pv *PostViews) PrepareFor(ctx context.Context, viewerID uint32, posts ...*models.Post) error {
+	// Media of posts that aren't public is only reachable through signed URLs
+	if err := pv.URLs.SignPosts(ctx, posts...); err != nil {
+		return err
+	}
+
+	if err := pv.loadReactions(viewerID, posts); err != nil {
+		return err
+	}
+	return pv.loadViewerState(viewerID, posts)
+}
+
+// reactionCounts counts the reactions to the posts, including their likes.
+// Likes are stored separately and can't be added as a reaction, so the two
+// never overlap.
+const reactionCounts = `
+	SELECT post_id, emoji, COUNT(*) AS count, BOOL_OR(user_id = ?) AS reacted
+	FROM reactions WHERE post_id IN (?) GROUP BY post_id, emoji
+	UNION ALL
+	SELECT post_id, ? AS emoji, COUNT(*) AS count, BOOL_OR(user_id = ?) AS reacted
+	FROM likes WHERE post_id IN (?) GROUP BY post_id
+	ORDER BY count DESC, emoji`
+
+// loadReactions fills in the reaction counts of the posts with one query.
+func (pv *PostViews) loadReactions(viewerID uint32, posts []*models.Post) error {
+	byID, postIDs := groupPosts(posts)
+	for _, post := range posts {
+		if post != nil {
+			post.Reactions = []models.ReactionCount{}
+		}
+	}
+	if len(postIDs) == 0 {
+		return nil
+	}
+
+	rows, err := pv.Database.Conn.Raw(reactionCounts, viewerID, postIDs, models.LikeEmoji, viewerID, postIDs).Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var postID uint32
+		var count models.ReactionCount
+		if err := rows.Scan(&postID, &count.Emoji, &count.Count, &count.Reacted); err != nil {
+			return err
+		}
+		for _, post := range byID[postID] {
+			post.Reactions = append(post.Reactions, count)
+		}
+	}
+	return rows.Err()
+}
+
+// viewerState finds which of the posts the viewer liked, bookmarked or
+// reposted.
+const viewerState = `
+	SELECT posts.id,
+		EXISTS (SELECT 1 FROM likes WHERE likes.post_id = posts.id AND likes.user_id = ?),
+		EXISTS (SELECT 1 FROM bookmarks WHERE bookmarks.post_id = posts.id AND bookmarks.user_id = ?),
+		EXISTS (SELECT 1 FROM posts reposts WHERE reposts.repost_of_id = posts.id AND reposts.user_id = ?)
+	FROM posts WHERE posts.id IN (?)`
+
+// loadViewerState fills in the viewer state of the posts with one query.
+// Anonymous viewers haven't interacted with any post.
+func (pv *PostViews) loadViewerState(viewerID uint32, posts []*models.Post) error {
+	byID, postIDs := groupPosts(posts)
+	for _, post := range posts {
+		if post != nil {
+			post.Viewer = models.PostViewerState{}
+		}
+	}
+	if viewerID == 0 || len(postIDs) == 0 {
+		return nil
+	}
+
+	rows, err := pv.Database.Conn.Raw(viewerState, viewerID, viewerID, viewerID, postIDs).Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var postID uint32
+		var state models.PostViewerState
+		if err := rows.Scan(&postID, &state.Liked, &state.Bookmarked, &state.Reposted); err != nil {
+			return err
+		}
+		for _, post := range byID[postID] {
+			post.Viewer = state
+		}
+	}
+	return rows.Err()
+}
+
+// groupPosts indexes the posts by ID, since a post can appear more than once
+// in a response, and returns their distinct IDs. Nil posts are skipped.
+func groupPosts(posts []*models.Post) (map[uint32][]*models.Post, []uint32) {
+	byID := make(map[uint32][]*models.Post, len(posts))
+	postIDs := make([]uint32, 0, len(posts))
+	for _, post := range posts {
+		if post == nil {
+			continue
+		}
+		if _, ok := byID[post.ID]; !ok {
+			postIDs = append(postIDs, post.ID)
+		}
+		byID[post.ID] = append(byID[post.ID], post)
+	}
+	return byID, postIDs
+}
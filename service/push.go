@@ -0,0 +1,404 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/bwoff11/frens/models"
+	"github.com/bwoff11/frens/pkg/config"
+	"github.com/bwoff11/frens/pkg/database"
+	"github.com/bwoff11/frens/pkg/events"
+	"github.com/bwoff11/frens/pkg/webpush"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/jsonapi"
+	"github.com/jinzhu/gorm"
+)
+
+// PushService manages the Web Push subscriptions of login sessions and
+// pushes new notifications to them in the background.
+type PushService struct {
+	Database *database.Database
+	Events   events.Bus
+	Client   *webpush.Client
+	Config   *config.PushConfig
+
+	jobs chan pushJob
+}
+
+// pushJob is a message to deliver to a subscription. Attempts counts the
+// deliveries that failed so far.
+type pushJob struct {
+	subscriptionID uint32
+	payload        []byte
+	attempts       int
+}
+
+// PushServerKey is the VAPID public key user agents subscribe with.
+type PushServerKey struct {
+	ID string `jsonapi:"primary,push-server-key"`
+}
+
+// PushAlertChanges turns alerts of a subscription on or off. Nil fields are
+// left as they are.
+type PushAlertChanges struct {
+	Like     *bool
+	Reaction *bool
+	Follow   *bool
+	Mention  *bool
+	Reply    *bool
+	Repost   *bool
+}
+
+func (pc PushAlertChanges) apply(alerts *models.PushAlerts) {
+	for _, change := range []struct {
+		value *bool
+		alert *bool
+	}{
+		{pc.Like, &alerts.Like},
+		{pc.Reaction, &alerts.Reaction},
+		{pc.Follow, &alerts.Follow},
+		{pc.Mention, &alerts.Mention},
+		{pc.Reply, &alerts.Reply},
+		{pc.Repost, &alerts.Repost},
+	} {
+		if change.value != nil {
+			*change.alert = *change.value
+		}
+	}
+}
+
+// pushPayload is what is pushed for a notification. It has enough to show
+// the notification without fetching it.
+type pushPayload struct {
+	NotificationID uint32  `json:"notificationID"`
+	Kind           string  `json:"kind"`
+	Title          string  `json:"title"`
+	Body           string  `json:"body,omitempty"`
+	ActorID        uint32  `json:"actorID"`
+	PostID         *uint32 `json:"postID,omitempty"`
+}
+
+// maxPushBodyLength is how much of a post's text is pushed, in characters.
+const maxPushBodyLength = 200
+
+func NewPushService(db *database.Database, bus events.Bus, config *config.PushConfig) (*PushService, error) {
+	// Endpoints come from user agents, so they may not point into the
+	// server's network. A base URL is chosen by the operator and may.
+	dialer := &net.Dialer{Timeout: config.Timeout}
+	if config.EndpointBaseURL == "" {
+		dialer.Control = refusePrivateAddresses
+	}
+	// Proxies would connect on the push's behalf, past the check
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	client, err := webpush.NewClient(config.VAPIDPrivateKey, config.Subject, config.EndpointBaseURL, &http.Client{
+		Transport: transport,
+		Timeout:   config.Timeout,
+		// Redirects count as failures instead of being followed
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &PushService{
+		Database: db,
+		Events:   bus,
+		Client:   client,
+		Config:   config,
+		jobs:     make(chan pushJob, config.QueueSize),
+	}, nil
+}
+
+// ServerKey returns the VAPID public key, which user agents need to
+// subscribe.
+func (ps *PushService) ServerKey(c *fiber.Ctx) error {
+	// Set the content type to application/vnd.api+json
+	c.Response().Header.Set(fiber.HeaderContentType, jsonapi.MediaType)
+
+	return jsonapi.MarshalPayload(c.Response().BodyWriter(), &PushServerKey{ID: ps.Client.PublicKey()})
+}
+
+// Get returns the push subscription of the session making the request.
+func (ps *PushService) Get(c *fiber.Ctx) error {
+	// Get the session of the user making the request
+	sessionID, err := getSessionID(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).SendString("Log in again to use push notifications")
+	}
+
+	var subscription models.PushSubscription
+	if err := ps.Database.Conn.Where("session_id = ?", sessionID).First(&subscription).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return c.Status(fiber.StatusNotFound).SendString("Push subscription not found")
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get the push subscription",
+		})
+	}
+
+	return ps.writeSubscription(c, fiber.StatusOK, &subscription)
+}
+
+// Subscribe sets the push subscription of the session making the request,
+// replacing the one it had. New subscriptions receive every kind of
+// notification unless the changes turn some off; replaced ones keep their
+// alerts.
+func (ps *PushService) Subscribe(c *fiber.Ctx, target webpush.Subscription, changes PushAlertChanges) error {
+	// Get the ID of the user making the request
+	userID, err := getRequestorID(c)
+	if err != nil {
+		// Log and handle error here
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to get user ID")
+	}
+	sessionID, err := getSessionID(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).SendString("Log in again to use push notifications")
+	}
+
+	if err := target.Validate(); err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid push subscription keys")
+	}
+
+	var subscription models.PushSubscription
+	created := false
+	err = ps.Database.Conn.Transaction(func(tx *gorm.DB) error {
+		err := tx.Set("gorm:query_option", "FOR UPDATE").Where("session_id = ?", sessionID).First(&subscription).Error
+		if err != nil && !gorm.IsRecordNotFoundError(err) {
+			return err
+		}
+		if err != nil {
+			created = true
+			subscription = models.PushSubscription{SessionID: sessionID, Alerts: models.AllPushAlerts}
+		}
+
+		subscription.UserID = userID
+		subscription.Endpoint = target.Endpoint
+		subscription.P256dh = target.P256dh
+		subscription.Auth = target.Auth
+		changes.apply(&subscription.Alerts)
+		return database.MapError(tx.Save(&subscription).Error)
+	})
+	if errors.Is(err, database.ErrUniqueViolation) {
+		return c.Status(fiber.StatusConflict).SendString("The push subscription was changed by another request")
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to save the push subscription",
+		})
+	}
+
+	status := fiber.StatusOK
+	if created {
+		status = fiber.StatusCreated
+	}
+	return ps.writeSubscription(c, status, &subscription)
+}
+
+// UpdateAlerts changes which kinds of notifications the session making the
+// request is pushed.
+func (ps *PushService) UpdateAlerts(c *fiber.Ctx, changes PushAlertChanges) error {
+	// Get the session of the user making the request
+	sessionID, err := getSessionID(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).SendString("Log in again to use push notifications")
+	}
+
+	var subscription models.PushSubscription
+	err = ps.Database.Conn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Set("gorm:query_option", "FOR UPDATE").Where("session_id = ?", sessionID).First(&subscription).Error; err != nil {
+			return err
+		}
+		changes.apply(&subscription.Alerts)
+		return tx.Save(&subscription).Error
+	})
+	if gorm.IsRecordNotFoundError(err) {
+		return c.Status(fiber.StatusNotFound).SendString("Push subscription not found")
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update the push subscription",
+		})
+	}
+
+	return ps.writeSubscription(c, fiber.StatusOK, &subscription)
+}
+
+// Unsubscribe removes the push subscription of the session making the
+// request, if it has one.
+func (ps *PushService) Unsubscribe(c *fiber.Ctx) error {
+	// Get the session of the user making the request
+	sessionID, err := getSessionID(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).SendString("Log in again to use push notifications")
+	}
+
+	if err := ps.Database.Conn.Where("session_id = ?", sessionID).Delete(&models.PushSubscription{}).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete the push subscription",
+		})
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (ps *PushService) writeSubscription(c *fiber.Ctx, status int, subscription *models.PushSubscription) error {
+	subscription.ServerKey = ps.Client.PublicKey()
+
+	// Set the content type to application/vnd.api+json
+	c.Response().Header.Set(fiber.HeaderContentType, jsonapi.MediaType)
+	c.Status(status)
+
+	// Marshal the subscription into JSON API format
+	if err := jsonapi.MarshalPayload(c.Response().BodyWriter(), subscription); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to marshal the push subscription",
+		})
+	}
+	return nil
+}
+
+// start launches the workers and subscribes to new notifications.
+func (ps *PushService) start() {
+	for i := 0; i < ps.Config.Workers; i++ {
+		go ps.work()
+	}
+	ps.Events.Subscribe("push", ps.handle, events.NotificationCreated)
+}
+
+// handle queues a new notification for the subscriptions of its user that
+// want its kind. Grouped notifications are only pushed for their first
+// actor, so a popular post doesn't push every like until the group is read.
+func (ps *PushService) handle(event events.Event) {
+	var notification models.Notification
+	if err := ps.Database.Conn.Preload("Actor").Preload("Post").First(&notification, event.NotificationID).Error; err != nil {
+		if !gorm.IsRecordNotFoundError(err) {
+			log.Println("Failed to get the notification to push:", err)
+		}
+		return
+	}
+	if notification.ActorCount > 1 {
+		return
+	}
+
+	var subscriptions []models.PushSubscription
+	if err := ps.Database.Conn.Where("user_id = ?", notification.UserID).Find(&subscriptions).Error; err != nil {
+		log.Println("Failed to get the push subscriptions:", err)
+		return
+	}
+
+	var payload []byte
+	for _, subscription := range subscriptions {
+		if !subscription.Alerts.Enabled(notification.Kind) {
+			continue
+		}
+		if payload == nil {
+			var err error
+			if payload, err = json.Marshal(newPushPayload(&notification)); err != nil {
+				log.Println("Failed to marshal the push payload:", err)
+				return
+			}
+		}
+		// This runs on the event bus, so it mustn't wait for the workers
+		select {
+		case ps.jobs <- pushJob{subscriptionID: subscription.ID, payload: payload}:
+		default:
+			log.Printf("Push queue is full, dropped notification %d for subscription %d", notification.ID, subscription.ID)
+		}
+	}
+}
+
+func newPushPayload(notification *models.Notification) pushPayload {
+	payload := pushPayload{
+		NotificationID: notification.ID,
+		Kind:           notification.Kind,
+		Title:          describeNotification(notification),
+		ActorID:        notification.ActorID,
+		PostID:         notification.PostID,
+	}
+	if notification.Post != nil {
+		payload.Body = truncate(notification.Post.Text, maxPushBodyLength)
+	}
+	return payload
+}
+
+func (ps *PushService) work() {
+	for job := range ps.jobs {
+		retryIn, err := ps.deliver(job)
+		if err == nil {
+			continue
+		}
+		if retryIn == 0 {
+			log.Println("Failed to push a notification:", err)
+			continue
+		}
+
+		log.Printf("Failed to push a notification, retrying in %s: %v", retryIn, err)
+		job.attempts++
+		time.AfterFunc(retryIn, func() { ps.retry(job) })
+	}
+}
+
+// retry queues a job again, dropping it if the queue is full so the timers
+// don't pile up behind the workers.
+func (ps *PushService) retry(job pushJob) {
+	select {
+	case ps.jobs <- job:
+	default:
+		log.Printf("Push queue is full, dropped a retry for subscription %d", job.subscriptionID)
+	}
+}
+
+// deliver sends the job's message. If it fails and may succeed later, it
+// returns how long to wait before trying again. Subscriptions the push
+// service no longer knows are removed.
+func (ps *PushService) deliver(job pushJob) (time.Duration, error) {
+	var subscription models.PushSubscription
+	if err := ps.Database.Conn.First(&subscription, job.subscriptionID).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ps.Config.Timeout)
+	defer cancel()
+	err := ps.Client.Send(ctx, webpush.Subscription{
+		Endpoint: subscription.Endpoint,
+		P256dh:   subscription.P256dh,
+		Auth:     subscription.Auth,
+	}, webpush.Message{Payload: job.payload, TTL: ps.Config.TTL})
+	if err == nil {
+		return 0, nil
+	}
+
+	// The subscription expired or the user agent unsubscribed. It's only
+	// removed if it wasn't replaced in the meantime.
+	if err == webpush.ErrGone {
+		return 0, ps.Database.Conn.
+			Where("id = ? AND endpoint = ?", subscription.ID, subscription.Endpoint).
+			Delete(&models.PushSubscription{}).Error
+	}
+
+	var statusErr *webpush.StatusError
+	if errors.As(err, &statusErr) && !statusErr.Temporary() {
+		return 0, err
+	}
+	if job.attempts+1 >= ps.Config.MaxAttempts {
+		return 0, err
+	}
+	retryIn := ps.Config.RetryBackoff << job.attempts
+	if statusErr != nil && statusErr.RetryAfter > retryIn {
+		retryIn = statusErr.RetryAfter
+	}
+	return retryIn, err
+}
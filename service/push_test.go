@@ -0,0 +1,197 @@
+package service
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bwoff11/frens/models"
+	"github.com/bwoff11/frens/pkg/config"
+	"github.com/bwoff11/frens/pkg/database"
+	"github.com/bwoff11/frens/pkg/events"
+	"github.com/bwoff11/frens/pkg/webpush"
+)
+
+// fakePushService records the messages pushed to it and answers with
+// status.
+type fakePushService struct {
+	mu       sync.Mutex
+	status   int
+	requests []*http.Request
+}
+
+func (f *fakePushService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r)
+	w.WriteHeader(f.status)
+}
+
+// newTestPush creates the push service, sending to baseURL if it's set. The
+// queue holds queueSize jobs and no workers run.
+func newTestPush(t *testing.T, db *database.Database, baseURL string, queueSize int) *PushService {
+	t.Helper()
+
+	ps, err := NewPushService(db, events.NewLocal(1), &config.PushConfig{
+		VAPIDPrivateKey: "fi971FSfYkw79HJGqmW8Szq1__YP7vhj4rcJKgBkks8",
+		Subject:         "mailto:admin@localhost",
+		EndpointBaseURL: baseURL,
+		TTL:             time.Hour,
+		Timeout:         5 * time.Second,
+		Workers:         1,
+		QueueSize:       queueSize,
+		MaxAttempts:     3,
+		RetryBackoff:    time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ps
+}
+
+// testPushSubscription returns a subscription to endpoint with fresh user
+// agent keys.
+func testPushSubscription(t *testing.T, endpoint string) webpush.Subscription {
+	t.Helper()
+
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := make([]byte, 16)
+	if _, err := rand.Read(auth); err != nil {
+		t.Fatal(err)
+	}
+	return webpush.Subscription{
+		Endpoint: endpoint,
+		P256dh:   base64.RawURLEncoding.EncodeToString(key.PublicKey().Bytes()),
+		Auth:     base64.RawURLEncoding.EncodeToString(auth),
+	}
+}
+
+func TestPushRefusesPrivateEndpoints(t *testing.T) {
+	fake := &fakePushService{status: http.StatusCreated}
+	server := httptest.NewTLSServer(fake)
+	defer server.Close()
+
+	ps := newTestPush(t, nil, "", 1)
+	sub := testPushSubscription(t, server.URL+"/send/abc")
+	err := ps.Client.Send(context.Background(), sub, webpush.Message{Payload: []byte("{}"), TTL: time.Minute})
+	if !errors.Is(err, errPrivateAddress) {
+		t.Fatalf("got %v, want %v", err, errPrivateAddress)
+	}
+	if len(fake.requests) != 0 {
+		t.Fatalf("the push service got %d requests", len(fake.requests))
+	}
+}
+
+func TestPushDelivers(t *testing.T) {
+	db := openTestDatabase(t)
+	fake := &fakePushService{status: http.StatusCreated}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	ps := newTestPush(t, db, server.URL, 1)
+
+	user := createTestUser(t, db, "pushed")
+	actor := createTestUser(t, db, "follower")
+	sub := testPushSubscription(t, "https://push.example.com/send/abc")
+	subscription := &models.PushSubscription{
+		UserID:    user.ID,
+		SessionID: "session",
+		Endpoint:  sub.Endpoint,
+		P256dh:    sub.P256dh,
+		Auth:      sub.Auth,
+		Alerts:    models.AllPushAlerts,
+	}
+	if err := db.Conn.Create(subscription).Error; err != nil {
+		t.Fatal(err)
+	}
+	notification := &models.Notification{UserID: user.ID, Kind: models.NotificationFollow, GroupKey: "follow", ActorID: actor.ID}
+	if err := db.Conn.Create(notification).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	ps.handle(events.Event{Type: events.NotificationCreated, UserID: user.ID, NotificationID: notification.ID})
+	var job pushJob
+	select {
+	case job = <-ps.jobs:
+	default:
+		t.Fatal("no push was queued")
+	}
+	if retryIn, err := ps.deliver(job); err != nil || retryIn != 0 {
+		t.Fatalf("got %s, %v, want 0, nil", retryIn, err)
+	}
+
+	if len(fake.requests) != 1 {
+		t.Fatalf("the push service got %d requests, want 1", len(fake.requests))
+	}
+	req := fake.requests[0]
+	if req.Method != http.MethodPost || req.URL.Path != "/send/abc" {
+		t.Errorf("got %s %s, want POST /send/abc", req.Method, req.URL.Path)
+	}
+	if got := req.Header.Get("Content-Encoding"); got != "aes128gcm" {
+		t.Errorf("got Content-Encoding %q, want aes128gcm", got)
+	}
+	if got := req.Header.Get("TTL"); got != "3600" {
+		t.Errorf("got TTL %q, want 3600", got)
+	}
+	if got := req.Header.Get("Authorization"); !strings.HasPrefix(got, "vapid t=") {
+		t.Errorf("got Authorization %q, want a VAPID token", got)
+	}
+
+	// Subscriptions the push service no longer knows are removed
+	fake.status = http.StatusGone
+	if _, err := ps.deliver(job); err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if err := db.Conn.Model(&models.PushSubscription{}).Where("id = ?", subscription.ID).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Error("the gone subscription wasn't removed")
+	}
+}
+
+func TestPushHandleDoesNotBlock(t *testing.T) {
+	db := openTestDatabase(t)
+	ps := newTestPush(t, db, "http://127.0.0.1:1", 0)
+
+	user := createTestUser(t, db, "pushed")
+	actor := createTestUser(t, db, "follower")
+	sub := testPushSubscription(t, "https://push.example.com/send/abc")
+	if err := db.Conn.Create(&models.PushSubscription{
+		UserID:    user.ID,
+		SessionID: "session",
+		Endpoint:  sub.Endpoint,
+		P256dh:    sub.P256dh,
+		Auth:      sub.Auth,
+		Alerts:    models.AllPushAlerts,
+	}).Error; err != nil {
+		t.Fatal(err)
+	}
+	notification := &models.Notification{UserID: user.ID, Kind: models.NotificationFollow, GroupKey: "follow", ActorID: actor.ID}
+	if err := db.Conn.Create(notification).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ps.handle(events.Event{Type: events.NotificationCreated, UserID: user.ID, NotificationID: notification.ID})
+		ps.retry(pushJob{subscriptionID: 1})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handle blocked on a full queue")
+	}
+}
@@ -0,0 +1,127 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/bwoff11/frens/models"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/limiter"
+	"github.com/google/jsonapi"
+	"github.com/jinzhu/gorm"
+)
+
+// StorageUsage describes how much media storage a user uses. A Quota of 0
+// means the user's storage is unlimited.
+type StorageUsage struct {
+	ID             uint32 `jsonapi:"primary,storage-usage"` // ID of the user
+	Used           int64  `jsonapi:"attr,used"`
+	Quota          int64  `jsonapi:"attr,quota"`
+	MediaCount     int    `jsonapi:"attr,mediaCount"`
+	UploadsPerHour int    `jsonapi:"attr,uploadsPerHour"`
+}
+
+// quotaError is returned when storing media would exceed the user's quota.
+type quotaError struct {
+	Used  int64
+	Quota int64
+	Size  int64
+}
+
+func (e *quotaError) Error() string {
+	return fmt.Sprintf("storing %d bytes would exceed the quota of %d bytes with %d bytes used", e.Size, e.Quota, e.Used)
+}
+
+// GetStorage responds with the storage usage of the user making the request.
+func (ms *MediaService) GetStorage(c *fiber.Ctx) error {
+	// Get the ID of the user making the request
+	userID, err := getRequestorID(c)
+	if err != nil {
+		// Log and handle error here
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to get user ID")
+	}
+
+	usage := StorageUsage{ID: userID, UploadsPerHour: ms.Config.UploadsPerHour}
+	usage.Used, usage.Quota, err = ms.storageUsage(ms.Database.Conn, userID)
+	if err == nil {
+		err = ms.Database.Conn.Model(&models.Media{}).Where("user_id = ?", userID).Count(&usage.MediaCount).Error
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get the storage usage",
+		})
+	}
+
+	// Set the content type to application/vnd.api+json
+	c.Response().Header.Set(fiber.HeaderContentType, jsonapi.MediaType)
+	c.Status(fiber.StatusOK)
+
+	// Marshal the usage into JSON API format
+	return jsonapi.MarshalPayload(c.Response().BodyWriter(), &usage)
+}
+
+// storageUsage returns the bytes of media the user stores and the quota of
+// the user's role. Within a transaction, the user is locked until it ends so
+// concurrent uploads can't exceed the quota together.
+func (ms *MediaService) storageUsage(tx *gorm.DB, userID uint32) (used, quota int64, err error) {
+	var user models.User
+	if err := tx.Set("gorm:query_option", "FOR UPDATE").Select("id, role").First(&user, userID).Error; err != nil {
+		return 0, 0, err
+	}
+
+	// Every media item counts in full, even when its content is shared
+	err = tx.Model(&models.Media{}).
+		Where("user_id = ?", userID).
+		Select("COALESCE(SUM(size), 0)").
+		Row().Scan(&used)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return used, ms.Config.Quotas[user.Role], nil
+}
+
+// checkQuota returns a *quotaError if the user can't store size more bytes.
+func (ms *MediaService) checkQuota(tx *gorm.DB, userID uint32, size int64) error {
+	used, quota, err := ms.storageUsage(tx, userID)
+	if err != nil {
+		return err
+	}
+	if quota > 0 && used+size > quota {
+		return &quotaError{Used: used, Quota: quota, Size: size}
+	}
+	return nil
+}
+
+// writeQuotaError responds with the JSON:API error for an exceeded quota.
+func writeQuotaError(c *fiber.Ctx, err *quotaError) error {
+	return writeError(c, fiber.StatusForbidden, "storage_quota_exceeded", "Storage quota exceeded",
+		fmt.Sprintf("Uploading this file would exceed your storage quota of %d bytes", err.Quota),
+		map[string]interface{}{"used": err.Used, "quota": err.Quota, "size": err.Size})
+}
+
+// newUploadLimiter returns a handler limiting how many uploads each user can
+// make per hour. Failed uploads don't count.
+func (ms *MediaService) newUploadLimiter() fiber.Handler {
+	max := ms.Config.UploadsPerHour
+	return limiter.New(limiter.Config{
+		Next: func(c *fiber.Ctx) bool {
+			return max == 0
+		},
+		Max:        max,
+		Expiration: time.Hour,
+		KeyGenerator: func(c *fiber.Ctx) string {
+			userID, _ := getRequestorID(c)
+			return strconv.FormatUint(uint64(userID), 10)
+		},
+		LimitReached: func(c *fiber.Ctx) error {
+			return writeError(c, fiber.StatusTooManyRequests, "upload_rate_limited", "Too many uploads",
+				fmt.Sprintf("At most %d files can be uploaded per hour", max), nil)
+		},
+		SkipFailedRequests: true,
+		LimiterMiddleware:  limiter.SlidingWindow{},
+	})
+}
@@ -0,0 +1,82 @@
+package service
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/bwoff11/frens/models"
+	"github.com/bwoff11/frens/pkg/config"
+)
+
+// rankedPost is a feed candidate along with the signals used to score it.
+type rankedPost struct {
+	Post         *models.Post
+	Likes        int
+	Replies      int
+	Reposts      int
+	Affinity     int // the viewer's past interactions with the author
+	SecondDegree bool
+	Score        float64
+}
+
+// scoreCandidates computes the score of every candidate as seen at the
+// given moment. Scores only depend on the candidates and the moment, so a
+// feed computed for the same snapshot is always ranked the same way.
+func scoreCandidates(candidates []*rankedPost, weights *config.AlgorithmicFeedConfig, now time.Time) {
+	halfLife := weights.RecencyHalfLife.Hours()
+
+	for _, c := range candidates {
+		engagement := 1 +
+			weights.LikeWeight*float64(c.Likes) +
+			weights.ReplyWeight*float64(c.Replies) +
+			weights.RepostWeight*float64(c.Reposts)
+
+		age := now.Sub(c.Post.CreatedAt).Hours()
+		if age < 0 {
+			age = 0
+		}
+		recency := math.Pow(0.5, age/halfLife)
+
+		affinity := 1 + weights.AffinityWeight*math.Log1p(float64(c.Affinity))
+
+		c.Score = engagement * recency * affinity
+		if c.SecondDegree {
+			c.Score *= weights.SecondDegreeWeight
+		}
+	}
+}
+
+// diversify keeps a single author from dominating the feed. The n-th best
+// post of an author is multiplied by AuthorDecay^n, and posts beyond
+// MaxPerAuthor are dropped. The candidates are returned sorted by score.
+func diversify(candidates []*rankedPost, weights *config.AlgorithmicFeedConfig) []*rankedPost {
+	sortRanked(candidates)
+
+	seen := make(map[uint32]int)
+	diverse := candidates[:0]
+	for _, c := range candidates {
+		n := seen[c.Post.UserID]
+		seen[c.Post.UserID] = n + 1
+
+		if weights.MaxPerAuthor > 0 && n >= weights.MaxPerAuthor {
+			continue
+		}
+		c.Score *= math.Pow(weights.AuthorDecay, float64(n))
+		diverse = append(diverse, c)
+	}
+
+	sortRanked(diverse)
+	return diverse
+}
+
+// sortRanked orders candidates by descending score, breaking ties by
+// descending post ID so the order is total.
+func sortRanked(candidates []*rankedPost) {
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].Score != candidates[j].Score {
+			return candidates[i].Score > candidates[j].Score
+		}
+		return candidates[i].Post.ID > candidates[j].Post.ID
+	})
+}
@@ -0,0 +1,145 @@
+package service
+
+import (
+	"log"
+
+	"github.com/bwoff11/frens/models"
+	"github.com/bwoff11/frens/pkg/database"
+	"github.com/bwoff11/frens/pkg/events"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/jsonapi"
+	"github.com/jinzhu/gorm"
+)
+
+// ReactionService adds and removes emoji reactions. Reacting with
+// models.LikeEmoji likes the post, so likes and reactions stay one feature
+// for clients that know about reactions.
+type ReactionService struct {
+	Database   *database.Database
+	Visibility *VisibilityPolicy
+	Emoji      *EmojiService
+	Views      *PostViews
+	Events     events.Bus
+}
+
+// React adds the emoji to the post's reactions from the user making the
+// request. Adding a reaction that already exists changes nothing. It
+// responds with the post and its updated reactions.
+func (rs *ReactionService) React(c *fiber.Ctx, postID uint32, emoji string) error {
+	return rs.change(c, postID, emoji, func(userID uint32, emoji string) error {
+		if emoji == models.LikeEmoji {
+			added := false
+			err := rs.Database.Conn.Transaction(func(tx *gorm.DB) error {
+				result := tx.Exec(`
+					INSERT INTO likes (created_at, updated_at, user_id, post_id) VALUES (NOW(), NOW(), ?, ?)
+					ON CONFLICT (user_id, post_id) DO NOTHING`, userID, postID)
+				if result.Error != nil || result.RowsAffected == 0 {
+					return result.Error
+				}
+				if err := adjustCount(tx, postID, likeCount, 1); err != nil {
+					return err
+				}
+				added = true
+				return nil
+			})
+			if err == nil && added {
+				rs.Events.Publish(events.Event{Type: events.PostLiked, ActorID: userID, PostID: postID})
+			}
+			return err
+		}
+
+		result := rs.Database.Conn.Exec(`
+			INSERT INTO reactions (created_at, updated_at, user_id, post_id, emoji) VALUES (NOW(), NOW(), ?, ?, ?)
+			ON CONFLICT (post_id, user_id, emoji) DO NOTHING`, userID, postID, emoji)
+		if result.Error == nil && result.RowsAffected > 0 {
+			rs.Events.Publish(events.Event{Type: events.PostReacted, ActorID: userID, PostID: postID, Emoji: emoji})
+		}
+		return result.Error
+	})
+}
+
+// Unreact removes the emoji from the post's reactions from the user making
+// the request, if it's there. It responds with the post and its updated
+// reactions.
+func (rs *ReactionService) Unreact(c *fiber.Ctx, postID uint32, emoji string) error {
+	return rs.change(c, postID, emoji, func(userID uint32, emoji string) error {
+		if emoji == models.LikeEmoji {
+			return rs.Database.Conn.Transaction(func(tx *gorm.DB) error {
+				result := tx.Where("user_id = ? AND post_id = ?", userID, postID).Delete(&models.Like{})
+				if result.Error != nil || result.RowsAffected == 0 {
+					return result.Error
+				}
+				return adjustCount(tx, postID, likeCount, -1)
+			})
+		}
+		return rs.Database.Conn.Where("user_id = ? AND post_id = ? AND emoji = ?", userID, postID, emoji).Delete(&models.Reaction{}).Error
+	})
+}
+
+// change applies a change to the reactions of a post the user making the
+// request can see and responds with the post.
+func (rs *ReactionService) change(c *fiber.Ctx, postID uint32, text string, apply func(userID uint32, emoji string) error) error {
+	// Get the ID of the user making the request
+	userID, err := getRequestorID(c)
+	if err != nil {
+		// Log and handle error here
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to get user ID")
+	}
+
+	emoji, ok, err := rs.Emoji.resolve(text)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to check the emoji",
+		})
+	}
+	if !ok {
+		return c.Status(fiber.StatusBadRequest).SendString("Unknown emoji")
+	}
+
+	// Posts the user cannot see are reported as missing so their existence
+	// is not leaked
+	var post models.Post
+	if err := rs.Database.Conn.Preload("User").Preload("Media").First(&post, postID).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).SendString("Post not found")
+	}
+	visible, err := rs.Visibility.CanView(userID, &post)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to check post visibility",
+		})
+	}
+	if !visible {
+		return c.Status(fiber.StatusNotFound).SendString("Post not found")
+	}
+
+	if err := apply(userID, emoji); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update the reactions",
+		})
+	}
+
+	// Reload the post for its updated counters
+	if err := rs.Database.Conn.Preload("User").Preload("Media").First(&post, postID).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get the post",
+		})
+	}
+
+	if err := rs.Views.Prepare(c, &post); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to prepare the posts",
+		})
+	}
+
+	// Set the content type to application/vnd.api+json
+	c.Response().Header.Set(fiber.HeaderContentType, jsonapi.MediaType)
+
+	// Marshal the post into JSON API format
+	if err := jsonapi.MarshalPayload(c.Response().BodyWriter(), &post); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to marshal the post",
+		})
+	}
+	return nil
+}
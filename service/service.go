@@ -5,38 +5,187 @@ import (
 
 	"github.com/bwoff11/frens/pkg/config"
 	"github.com/bwoff11/frens/pkg/database"
+	"github.com/bwoff11/frens/pkg/events"
+	"github.com/bwoff11/frens/pkg/imageproc"
+	"github.com/bwoff11/frens/pkg/pubsub"
+	"github.com/bwoff11/frens/pkg/storage"
+	"github.com/bwoff11/frens/pkg/timeline"
+	"github.com/bwoff11/frens/pkg/transcode"
 	"github.com/gofiber/fiber/v2"
 	"github.com/golang-jwt/jwt/v5"
 )
 
 type Service struct {
-	Auth     *AuthService
-	Block    *BlockService
-	Bookmark *BookmarkService
-	Feed     *FeedService
-	Follow   *FollowService
-	Like     *LikeService
-	Media    *MediaService
-	Post     *PostService
-	User     *UserService
+	Auth         *AuthService
+	Block        *BlockService
+	Bookmark     *BookmarkService
+	Email        *EmailService
+	Emoji        *EmojiService
+	Feed         *FeedService
+	Filter       *FilterService
+	Follow       *FollowService
+	Like         *LikeService
+	Media        *MediaService
+	MediaGC      *MediaGCService
+	Mute         *MuteService
+	Notification *NotificationService
+	Post         *PostService
+	Push         *PushService
+	Reaction     *ReactionService
+	Stream       *StreamService
+	Upload       *UploadService
+	User         *UserService
+	Webhook      *WebhookService
+
+	Counter    *CounterService
+	Events     events.Bus
+	Timeline   *TimelineService
+	Transcode  *TranscodeService
+	Visibility *VisibilityPolicy
 }
 
-func New(db *database.Database, config *config.APIConfig) *Service {
+func New(db *database.Database, config *config.Config) (*Service, error) {
+	visibility := &VisibilityPolicy{Database: db}
+	bus := events.NewLocal(config.Events.QueueSize)
+
+	timelineStore, err := timeline.New(&config.Timeline, db.Conn)
+	if err != nil {
+		return nil, err
+	}
+	timelines := NewTimelineService(db, timelineStore, &config.Timeline)
+
+	store, err := storage.New(&config.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	transcoder, err := transcode.New(&config.Media.Transcode)
+	if err != nil {
+		return nil, err
+	}
+
+	urls := &MediaURLs{Storage: store, Expiry: config.Media.SignedURLExpiry}
+	images := imageproc.NewProcessor(&config.Media.Images)
+	transcodes := NewTranscodeService(db, store, images, transcoder, &config.Media.Transcode)
+	media := &MediaService{
+		Database:   db,
+		Storage:    store,
+		Visibility: visibility,
+		Images:     images,
+		Transcodes: transcodes,
+		URLs:       urls,
+		Config:     &config.Media,
+	}
+	media.UploadLimiter = media.newUploadLimiter()
+	transcodes.Media = media
+	views := &PostViews{Database: db, URLs: urls}
+
+	push, err := NewPushService(db, bus, &config.Push)
+	if err != nil {
+		return nil, err
+	}
+	email, err := NewEmailService(db, visibility, bus, &config.Mail)
+	if err != nil {
+		return nil, err
+	}
+	emoji := &EmojiService{Database: db}
+
+	users := &UserService{Database: db}
+	if err := users.PromoteAdmins(config.App.Admins); err != nil {
+		return nil, fmt.Errorf("failed to promote admins: %w", err)
+	}
+
 	return &Service{
 		Auth: &AuthService{
 			Database:    db,
-			JWTSecret:   []byte(config.TokenSecret),
-			JWTDuration: config.TokenDuration,
+			JWTSecret:   []byte(config.API.TokenSecret),
+			JWTDuration: config.API.TokenDuration,
+			Events:      bus,
 		},
 		Block:    &BlockService{Database: db},
-		Bookmark: &BookmarkService{Database: db},
-		Feed:     &FeedService{Database: db},
-		Follow:   &FollowService{Database: db},
-		Like:     &LikeService{Database: db},
-		Media:    &MediaService{Database: db},
-		Post:     &PostService{Database: db},
-		User:     &UserService{Database: db},
-	}
+		Bookmark: &BookmarkService{Database: db, Visibility: visibility, Views: views},
+		Email:    email,
+		Emoji:    emoji,
+		Feed: &FeedService{
+			Database:    db,
+			Visibility:  visibility,
+			Timelines:   timelines,
+			Views:       views,
+			Algorithmic: &config.Feed.Algorithmic,
+			Explore:     &config.Feed.Explore,
+		},
+		Filter: &FilterService{Database: db},
+		Follow: &FollowService{Database: db, Timelines: timelines, Events: bus},
+		Like:   &LikeService{Database: db, Visibility: visibility, Views: views, Events: bus},
+		Media:  media,
+		MediaGC: &MediaGCService{
+			Database: db,
+			Storage:  store,
+			Media:    media,
+			Config:   &config.Media.GC,
+		},
+		Mute: &MuteService{Database: db},
+		Notification: &NotificationService{
+			Database:   db,
+			Visibility: visibility,
+			Events:     bus,
+			Views:      views,
+		},
+		Post: &PostService{
+			Database:   db,
+			Visibility: visibility,
+			Timelines:  timelines,
+			Media:      &config.Media,
+			Views:      views,
+			Events:     bus,
+		},
+		Push: push,
+		Reaction: &ReactionService{
+			Database:   db,
+			Visibility: visibility,
+			Emoji:      emoji,
+			Views:      views,
+			Events:     bus,
+		},
+		Stream: &StreamService{
+			Database:   db,
+			Visibility: visibility,
+			Events:     bus,
+			PubSub:     pubsub.NewLocal(),
+			Views:      views,
+			Config:     &config.Streaming,
+		},
+		Upload: &UploadService{
+			Database: db,
+			Storage:  store,
+			Media:    media,
+			Config:   &config.Media.Uploads,
+		},
+		User:    users,
+		Webhook: NewWebhookService(db, bus, views, &config.Webhooks),
+
+		Counter:    &CounterService{Database: db, Config: &config.Counters},
+		Events:     bus,
+		Timeline:   timelines,
+		Transcode:  transcodes,
+		Visibility: visibility,
+	}, nil
+}
+
+// Start launches the background jobs of the services. It returns
+// immediately; the jobs run for the lifetime of the process.
+func (s *Service) Start() {
+	s.Timeline.start()
+	s.Transcode.start()
+	s.Notification.start()
+	s.Stream.start()
+	s.Push.start()
+	s.Email.start()
+	s.Webhook.start()
+	go s.Counter.loop()
+	go s.Feed.refreshExploreLoop()
+	go s.MediaGC.loop()
+	go s.Upload.cleanupLoop()
 }
 
 func getRequestorID(c *fiber.Ctx) (uint32, error) {
@@ -56,3 +205,24 @@ func getRequestorID(c *fiber.Ctx) (uint32, error) {
 
 	return id, nil
 }
+
+// getOptionalRequestorID is getRequestorID for routes that can also be used
+// without logging in. It returns zero for anonymous requests.
+func getOptionalRequestorID(c *fiber.Ctx) (uint32, error) {
+	if _, ok := c.Locals("user").(*jwt.Token); !ok {
+		return 0, nil
+	}
+	return getRequestorID(c)
+}
+
+// getSessionID returns the ID of the login session the request's token
+// belongs to. Tokens issued before sessions were introduced have none.
+func getSessionID(c *fiber.Ctx) (string, error) {
+	user := c.Locals("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+	id, ok := claims["jti"].(string)
+	if !ok || id == "" {
+		return "", fiber.ErrUnauthorized
+	}
+	return id, nil
+}
@@ -0,0 +1,541 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwoff11/frens/models"
+	"github.com/bwoff11/frens/pkg/config"
+	"github.com/bwoff11/frens/pkg/database"
+	"github.com/bwoff11/frens/pkg/events"
+	"github.com/bwoff11/frens/pkg/pubsub"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/websocket/v2"
+	"github.com/google/jsonapi"
+	"github.com/jinzhu/gorm"
+)
+
+// StreamService pushes new posts, notifications and deletions to connected
+// clients over WebSocket or server-sent events. Events are published to
+// pub/sub topics, and every connection renders what it receives for its
+// user, so visibility and the viewer's state are the same as in the API.
+type StreamService struct {
+	Database   *database.Database
+	Visibility *VisibilityPolicy
+	Events     events.Bus
+	PubSub     pubsub.PubSub
+	Views      *PostViews
+	Config     *config.StreamingConfig
+}
+
+// Streaming channels. User and hashtag channels are followed by an ID or
+// tag, like user:12 or hashtag:frens.
+const (
+	channelHome          = "home"          // new posts in the home timeline
+	channelNotifications = "notifications" // new and updated notifications
+	channelUser          = "user"          // new posts of a user
+	channelHashtag       = "hashtag"       // new public posts with a hashtag
+)
+
+// defaultChannels are streamed when a client doesn't choose any.
+var defaultChannels = []string{channelHome, channelNotifications}
+
+// Events sent to clients, in the event meta of each document.
+const (
+	streamUpdate       = "update"
+	streamDelete       = "delete"
+	streamNotification = "notification"
+	streamSubscribed   = "subscribed"
+	streamUnsubscribed = "unsubscribed"
+	streamError        = "error"
+)
+
+// hashtagPattern matches hashtags in post text, like #frens.
+var hashtagPattern = regexp.MustCompile(`(?:^|[^\w#])#(\w{1,64})`)
+
+// tagPattern matches a hashtag as used in a channel, without the #.
+var tagPattern = regexp.MustCompile(`^\w{1,64}$`)
+
+// streamMessage is what is published to the topics. It only references the
+// post or notification, which each connection loads for its user.
+type streamMessage struct {
+	Event          string `json:"event"`
+	PostID         uint32 `json:"postID,omitempty"`
+	NotificationID uint32 `json:"notificationID,omitempty"`
+
+	// The post is gone by the time a deletion is rendered, so its author
+	// and privacy travel with the message
+	UserID  uint32 `json:"userID,omitempty"`
+	Privacy string `json:"privacy,omitempty"`
+}
+
+// streamCommand changes the channels of a WebSocket connection.
+type streamCommand struct {
+	Action  string `json:"action"` // subscribe or unsubscribe
+	Channel string `json:"channel"`
+}
+
+// streamWriter sends documents to a client over one of the transports.
+type streamWriter interface {
+	write(event string, doc []byte) error
+	heartbeat() error
+}
+
+// Stream streams the channels to the user making the request, over
+// WebSocket if the request asks for an upgrade and as server-sent events
+// otherwise. Without channels, the home timeline and notifications are
+// streamed.
+func (ss *StreamService) Stream(c *fiber.Ctx, channels []string) error {
+	// Get the ID of the user making the request
+	userID, err := getRequestorID(c)
+	if err != nil {
+		// Log and handle error here
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to get user ID")
+	}
+
+	if len(channels) == 0 {
+		channels = defaultChannels
+	}
+	if len(channels) > ss.Config.MaxChannels {
+		return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("At most %d channels can be streamed", ss.Config.MaxChannels))
+	}
+	topics := make(map[string]string, len(channels))
+	for _, channel := range channels {
+		topic, ok := channelTopic(userID, channel)
+		if !ok {
+			return c.Status(fiber.StatusBadRequest).SendString("Unknown channel " + channel)
+		}
+		topics[topic] = channel
+	}
+
+	if websocket.IsWebSocketUpgrade(c) {
+		return websocket.New(func(conn *websocket.Conn) {
+			ss.serveWebSocket(conn, userID, topics)
+		})(c)
+	}
+
+	c.Set(fiber.HeaderContentType, "text/event-stream")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	c.Set(fiber.HeaderConnection, "keep-alive")
+	c.Set("X-Accel-Buffering", "no") // Keep proxies from buffering the stream
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		ss.serve(userID, topics, eventStreamWriter{w}, nil)
+	})
+	return nil
+}
+
+// channelTopic returns the topic a channel is streamed from for the user,
+// and false if the channel doesn't exist.
+func channelTopic(userID uint32, channel string) (string, bool) {
+	name, arg, _ := strings.Cut(channel, ":")
+	switch name {
+	case channelHome, channelNotifications:
+		if arg != "" {
+			return "", false
+		}
+		return fmt.Sprintf("%s:%d", name, userID), true
+	case channelUser:
+		id, err := strconv.ParseUint(arg, 10, 32)
+		if err != nil {
+			return "", false
+		}
+		return fmt.Sprintf("%s:%d", name, id), true
+	case channelHashtag:
+		if !tagPattern.MatchString(arg) {
+			return "", false
+		}
+		return name + ":" + strings.ToLower(arg), true
+	}
+	return "", false
+}
+
+// serve streams the topics, each labelled with the channel it was
+// subscribed as, until the client goes away or falls too far behind.
+// Commands from WebSocket clients change the topics as it goes. It returns
+// pubsub.ErrSlowSubscriber if the client fell behind.
+func (ss *StreamService) serve(viewerID uint32, topics map[string]string, w streamWriter, commands <-chan streamCommand) error {
+	names := make([]string, 0, len(topics))
+	for topic := range topics {
+		names = append(names, topic)
+	}
+	sub, err := ss.PubSub.Subscribe(ss.Config.BufferSize, names...)
+	if err != nil {
+		log.Println("Failed to subscribe to the stream:", err)
+		return err
+	}
+	defer sub.Close()
+
+	heartbeat := time.NewTicker(ss.Config.HeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case msg, ok := <-sub.Messages():
+			if !ok {
+				// The client should reconnect and catch up through the API
+				if sub.Err() == pubsub.ErrSlowSubscriber {
+					w.write(streamError, streamErrorDoc("slow_consumer", "Stream fell behind", "Too many messages were waiting to be sent"))
+				}
+				return sub.Err()
+			}
+			event, doc, err := ss.render(viewerID, topics[msg.Topic], msg)
+			if err != nil {
+				log.Println("Failed to render a stream message:", err)
+				continue
+			}
+			if doc == nil {
+				continue
+			}
+			if err := w.write(event, doc); err != nil {
+				return nil
+			}
+
+		case <-heartbeat.C:
+			if err := w.heartbeat(); err != nil {
+				return nil
+			}
+
+		case cmd, ok := <-commands:
+			if !ok {
+				return nil
+			}
+			event, doc := ss.apply(viewerID, topics, sub, cmd)
+			if err := w.write(event, doc); err != nil {
+				return nil
+			}
+		}
+	}
+}
+
+// apply subscribes to or unsubscribes from a channel and returns the
+// document confirming it.
+func (ss *StreamService) apply(viewerID uint32, topics map[string]string, sub pubsub.Subscription, cmd streamCommand) (string, []byte) {
+	topic, ok := channelTopic(viewerID, cmd.Channel)
+	if !ok {
+		return streamError, streamErrorDoc("unknown_channel", "Unknown channel", "There is no channel "+cmd.Channel)
+	}
+
+	switch cmd.Action {
+	case "subscribe":
+		if _, ok := topics[topic]; !ok && len(topics) >= ss.Config.MaxChannels {
+			return streamError, streamErrorDoc("too_many_channels", "Too many channels",
+				fmt.Sprintf("At most %d channels can be streamed", ss.Config.MaxChannels))
+		}
+		if err := sub.Add(topic); err != nil {
+			log.Println("Failed to subscribe to a channel:", err)
+			return streamError, streamErrorDoc("subscribe_failed", "Failed to subscribe", "")
+		}
+		topics[topic] = cmd.Channel
+		return streamSubscribed, streamMetaDoc(streamSubscribed, cmd.Channel)
+	case "unsubscribe":
+		if err := sub.Remove(topic); err != nil {
+			log.Println("Failed to unsubscribe from a channel:", err)
+			return streamError, streamErrorDoc("unsubscribe_failed", "Failed to unsubscribe", "")
+		}
+		delete(topics, topic)
+		return streamUnsubscribed, streamMetaDoc(streamUnsubscribed, cmd.Channel)
+	}
+	return streamError, streamErrorDoc("unknown_action", "Unknown action", "Actions are subscribe and unsubscribe")
+}
+
+// render turns a published message into the document sent to the viewer. It
+// returns a nil document if the viewer shouldn't get the message.
+func (ss *StreamService) render(viewerID uint32, channel string, msg pubsub.Message) (string, []byte, error) {
+	var m streamMessage
+	if err := json.Unmarshal(msg.Data, &m); err != nil {
+		return "", nil, err
+	}
+
+	switch m.Event {
+	case streamUpdate:
+		var post models.Post
+		if err := ss.Database.Conn.Preload("User").Preload("Media").First(&post, m.PostID).Error; err != nil {
+			if gorm.IsRecordNotFoundError(err) {
+				return "", nil, nil
+			}
+			return "", nil, err
+		}
+		visible, err := ss.Visibility.CanView(viewerID, &post)
+		if err != nil || !visible {
+			return "", nil, err
+		}
+		if err := ss.Views.PrepareFor(context.Background(), viewerID, &post); err != nil {
+			return "", nil, err
+		}
+		doc, err := streamDoc(&post, m.Event, channel)
+		return m.Event, doc, err
+
+	case streamNotification:
+		var notification models.Notification
+		if err := ss.Database.Conn.
+			Preload("Actor").
+			Preload("Post").
+			Preload("Post.User").
+			Preload("Post.Media").
+			Where("id = ? AND user_id = ?", m.NotificationID, viewerID).
+			First(&notification).Error; err != nil {
+			if gorm.IsRecordNotFoundError(err) {
+				return "", nil, nil
+			}
+			return "", nil, err
+		}
+		if err := ss.Views.PrepareFor(context.Background(), viewerID, notification.Post); err != nil {
+			return "", nil, err
+		}
+		doc, err := streamDoc(&notification, m.Event, channel)
+		return m.Event, doc, err
+
+	case streamDelete:
+		visible, err := ss.Visibility.CanView(viewerID, &models.Post{UserID: m.UserID, Privacy: m.Privacy})
+		if err != nil || !visible {
+			return "", nil, err
+		}
+		doc, err := json.Marshal(&jsonapi.OnePayload{
+			Data: &jsonapi.Node{Type: "post", ID: strconv.FormatUint(uint64(m.PostID), 10)},
+			Meta: &jsonapi.Meta{"event": m.Event},
+		})
+		return m.Event, doc, err
+	}
+	return "", nil, fmt.Errorf("unknown stream event %q", m.Event)
+}
+
+// streamDoc marshals the model into a JSON API document with the event and
+// channel in its meta.
+func streamDoc(model interface{}, event, channel string) ([]byte, error) {
+	payload, err := jsonapi.Marshal(model)
+	if err != nil {
+		return nil, err
+	}
+	one := payload.(*jsonapi.OnePayload)
+	one.Meta = &jsonapi.Meta{"event": event, "channel": channel}
+	return json.Marshal(one)
+}
+
+// streamMetaDoc is a document with only meta, confirming a change of
+// channels.
+func streamMetaDoc(event, channel string) []byte {
+	doc, _ := json.Marshal(map[string]interface{}{
+		"meta": jsonapi.Meta{"event": event, "channel": channel},
+	})
+	return doc
+}
+
+// streamErrorDoc is a JSON API error document.
+func streamErrorDoc(code, title, detail string) []byte {
+	var buf bytes.Buffer
+	jsonapi.MarshalErrors(&buf, []*jsonapi.ErrorObject{{Code: code, Title: title, Detail: detail}})
+	return bytes.TrimSpace(buf.Bytes())
+}
+
+// serveWebSocket streams over a WebSocket connection. Clients change their
+// channels by sending commands, and are pinged on every heartbeat. The
+// connection is dropped if they don't answer within two heartbeats.
+func (ss *StreamService) serveWebSocket(conn *websocket.Conn, viewerID uint32, topics map[string]string) {
+	// The connection is released once this returns, so the reader must be
+	// done with it by then
+	ws := conn.Conn
+	done := make(chan struct{})
+	commands := make(chan streamCommand)
+	var reader sync.WaitGroup
+	reader.Add(1)
+	go func() {
+		defer reader.Done()
+		defer close(commands)
+
+		deadline := 2 * ss.Config.HeartbeatInterval
+		ws.SetReadLimit(4096)
+		ws.SetReadDeadline(time.Now().Add(deadline))
+		ws.SetPongHandler(func(string) error {
+			return ws.SetReadDeadline(time.Now().Add(deadline))
+		})
+		for {
+			_, data, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			var cmd streamCommand
+			if err := json.Unmarshal(data, &cmd); err != nil {
+				cmd = streamCommand{}
+			}
+			select {
+			case commands <- cmd:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	w := webSocketWriter{conn: conn, timeout: ss.Config.WriteTimeout}
+	code := websocket.CloseNormalClosure
+	if err := ss.serve(viewerID, topics, w, commands); err == pubsub.ErrSlowSubscriber {
+		code = websocket.CloseTryAgainLater
+	}
+
+	close(done)
+	ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, ""), time.Now().Add(ss.Config.WriteTimeout))
+	ws.Close()
+	reader.Wait()
+}
+
+type webSocketWriter struct {
+	conn    *websocket.Conn
+	timeout time.Duration
+}
+
+func (w webSocketWriter) write(event string, doc []byte) error {
+	if err := w.conn.SetWriteDeadline(time.Now().Add(w.timeout)); err != nil {
+		return err
+	}
+	return w.conn.WriteMessage(websocket.TextMessage, doc)
+}
+
+func (w webSocketWriter) heartbeat() error {
+	return w.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(w.timeout))
+}
+
+// eventStreamWriter writes server-sent events. Heartbeats are comments,
+// which clients ignore.
+type eventStreamWriter struct{ w *bufio.Writer }
+
+func (w eventStreamWriter) write(event string, doc []byte) error {
+	if _, err := fmt.Fprintf(w.w, "event: %s\ndata: %s\n\n", event, doc); err != nil {
+		return err
+	}
+	return w.w.Flush()
+}
+
+func (w eventStreamWriter) heartbeat() error {
+	if _, err := w.w.WriteString(": heartbeat\n\n"); err != nil {
+		return err
+	}
+	return w.w.Flush()
+}
+
+// start subscribes to the events that are streamed.
+func (ss *StreamService) start() {
+	ss.Events.Subscribe("streaming", ss.handle,
+		events.PostCreated, events.PostDeleted, events.NotificationCreated)
+}
+
+func (ss *StreamService) handle(event events.Event) {
+	var err error
+	switch event.Type {
+	case events.PostCreated:
+		err = ss.publishPost(event.PostID)
+	case events.PostDeleted:
+		err = ss.publishDeletion(event)
+	case events.NotificationCreated:
+		err = ss.publish(streamMessage{Event: streamNotification, NotificationID: event.NotificationID},
+			fmt.Sprintf("%s:%d", channelNotifications, event.UserID))
+	}
+	if err != nil {
+		log.Printf("Failed to stream %s: %v", event.Type, err)
+	}
+}
+
+// publishPost publishes a new post to the home timelines of its author and
+// their followers, the author's channel and, if it's public, the channels of
+// its hashtags.
+func (ss *StreamService) publishPost(postID uint32) error {
+	var post models.Post
+	if err := ss.Database.Conn.First(&post, postID).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return nil
+		}
+		return err
+	}
+
+	msg := streamMessage{Event: streamUpdate, PostID: post.ID}
+	topics := []string{
+		fmt.Sprintf("%s:%d", channelHome, post.UserID),
+		fmt.Sprintf("%s:%d", channelUser, post.UserID),
+	}
+	if post.Privacy == models.PrivacyPublic {
+		seen := make(map[string]bool)
+		for _, match := range hashtagPattern.FindAllStringSubmatch(post.Text, -1) {
+			topic := channelHashtag + ":" + strings.ToLower(match[1])
+			if !seen[topic] {
+				seen[topic] = true
+				topics = append(topics, topic)
+			}
+		}
+	}
+	if err := ss.publish(msg, topics...); err != nil {
+		return err
+	}
+
+	// Private posts are not shown to anyone else
+	if post.Privacy == models.PrivacyPrivate {
+		return nil
+	}
+	return ss.publishFollowers(msg, post.UserID)
+}
+
+// publishDeletion tells the clients that may be showing a deleted post: the
+// author's home timeline and channel, and the home timelines of their
+// followers unless it was private.
+func (ss *StreamService) publishDeletion(event events.Event) error {
+	msg := streamMessage{Event: streamDelete, PostID: event.PostID, UserID: event.ActorID, Privacy: event.Privacy}
+	if err := ss.publish(msg,
+		fmt.Sprintf("%s:%d", channelHome, event.ActorID),
+		fmt.Sprintf("%s:%d", channelUser, event.ActorID),
+	); err != nil {
+		return err
+	}
+	if event.Privacy == models.PrivacyPrivate {
+		return nil
+	}
+	return ss.publishFollowers(msg, event.ActorID)
+}
+
+// publishFollowers publishes the message to the home timelines of the
+// user's followers.
+func (ss *StreamService) publishFollowers(msg streamMessage, userID uint32) error {
+	var lastID uint32
+	for {
+		var follows []models.Follow
+		if err := ss.Database.Conn.
+			Where("followed_id = ? AND id > ?", userID, lastID).
+			Order("id").
+			Limit(followerBatchSize).
+			Find(&follows).Error; err != nil {
+			return err
+		}
+		if len(follows) == 0 {
+			return nil
+		}
+
+		topics := make([]string, len(follows))
+		for i, follow := range follows {
+			topics[i] = fmt.Sprintf("%s:%d", channelHome, follow.UserID)
+		}
+		if err := ss.publish(msg, topics...); err != nil {
+			return err
+		}
+		lastID = follows[len(follows)-1].ID
+	}
+}
+
+// publish publishes the message to the topics.
+func (ss *StreamService) publish(msg streamMessage, topics ...string) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	for _, topic := range topics {
+		if err := ss.PubSub.Publish(topic, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,360 @@
+package service
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bwoff11/frens/models"
+	"github.com/bwoff11/frens/pkg/config"
+	"github.com/bwoff11/frens/pkg/database"
+	"github.com/bwoff11/frens/pkg/timeline"
+)
+
+// followerBatchSize is how many followers are loaded at once during fan-out.
+const followerBatchSize = 1000
+
+// timelineJob is a unit of work for the timeline workers. Either a post is
+// fanned out to its author's followers or a user's timeline is rebuilt.
+type timelineJob struct {
+	post    *models.Post
+	rebuild uint32
+}
+
+// TimelineService maintains the materialized home timelines. New posts are
+// fanned out to the timelines of their author's followers in the background,
+// except for accounts with very many followers whose posts are merged in
+// when a timeline is read.
+type TimelineService struct {
+	Database *database.Database
+	Store    timeline.Store
+	Config   *config.TimelineConfig
+
+	jobs chan timelineJob
+
+	// rebuilding collects the entries fanned out to each timeline while it
+	// is being rebuilt. The rebuild adds them back after replacing the
+	// timeline, as its query may have run before their posts were created.
+	mu         sync.Mutex
+	rebuilding map[uint32]*pendingRebuild
+}
+
+// pendingRebuild tracks the rebuilds of a timeline that are running, which
+// can be more than one when a timeline is read while a worker rebuilds it.
+type pendingRebuild struct {
+	running int
+	entries []timeline.Entry
+}
+
+func NewTimelineService(db *database.Database, store timeline.Store, config *config.TimelineConfig) *TimelineService {
+	return &TimelineService{
+		Database: db,
+		Store:    store,
+		Config:   config,
+		jobs:     make(chan timelineJob, config.QueueSize),
+
+		rebuilding: make(map[uint32]*pendingRebuild),
+	}
+}
+
+// FanOut queues the post for delivery to its author's followers. If the
+// queue is full, the timelines the post belongs in are invalidated instead,
+// so they are rebuilt with it when they are next read.
+func (ts *TimelineService) FanOut(post *models.Post) {
+	select {
+	case ts.jobs <- timelineJob{post: post}:
+	default:
+		log.Println("Timeline queue is full, invalidating the timelines of the followers of user", post.UserID)
+		if err := ts.invalidateAudience(post); err != nil {
+			log.Println("Failed to invalidate timelines:", err)
+		}
+	}
+}
+
+// Rebuild queues a rebuild of the user's timeline, e.g. after they followed
+// or unfollowed someone. If the queue is full, the timeline is invalidated
+// instead, so it is rebuilt when it is next read.
+func (ts *TimelineService) Rebuild(userID uint32) {
+	select {
+	case ts.jobs <- timelineJob{rebuild: userID}:
+	default:
+		log.Println("Timeline queue is full, invalidating the timeline of user", userID)
+		if err := ts.Store.Invalidate([]uint32{userID}); err != nil {
+			log.Println("Failed to invalidate timelines:", err)
+		}
+	}
+}
+
+// invalidateAudience invalidates the timelines the post would be fanned out
+// to.
+func (ts *TimelineService) invalidateAudience(post *models.Post) error {
+	userIDs := []uint32{post.UserID}
+	if post.Privacy != models.PrivacyPrivate {
+		// Followers of accounts at the threshold merge the posts in on read,
+		// so no more than that many need to be invalidated
+		var followers []uint32
+		if err := ts.Database.Conn.Model(&models.Follow{}).
+			Where("followed_id = ?", post.UserID).
+			Limit(ts.Config.FanoutThreshold).
+			Pluck("user_id", &followers).Error; err != nil {
+			return err
+		}
+		if len(followers) < ts.Config.FanoutThreshold {
+			userIDs = append(userIDs, followers...)
+		}
+	}
+	return ts.Store.Invalidate(userIDs)
+}
+
+// start launches the workers and the trimming loop.
+func (ts *TimelineService) start() {
+	for i := 0; i < ts.Config.Workers; i++ {
+		go ts.work()
+	}
+	go ts.trimLoop()
+}
+
+func (ts *TimelineService) work() {
+	for job := range ts.jobs {
+		var err error
+		if job.post != nil {
+			err = ts.fanOut(job.post)
+		} else {
+			err = ts.rebuild(job.rebuild)
+		}
+		if err != nil {
+			log.Println("Failed to update timelines:", err)
+		}
+	}
+}
+
+func (ts *TimelineService) trimLoop() {
+	ticker := time.NewTicker(ts.Config.TrimInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := ts.Store.Trim(ts.Config.MaxEntries); err != nil {
+			log.Println("Failed to trim timelines:", err)
+		}
+	}
+}
+
+func (ts *TimelineService) fanOut(post *models.Post) error {
+	entry := timeline.Entry{PostID: post.ID, AuthorID: post.UserID, CreatedAt: post.CreatedAt}
+
+	// Authors always see their own posts
+	if err := ts.add([]uint32{post.UserID}, entry); err != nil {
+		return err
+	}
+
+	// Private posts are not shown to anyone else
+	if post.Privacy == models.PrivacyPrivate {
+		return nil
+	}
+
+	// Posts of accounts with too many followers are merged in on read
+	var followers int
+	if err := ts.Database.Conn.Model(&models.Follow{}).
+		Where("followed_id = ?", post.UserID).
+		Count(&followers).Error; err != nil {
+		return err
+	}
+	if followers >= ts.Config.FanoutThreshold {
+		return nil
+	}
+
+	var lastID uint32
+	for {
+		var follows []models.Follow
+		if err := ts.Database.Conn.
+			Where("followed_id = ? AND id > ?", post.UserID, lastID).
+			Order("id").
+			Limit(followerBatchSize).
+			Find(&follows).Error; err != nil {
+			return err
+		}
+		if len(follows) == 0 {
+			return nil
+		}
+
+		userIDs := make([]uint32, len(follows))
+		for i, follow := range follows {
+			userIDs[i] = follow.UserID
+		}
+		if err := ts.add(userIDs, entry); err != nil {
+			return err
+		}
+		lastID = follows[len(follows)-1].ID
+	}
+}
+
+// add inserts the entry into the timelines of the given users, recording it
+// for those being rebuilt. It is recorded first: an entry added before the
+// rebuild started belongs to a post its query already sees.
+func (ts *TimelineService) add(userIDs []uint32, entry timeline.Entry) error {
+	ts.mu.Lock()
+	for _, userID := range userIDs {
+		if pending, ok := ts.rebuilding[userID]; ok {
+			pending.entries = append(pending.entries, entry)
+		}
+	}
+	ts.mu.Unlock()
+
+	return ts.Store.Add(userIDs, entry)
+}
+
+// rebuild recomputes the user's timeline from the posts of the accounts they
+// follow, leaving out accounts whose posts are merged in on read. Entries
+// fanned out while it runs are added back after the timeline is replaced.
+func (ts *TimelineService) rebuild(userID uint32) error {
+	ts.mu.Lock()
+	pending, ok := ts.rebuilding[userID]
+	if !ok {
+		pending = &pendingRebuild{}
+		ts.rebuilding[userID] = pending
+	}
+	pending.running++
+	ts.mu.Unlock()
+	defer func() {
+		ts.mu.Lock()
+		if pending.running--; pending.running == 0 {
+			delete(ts.rebuilding, userID)
+		}
+		ts.mu.Unlock()
+	}()
+
+	celebrities, err := ts.celebritiesFollowedBy(userID)
+	if err != nil {
+		return err
+	}
+
+	query := ts.Database.Conn.
+		Table("posts").
+		Select("id AS post_id, user_id AS author_id, created_at").
+		Where(`user_id = ? OR (privacy <> ? AND user_id IN (SELECT followed_id FROM follows WHERE user_id = ?))`,
+			userID, models.PrivacyPrivate, userID)
+	if len(celebrities) > 0 {
+		query = query.Where("user_id NOT IN (?)", celebrities)
+	}
+
+	var entries []timeline.Entry
+	if err := query.
+		Order("created_at DESC, id DESC").
+		Limit(ts.Config.MaxEntries).
+		Scan(&entries).Error; err != nil {
+		return err
+	}
+
+	if err := ts.Store.Replace(userID, entries); err != nil {
+		return err
+	}
+
+	// The entries are kept until no rebuild is running, as another one may
+	// still replace the timeline with the results of an older query
+	ts.mu.Lock()
+	added := append([]timeline.Entry(nil), pending.entries...)
+	ts.mu.Unlock()
+	for _, entry := range added {
+		if err := ts.Store.Add([]uint32{userID}, entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// celebritiesFollowedBy returns the accounts followed by the user whose
+// posts are not fanned out.
+func (ts *TimelineService) celebritiesFollowedBy(userID uint32) ([]uint32, error) {
+	var ids []uint32
+	err := ts.Database.Conn.
+		Model(&models.Follow{}).
+		Where("followed_id IN (SELECT followed_id FROM follows WHERE user_id = ?)", userID).
+		Group("followed_id").
+		Having("count(*) >= ?", ts.Config.FanoutThreshold).
+		Pluck("followed_id", &ids).Error
+	return ids, err
+}
+
+// Page returns up to limit entries of the user's home timeline, starting
+// after from in the direction given by newer like timeline.Store.Range, and
+// whether there are more entries in that direction. Posts of accounts that
+// are not fanned out are merged in from the posts table.
+func (ts *TimelineService) Page(userID uint32, from *timeline.Entry, newer bool, limit int) ([]timeline.Entry, bool, error) {
+	// Build the timeline the first time it is read
+	materialized, err := ts.Store.Materialized(userID)
+	if err != nil {
+		return nil, false, err
+	}
+	if !materialized {
+		if err := ts.rebuild(userID); err != nil {
+			return nil, false, err
+		}
+	}
+
+	entries, err := ts.Store.Range(userID, from, newer, limit+1)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Merge in the posts of followed accounts that are not fanned out
+	celebrities, err := ts.celebritiesFollowedBy(userID)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(celebrities) > 0 {
+		query := ts.Database.Conn.
+			Table("posts").
+			Select("id AS post_id, user_id AS author_id, created_at").
+			Where("user_id IN (?) AND privacy <> ?", celebrities, models.PrivacyPrivate)
+		switch {
+		case from == nil:
+			query = query.Order("created_at DESC, id DESC")
+		case newer:
+			query = query.Where("(created_at, id) > (?, ?)", from.CreatedAt, from.PostID).
+				Order("created_at ASC, id ASC")
+		default:
+			query = query.Where("(created_at, id) < (?, ?)", from.CreatedAt, from.PostID).
+				Order("created_at DESC, id DESC")
+		}
+
+		var merged []timeline.Entry
+		if err := query.Limit(limit + 1).Scan(&merged).Error; err != nil {
+			return nil, false, err
+		}
+		entries = mergeEntries(entries, merged, newer)
+	}
+
+	more := len(entries) > limit
+	if more {
+		entries = entries[:limit]
+	}
+	if newer {
+		for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+			entries[i], entries[j] = entries[j], entries[i]
+		}
+	}
+	return entries, more, nil
+}
+
+// mergeEntries combines two lists of entries in the order given by newer,
+// dropping duplicates. An account that recently crossed the fan-out
+// threshold can have its posts in both lists.
+func mergeEntries(a, b []timeline.Entry, newer bool) []timeline.Entry {
+	seen := make(map[uint32]bool, len(a)+len(b))
+	merged := make([]timeline.Entry, 0, len(a)+len(b))
+	for _, entry := range append(a, b...) {
+		if !seen[entry.PostID] {
+			seen[entry.PostID] = true
+			merged = append(merged, entry)
+		}
+	}
+
+	sort.Slice(merged, func(i, j int) bool {
+		if newer {
+			return merged[j].Before(merged[i])
+		}
+		return merged[i].Before(merged[j])
+	})
+	return merged
+}
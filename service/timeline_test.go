@@ -0,0 +1,104 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bwoff11/frens/models"
+	"github.com/bwoff11/frens/pkg/config"
+	"github.com/bwoff11/frens/pkg/timeline"
+)
+
+// TestRebuildDoesNotBlock checks that a rebuild requested while the queue is
+// full invalidates the timeline instead of waiting for a worker.
+func TestRebuildDoesNotBlock(t *testing.T) {
+	store := timeline.NewMemoryStore(10)
+	ts := NewTimelineService(nil, store, &config.TimelineConfig{MaxEntries: 10, FanoutThreshold: 10, QueueSize: 0})
+	if err := store.Replace(1, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ts.Rebuild(1)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Rebuild blocked on the full queue")
+	}
+
+	if ok, _ := store.Materialized(1); ok {
+		t.Error("the timeline is still materialized")
+	}
+}
+
+// replaceHookStore runs beforeReplace when a timeline is replaced, to
+// simulate work done while a rebuild runs.
+type replaceHookStore struct {
+	*timeline.MemoryStore
+	beforeReplace func()
+}
+
+func (s *replaceHookStore) Replace(userID uint32, entries []timeline.Entry) error {
+	if s.beforeReplace != nil {
+		hook := s.beforeReplace
+		s.beforeReplace = nil
+		hook()
+	}
+	return s.MemoryStore.Replace(userID, entries)
+}
+
+// TestRebuildKeepsConcurrentFanOut checks that a post fanned out between the
+// query of a rebuild and the replacement of the timeline isn't lost.
+func TestRebuildKeepsConcurrentFanOut(t *testing.T) {
+	db := openTestDatabase(t)
+	store := &replaceHookStore{MemoryStore: timeline.NewMemoryStore(10)}
+	ts := NewTimelineService(db, store, &config.TimelineConfig{MaxEntries: 10, FanoutThreshold: 10})
+
+	author := models.User{Username: "author", Email: "author@example.com", Password: "x", Role: models.RoleUser}
+	follower := models.User{Username: "follower", Email: "follower@example.com", Password: "x", Role: models.RoleUser}
+	for _, user := range []*models.User{&author, &follower} {
+		if err := db.Conn.Create(user).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Conn.Create(&models.Follow{UserID: follower.ID, FollowedID: author.ID}).Error; err != nil {
+		t.Fatal(err)
+	}
+	first := models.Post{UserID: author.ID, Text: "first", Privacy: models.PrivacyPublic}
+	if err := db.Conn.Create(&first).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := store.MemoryStore.Replace(follower.ID, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second post is created and fanned out after the rebuild queried
+	// the posts
+	second := models.Post{UserID: author.ID, Text: "second", Privacy: models.PrivacyPublic}
+	store.beforeReplace = func() {
+		if err := db.Conn.Create(&second).Error; err != nil {
+			t.Fatal(err)
+		}
+		if err := ts.fanOut(&second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ts.rebuild(follower.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := store.Range(follower.ID, nil, false, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[uint32]bool{}
+	for _, entry := range entries {
+		got[entry.PostID] = true
+	}
+	if !got[first.ID] || !got[second.ID] || len(entries) != 2 {
+		t.Errorf("timeline has posts %v, want %d and %d", got, first.ID, second.ID)
+	}
+}
@@ -0,0 +1,290 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/bwoff11/frens/models"
+	"github.com/bwoff11/frens/pkg/config"
+	"github.com/bwoff11/frens/pkg/database"
+	"github.com/bwoff11/frens/pkg/imageproc"
+	"github.com/bwoff11/frens/pkg/storage"
+	"github.com/bwoff11/frens/pkg/transcode"
+	"github.com/jinzhu/gorm"
+)
+
+// TranscodeService converts video, GIF and audio uploads in the background.
+// Until they are done, the media is in the processing state.
+type TranscodeService struct {
+	Database   *database.Database
+	Storage    storage.Storage
+	Media      *MediaService
+	Images     *imageproc.Processor
+	Transcoder transcode.Transcoder
+	Config     *config.TranscodeConfig
+
+	jobs chan uint32
+
+	// queued holds the media in the queue or being transcoded, so it isn't
+	// queued twice. rescan asks for the processing media to be queued again
+	// after the queue overflowed.
+	mu     sync.Mutex
+	queued map[uint32]bool
+	rescan chan struct{}
+}
+
+func NewTranscodeService(db *database.Database, store storage.Storage, images *imageproc.Processor, transcoder transcode.Transcoder, config *config.TranscodeConfig) *TranscodeService {
+	return &TranscodeService{
+		Database:   db,
+		Storage:    store,
+		Images:     images,
+		Transcoder: transcoder,
+		Config:     config,
+		jobs:       make(chan uint32, config.QueueSize),
+		queued:     make(map[uint32]bool),
+		rescan:     make(chan struct{}, 1),
+	}
+}
+
+// mediaKind returns the kind of media with the sniffed content type.
+func mediaKind(contentType string) string {
+	switch {
+	case contentType == "image/gif":
+		return models.MediaKindGIF
+	case strings.HasPrefix(contentType, "video/"):
+		return models.MediaKindVideo
+	case strings.HasPrefix(contentType, "audio/"):
+		return models.MediaKindAudio
+	default:
+		return models.MediaKindImage
+	}
+}
+
+// submit stores the upload of size bytes and creates the media in the
+// processing state, then queues it for transcoding. If an identical upload
+// was transcoded before, the media refers to its blob instead.
+func (ts *TranscodeService) submit(ctx context.Context, media *models.Media, contentType string, src io.Reader, size int64) error {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return err
+	}
+	media.Key = "transcode/" + hex.EncodeToString(random)
+	source := media.VariantKey(models.MediaSourceVariant)
+
+	// Blobs are addressed by the upload, so it's hashed on its way to
+	// storage
+	hash := sha256.New()
+	if err := ts.Storage.Put(ctx, source, io.TeeReader(src, hash), size, contentType); err != nil {
+		return err
+	}
+
+	// Identical uploads share the stored files and skip transcoding
+	created, err := ts.Media.createFromBlob(media, hex.EncodeToString(hash.Sum(nil)))
+	if err == nil && !created {
+		media.Kind = mediaKind(contentType)
+		media.State = models.MediaStateProcessing
+		media.ContentType = contentType
+		media.Size = size
+		err = ts.Database.Conn.Transaction(func(tx *gorm.DB) error {
+			if err := ts.Media.checkQuota(tx, media.UserID, media.Size); err != nil {
+				return err
+			}
+			return tx.Create(media).Error
+		})
+	}
+	if err != nil || created {
+		if err := ts.Storage.Delete(ctx, source); err != nil {
+			log.Println("Failed to delete stored media:", err)
+		}
+		return err
+	}
+
+	ts.enqueue(media.ID)
+	return nil
+}
+
+// enqueue queues the media for transcoding without blocking. If the queue
+// is full, the media stays processing and is queued again by a rescan once
+// there is room.
+func (ts *TranscodeService) enqueue(mediaID uint32) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.queued[mediaID] {
+		return
+	}
+	select {
+	case ts.jobs <- mediaID:
+		ts.queued[mediaID] = true
+	default:
+		log.Println("Transcode queue is full, media", mediaID, "is queued later")
+		select {
+		case ts.rescan <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// start launches the workers and queues media left processing by a
+// previous run.
+func (ts *TranscodeService) start() {
+	for i := 0; i < ts.Config.Workers; i++ {
+		go ts.work()
+	}
+	go ts.feed()
+	ts.rescan <- struct{}{}
+}
+
+// feed queues all processing media whenever a rescan is requested, waiting
+// for room in the queue.
+func (ts *TranscodeService) feed() {
+	for range ts.rescan {
+		var ids []uint32
+		err := ts.Database.Conn.Model(&models.Media{}).
+			Where("state = ?", models.MediaStateProcessing).
+			Order("id").
+			Pluck("id", &ids).Error
+		if err != nil {
+			log.Println("Failed to find media to transcode:", err)
+			continue
+		}
+
+		for _, id := range ids {
+			ts.mu.Lock()
+			queued := ts.queued[id]
+			ts.queued[id] = true
+			ts.mu.Unlock()
+			if !queued {
+				ts.jobs <- id
+			}
+		}
+	}
+}
+
+func (ts *TranscodeService) work() {
+	for mediaID := range ts.jobs {
+		// A hung ffmpeg mustn't hold up the worker for good
+		ctx, cancel := context.WithTimeout(context.Background(), ts.Config.Timeout)
+		if err := ts.process(ctx, mediaID); err != nil {
+			log.Println("Failed to transcode media:", err)
+		}
+		cancel()
+
+		ts.mu.Lock()
+		delete(ts.queued, mediaID)
+		ts.mu.Unlock()
+	}
+}
+
+// process transcodes the media, stores the result as a blob and marks the
+// media as ready. Media that can't be transcoded is marked as failed. Other
+// errors, like storage being unreachable, may pass, so the media is left
+// processing and tried again at the next rescan.
+func (ts *TranscodeService) process(ctx context.Context, mediaID uint32) error {
+	var media models.Media
+	if err := ts.Database.Conn.First(&media, mediaID).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return nil
+		}
+		return err
+	}
+	if media.State != models.MediaStateProcessing {
+		return nil
+	}
+
+	blob, variants, err := ts.transcode(ctx, &media)
+	if err == nil {
+		err = ts.Media.finishWithBlob(ctx, &media, blob, variants)
+	}
+	if err == errMediaGone {
+		return nil
+	}
+	if err != nil {
+		if errors.Is(err, transcode.ErrInvalidMedia) {
+			ts.fail(ctx, &media)
+		}
+		return err
+	}
+
+	// The upload is only kept until it's transcoded
+	if err := ts.Storage.Delete(ctx, media.VariantKey(models.MediaSourceVariant)); err != nil {
+		log.Println("Failed to delete transcoded upload:", err)
+	}
+	return nil
+}
+
+// transcode converts the stored upload of the media into the variants of a
+// blob. Video gets images of its poster frame as the smaller variants.
+func (ts *TranscodeService) transcode(ctx context.Context, media *models.Media) (*models.Blob, []imageproc.Variant, error) {
+	reader, _, err := ts.Storage.Get(ctx, media.VariantKey(models.MediaSourceVariant))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer reader.Close()
+
+	// Blobs are addressed by the upload, so identical uploads are found
+	// before they are transcoded again
+	hash := sha256.New()
+	result, err := ts.Transcoder.Transcode(ctx, io.TeeReader(reader, hash), transcode.Kind(media.Kind))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	blob := &models.Blob{
+		Hash:        hex.EncodeToString(hash.Sum(nil)),
+		Kind:        media.Kind,
+		ContentType: result.ContentType,
+		Size:        int64(len(result.Data)),
+		Width:       result.Width,
+		Height:      result.Height,
+		Duration:    result.Duration.Seconds(),
+	}
+	variants := []imageproc.Variant{{
+		Name:        imageproc.VariantOriginal,
+		Data:        result.Data,
+		ContentType: result.ContentType,
+		Width:       result.Width,
+		Height:      result.Height,
+	}}
+
+	if result.Poster != nil {
+		poster, err := ts.Images.Process(ctx, result.Poster)
+		if errors.Is(err, imageproc.ErrInvalidImage) || errors.Is(err, imageproc.ErrTooManyPixels) {
+			return nil, nil, fmt.Errorf("%w: poster frame: %v", transcode.ErrInvalidMedia, err)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		blob.Blurhash = poster.Blurhash
+		for _, variant := range poster.Variants {
+			if variant.Name != imageproc.VariantOriginal {
+				variants = append(variants, variant)
+			}
+		}
+	}
+
+	return blob, variants, nil
+}
+
+// fail marks the media as failed and removes its upload, which no longer
+// counts towards the user's quota.
+func (ts *TranscodeService) fail(ctx context.Context, media *models.Media) {
+	err := ts.Database.Conn.Model(&models.Media{}).
+		Where("id = ? AND state = ?", media.ID, models.MediaStateProcessing).
+		Updates(map[string]interface{}{"state": models.MediaStateFailed, "size": 0}).Error
+	if err != nil {
+		log.Println("Failed to mark media as failed:", err)
+	}
+
+	if err := ts.Storage.Delete(ctx, media.VariantKey(models.MediaSourceVariant)); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		log.Println("Failed to delete stored media:", err)
+	}
+}
@@ -0,0 +1,224 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwoff11/frens/models"
+	"github.com/bwoff11/frens/pkg/config"
+	"github.com/bwoff11/frens/pkg/database"
+	"github.com/bwoff11/frens/pkg/imageproc"
+	"github.com/bwoff11/frens/pkg/storage"
+	"github.com/bwoff11/frens/pkg/transcode"
+)
+
+// newTestTranscodes creates the media and transcode services on the test
+// database, storing files in a temporary directory and transcoding with
+// fake. The transcode queue holds queueSize media and no workers run until
+// start is called.
+func newTestTranscodes(t *testing.T, db *database.Database, fake *transcode.Fake, queueSize int) (*TranscodeService, storage.Storage) {
+	t.Helper()
+
+	store, err := storage.NewLocal(t.TempDir(), "http://localhost/files", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaConfig := &config.MediaConfig{
+		MaxSize:      1 << 20,
+		AllowedTypes: []string{"video/mp4"},
+		Transcode: config.TranscodeConfig{
+			Transcoder: "fake",
+			Workers:    1,
+			QueueSize:  queueSize,
+			MaxSize:    1 << 20,
+			Timeout:    time.Minute,
+		},
+	}
+	images := imageproc.NewProcessor(&config.ImageConfig{
+		Workers:         1,
+		MaxPixels:       1 << 20,
+		ThumbnailSize:   8,
+		SmallSize:       12,
+		OriginalMaxSize: 16,
+		JPEGQuality:     80,
+	})
+
+	transcodes := NewTranscodeService(db, store, images, fake, &mediaConfig.Transcode)
+	transcodes.Media = &MediaService{
+		Database:   db,
+		Storage:    store,
+		Images:     images,
+		Transcodes: transcodes,
+		Config:     mediaConfig,
+	}
+	return transcodes, store
+}
+
+// createTestUser creates a user with the given name on the test database.
+func createTestUser(t *testing.T, db *database.Database, name string) *models.User {
+	t.Helper()
+
+	user := &models.User{Username: name, Email: name + "@example.com", Password: "x", Role: models.RoleUser}
+	if err := db.Conn.Create(user).Error; err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// waitForMediaState polls the media until it leaves the processing state.
+func waitForMediaState(t *testing.T, db *database.Database, mediaID uint32) *models.Media {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var media models.Media
+		if err := db.Conn.First(&media, mediaID).Error; err != nil {
+			t.Fatal(err)
+		}
+		if media.State != models.MediaStateProcessing {
+			return &media
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("media %d is still processing", mediaID)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestSubmitDoesNotBlock checks that media submitted while the queue is
+// full is queued later instead of blocking the upload, and transcoded once
+// the workers run.
+func TestSubmitDoesNotBlock(t *testing.T) {
+	db := openTestDatabase(t)
+	ts, _ := newTestTranscodes(t, db, &transcode.Fake{}, 0)
+	user := createTestUser(t, db, "uploader")
+
+	var submitted []uint32
+	for _, content := range []string{"first video", "second video"} {
+		media := &models.Media{UserID: user.ID}
+		done := make(chan error, 1)
+		go func() {
+			done <- ts.submit(context.Background(), media, "video/mp4", strings.NewReader(content), int64(len(content)))
+		}()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("submit blocked on the full queue")
+		}
+		submitted = append(submitted, media.ID)
+	}
+
+	ts.start()
+	for _, id := range submitted {
+		if media := waitForMediaState(t, db, id); media.State != models.MediaStateReady {
+			t.Errorf("media %d is %s, want %s", id, media.State, models.MediaStateReady)
+		}
+	}
+}
+
+// TestProcess checks that transcoded video is stored as a blob with the
+// poster frame as its smaller variants, and the upload is removed.
+func TestProcess(t *testing.T) {
+	db := openTestDatabase(t)
+	ts, store := newTestTranscodes(t, db, &transcode.Fake{Width: 32, Height: 24, Duration: 3 * time.Second}, 1)
+	user := createTestUser(t, db, "uploader")
+
+	media := &models.Media{UserID: user.ID}
+	if err := ts.submit(context.Background(), media, "video/mp4", strings.NewReader("a video"), 7); err != nil {
+		t.Fatal(err)
+	}
+	source := media.VariantKey(models.MediaSourceVariant)
+	if err := ts.process(context.Background(), media.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	var ready models.Media
+	if err := db.Conn.First(&ready, media.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if ready.State != models.MediaStateReady || ready.BlobHash == "" {
+		t.Fatalf("media is %s with blob %q, want it ready with a blob", ready.State, ready.BlobHash)
+	}
+	if ready.Width != 32 || ready.Height != 24 || ready.Duration != 3 || ready.Blurhash == "" {
+		t.Errorf("media is %dx%d, %vs, blurhash %q, want 32x24, 3s and a blurhash",
+			ready.Width, ready.Height, ready.Duration, ready.Blurhash)
+	}
+	for _, variant := range models.MediaVariants {
+		if _, err := store.Stat(context.Background(), ready.VariantKey(variant)); err != nil {
+			t.Errorf("variant %s: %v", variant, err)
+		}
+	}
+	if _, err := store.Stat(context.Background(), source); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("the upload is still stored: %v", err)
+	}
+}
+
+// TestProcessFailure checks that media the transcoder rejects is marked as
+// failed and its upload is removed.
+func TestProcessFailure(t *testing.T) {
+	db := openTestDatabase(t)
+	ts, store := newTestTranscodes(t, db, &transcode.Fake{Err: transcode.ErrInvalidMedia}, 1)
+	user := createTestUser(t, db, "uploader")
+
+	media := &models.Media{UserID: user.ID}
+	if err := ts.submit(context.Background(), media, "video/mp4", strings.NewReader("not a video"), 11); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.process(context.Background(), media.ID); err == nil {
+		t.Fatal("process succeeded")
+	}
+
+	var failed models.Media
+	if err := db.Conn.First(&failed, media.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if failed.State != models.MediaStateFailed || failed.Size != 0 {
+		t.Errorf("media is %s with size %d, want %s with size 0", failed.State, failed.Size, models.MediaStateFailed)
+	}
+	if _, err := store.Stat(context.Background(), media.VariantKey(models.MediaSourceVariant)); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("the upload is still stored: %v", err)
+	}
+}
+
+// TestProcessTransientError checks that media is left processing with its
+// upload when transcoding fails for reasons other than the upload itself.
+func TestProcessTransientError(t *testing.T) {
+	db := openTestDatabase(t)
+	fake := &transcode.Fake{Err: errors.New("storage timed out")}
+	ts, store := newTestTranscodes(t, db, fake, 1)
+	user := createTestUser(t, db, "uploader")
+
+	media := &models.Media{UserID: user.ID}
+	if err := ts.submit(context.Background(), media, "video/mp4", strings.NewReader("a video"), 7); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.process(context.Background(), media.ID); err == nil {
+		t.Fatal("process succeeded")
+	}
+
+	var processing models.Media
+	if err := db.Conn.First(&processing, media.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if processing.State != models.MediaStateProcessing || processing.Size == 0 {
+		t.Errorf("media is %s with size %d, want it still %s", processing.State, processing.Size, models.MediaStateProcessing)
+	}
+	if _, err := store.Stat(context.Background(), media.VariantKey(models.MediaSourceVariant)); err != nil {
+		t.Errorf("the upload was removed: %v", err)
+	}
+
+	// Once the problem is gone, the retry succeeds
+	fake.Err = nil
+	if err := ts.process(context.Background(), media.ID); err != nil {
+		t.Fatal(err)
+	}
+	if ready := waitForMediaState(t, db, media.ID); ready.State != models.MediaStateReady {
+		t.Errorf("media is %s, want %s", ready.State, models.MediaStateReady)
+	}
+}
@@ -0,0 +1,421 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwoff11/frens/models"
+	"github.com/bwoff11/frens/pkg/config"
+	"github.com/bwoff11/frens/pkg/database"
+	"github.com/bwoff11/frens/pkg/storage"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/jsonapi"
+	"github.com/jinzhu/gorm"
+)
+
+// TusVersion is the version of the tus resumable upload protocol spoken by
+// the upload routes.
+const TusVersion = "1.0.0"
+
+// UploadService implements resumable uploads with the tus protocol. Chunks
+// are kept in storage until the upload is complete and ingested like any
+// other media.
+type UploadService struct {
+	Database *database.Database
+	Storage  storage.Storage
+	Media    *MediaService
+	Config   *config.UploadConfig
+}
+
+// Options responds with the tus capabilities of the server.
+func (us *UploadService) Options(c *fiber.Ctx) error {
+	c.Set("Tus-Version", TusVersion)
+	c.Set("Tus-Max-Size", strconv.FormatInt(us.Media.maxSize(), 10))
+	c.Set("Tus-Extension", "creation,expiration,termination")
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// Create starts an upload of length bytes.
+func (us *UploadService) Create(c *fiber.Ctx, length int64, description string, sensitive bool) error {
+	// Get the ID of the user making the request
+	userID, err := getRequestorID(c)
+	if err != nil {
+		// Log and handle error here
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to get user ID")
+	}
+
+	if length > us.Media.maxSize() {
+		return c.Status(fiber.StatusRequestEntityTooLarge).SendString("File is too large")
+	}
+
+	// Don't let the user upload something that can't be stored
+	var quotaErr *quotaError
+	if err := us.Media.checkQuota(us.Database.Conn, userID, 1); errors.As(err, &quotaErr) {
+		return writeQuotaError(c, quotaErr)
+	} else if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create the upload",
+		})
+	}
+
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create the upload",
+		})
+	}
+
+	upload := models.Upload{
+		ID:          hex.EncodeToString(random),
+		ExpiresAt:   time.Now().Add(us.Config.Expiry),
+		UserID:      userID,
+		Length:      length,
+		Description: description,
+		Sensitive:   sensitive,
+		State:       models.UploadStateUploading,
+	}
+	if err := us.Database.Conn.Create(&upload).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create the upload",
+		})
+	}
+
+	c.Set(fiber.HeaderLocation, c.BaseURL()+strings.TrimSuffix(c.Path(), "/")+"/"+upload.ID)
+	c.Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	return c.SendStatus(fiber.StatusCreated)
+}
+
+// Head responds with the offset at which the upload continues.
+func (us *UploadService) Head(c *fiber.Ctx, uploadID string) error {
+	upload, err := us.find(c, uploadID)
+	if err != nil || upload == nil {
+		return err
+	}
+
+	c.Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	c.Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	c.Status(fiber.StatusOK)
+	return nil
+}
+
+// Get responds with the upload in JSON:API format. Once complete, it
+// carries the ID of the media item it became.
+func (us *UploadService) Get(c *fiber.Ctx, uploadID string) error {
+	upload, err := us.find(c, uploadID)
+	if err != nil || upload == nil {
+		return err
+	}
+
+	// Set the content type to application/vnd.api+json
+	c.Response().Header.Set(fiber.HeaderContentType, jsonapi.MediaType)
+	c.Status(fiber.StatusOK)
+
+	// Marshal the upload into JSON API format
+	return jsonapi.MarshalPayload(c.Response().BodyWriter(), upload)
+}
+
+// completingTimeout is how long an upload can be completing before another
+// request may take over, e.g. after the process completing it stopped.
+const completingTimeout = 10 * time.Minute
+
+// Append stores a chunk of the upload starting at offset, which must be
+// the current offset of the upload. When the last chunk arrives the upload
+// becomes a media item.
+func (us *UploadService) Append(c *fiber.Ctx, uploadID string, offset int64, chunk []byte) error {
+	// Get the ID of the user making the request
+	userID, err := getRequestorID(c)
+	if err != nil {
+		// Log and handle error here
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to get user ID")
+	}
+
+	ctx := c.UserContext()
+	var upload models.Upload
+	completing := false
+	err = us.Database.Conn.Transaction(func(tx *gorm.DB) error {
+		// Chunks of an upload are appended one at a time
+		err := tx.Set("gorm:query_option", "FOR UPDATE").
+			Where("id = ? AND user_id = ?", uploadID, userID).
+			First(&upload).Error
+		if gorm.IsRecordNotFoundError(err) {
+			return fiber.NewError(fiber.StatusNotFound, "Upload not found")
+		}
+		if err != nil {
+			return err
+		}
+
+		if time.Now().After(upload.ExpiresAt) {
+			return fiber.NewError(fiber.StatusGone, "Upload expired")
+		}
+		if upload.State == models.UploadStateFailed {
+			return fiber.NewError(fiber.StatusConflict, "Upload failed: "+upload.Error)
+		}
+		if upload.State == models.UploadStateCompleting && time.Since(upload.UpdatedAt) < completingTimeout {
+			return fiber.NewError(fiber.StatusConflict, "Upload is being completed")
+		}
+		if upload.MediaID != nil || offset != upload.Offset {
+			return fiber.NewError(fiber.StatusConflict, "Upload offset does not match")
+		}
+		if offset+int64(len(chunk)) > upload.Length {
+			return fiber.NewError(fiber.StatusRequestEntityTooLarge, "Chunk exceeds the upload length")
+		}
+
+		if len(chunk) > 0 {
+			if err := us.Storage.Put(ctx, upload.ChunkKey(offset), bytes.NewReader(chunk), int64(len(chunk)), "application/octet-stream"); err != nil {
+				return err
+			}
+		}
+		if offset+int64(len(chunk)) < upload.Length {
+			upload.Offset += int64(len(chunk))
+			return tx.Model(&upload).Update("upload_offset", upload.Offset).Error
+		}
+
+		// The last chunk is acknowledged once the media item exists. Until
+		// then other requests are turned away.
+		completing = true
+		upload.State = models.UploadStateCompleting
+		return tx.Model(&upload).Update("state", upload.State).Error
+	})
+	if err == nil && completing {
+		err = us.complete(ctx, &upload)
+	}
+
+	var fiberErr *fiber.Error
+	var quotaErr *quotaError
+	switch {
+	case errors.As(err, &fiberErr):
+		return c.Status(fiberErr.Code).SendString(fiberErr.Message)
+	case errors.As(err, &quotaErr):
+		return writeQuotaError(c, quotaErr)
+	case err != nil:
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to store the chunk",
+		})
+	}
+
+	c.Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// complete ingests the chunks of the completing upload as a media item of
+// the uploader. If the file can't become one, the upload fails and its
+// chunks are removed. Other errors leave the last chunk unacknowledged, so
+// it can be sent again once the problem is solved, e.g. space freed up for
+// the quota.
+func (us *UploadService) complete(ctx context.Context, upload *models.Upload) error {
+	media, err := us.ingestChunks(ctx, upload)
+
+	var fiberErr *fiber.Error
+	if errors.As(err, &fiberErr) {
+		upload.State = models.UploadStateFailed
+		upload.Error = fiberErr.Message
+		if err := us.Database.Conn.Model(upload).Updates(map[string]interface{}{
+			"state": upload.State,
+			"error": upload.Error,
+		}).Error; err != nil {
+			log.Println("Failed to mark the upload as failed:", err)
+		}
+		us.deleteChunks(ctx, upload)
+		return err
+	}
+	if err != nil {
+		if err := us.Database.Conn.Model(upload).Update("state", models.UploadStateUploading).Error; err != nil {
+			log.Println("Failed to reset the upload:", err)
+		}
+		return err
+	}
+
+	upload.Offset = upload.Length
+	upload.State = models.UploadStateComplete
+	upload.MediaID = &media.ID
+	if err := us.Database.Conn.Model(upload).Updates(map[string]interface{}{
+		"upload_offset": upload.Offset,
+		"state":         upload.State,
+		"media_id":      media.ID,
+	}).Error; err != nil {
+		// The media item is unused and removed by the garbage collector
+		return err
+	}
+
+	// The chunks are only needed until the media item exists
+	us.deleteChunks(ctx, upload)
+	return nil
+}
+
+// ingestChunks streams the chunks of the upload, in order, into a new media
+// item of the uploader.
+func (us *UploadService) ingestChunks(ctx context.Context, upload *models.Upload) (*models.Media, error) {
+	var objects []storage.Object
+	err := us.Storage.List(ctx, upload.Key()+"/", func(object storage.Object) error {
+		objects = append(objects, object)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+
+	var size int64
+	for _, object := range objects {
+		size += object.Size
+	}
+	if size != upload.Length {
+		return nil, errors.New("stored chunks don't add up to the upload length")
+	}
+
+	// Each chunk is opened when the previous one is exhausted
+	readers := make([]io.Reader, len(objects))
+	for i := range objects {
+		readers[i] = &chunkReader{ctx: ctx, storage: us.Storage, key: objects[i].Key}
+	}
+	defer func() {
+		for _, reader := range readers {
+			reader.(*chunkReader).Close()
+		}
+	}()
+	return us.Media.ingest(ctx, upload.UserID, io.MultiReader(readers...), size, upload.Description, upload.Sensitive)
+}
+
+// chunkReader reads a stored chunk, opening it on the first read.
+type chunkReader struct {
+	ctx     context.Context
+	storage storage.Storage
+	key     string
+	reader  io.ReadCloser
+	done    bool
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	if cr.done {
+		return 0, io.EOF
+	}
+	if cr.reader == nil {
+		reader, _, err := cr.storage.Get(cr.ctx, cr.key)
+		if err != nil {
+			return 0, err
+		}
+		cr.reader = reader
+	}
+
+	n, err := cr.reader.Read(p)
+	if err == io.EOF {
+		// Don't hold on to the connection until all chunks are read
+		cr.done = true
+		cr.Close()
+	}
+	return n, err
+}
+
+func (cr *chunkReader) Close() error {
+	if cr.reader == nil {
+		return nil
+	}
+	err := cr.reader.Close()
+	cr.reader = nil
+	return err
+}
+
+// Terminate cancels the upload and removes its chunks.
+func (us *UploadService) Terminate(c *fiber.Ctx, uploadID string) error {
+	upload, err := us.find(c, uploadID)
+	if err != nil || upload == nil {
+		return err
+	}
+
+	if err := us.Database.Conn.Delete(upload).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete the upload",
+		})
+	}
+	us.deleteChunks(c.UserContext(), upload)
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// find loads an unexpired upload of the user making the request. If there
+// is none, the response has already been written and nil is returned.
+func (us *UploadService) find(c *fiber.Ctx, uploadID string) (*models.Upload, error) {
+	userID, err := getRequestorID(c)
+	if err != nil {
+		return nil, err
+	}
+
+	var upload models.Upload
+	if err := us.Database.Conn.Where("id = ? AND user_id = ?", uploadID, userID).First(&upload).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return nil, c.Status(fiber.StatusNotFound).SendString("Upload not found")
+		}
+		return nil, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get the upload",
+		})
+	}
+	if time.Now().After(upload.ExpiresAt) {
+		return nil, c.Status(fiber.StatusGone).SendString("Upload expired")
+	}
+	return &upload, nil
+}
+
+// deleteChunks removes the stored chunks of the upload.
+func (us *UploadService) deleteChunks(ctx context.Context, upload *models.Upload) {
+	err := us.Storage.List(ctx, upload.Key()+"/", func(object storage.Object) error {
+		return us.Storage.Delete(ctx, object.Key)
+	})
+	if err != nil {
+		log.Println("Failed to delete upload chunks:", err)
+	}
+}
+
+func (us *UploadService) cleanupLoop() {
+	ticker := time.NewTicker(us.Config.CleanupInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := us.expire(context.Background()); err != nil {
+			log.Println("Failed to remove expired uploads:", err)
+		}
+	}
+}
+
+// expire removes expired uploads along with their chunks.
+func (us *UploadService) expire(ctx context.Context) error {
+	const batchSize = 100
+	for {
+		var batch []models.Upload
+		err := us.Database.Conn.
+			Where("expires_at < ?", time.Now()).
+			Limit(batchSize).
+			Find(&batch).Error
+		if err != nil {
+			return err
+		}
+
+		for i := range batch {
+			us.deleteChunks(ctx, &batch[i])
+			if err := us.Database.Conn.Delete(&batch[i]).Error; err != nil {
+				return err
+			}
+		}
+
+		if len(batch) < batchSize {
+			return nil
+		}
+	}
+}
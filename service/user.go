@@ -1,5 +1,103 @@
 package service
 
-import "github.com/bwoff11/frens/pkg/database"
+import (
+	"log"
+
+	"github.com/bwoff11/frens/models"
+	"github.com/bwoff11/frens/pkg/database"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/jsonapi"
+)
 
 type UserService struct{ Database *database.Database }
+
+// RequireAdmin is a handler that only lets admins through to the next one.
+func (us *UserService) RequireAdmin(c *fiber.Ctx) error {
+	// Get the ID of the user making the request
+	userID, err := getRequestorID(c)
+	if err != nil {
+		// Log and handle error here
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to get user ID")
+	}
+
+	var user models.User
+	if err := us.Database.Conn.Select("role").First(&user, userID).Error; err != nil {
+		return c.Status(fiber.StatusUnauthorized).SendString("User not found")
+	}
+	if user.Role != models.RoleAdmin {
+		return c.Status(fiber.StatusForbidden).SendString("Admins only")
+	}
+
+	return c.Next()
+}
+
+// PromoteAdmins makes the users with the given usernames admins. Usernames
+// that aren't registered are logged and skipped, so registering one later
+// doesn't make anyone an admin until the next start.
+func (us *UserService) PromoteAdmins(usernames []string) error {
+	if len(usernames) == 0 {
+		return nil
+	}
+
+	var found []string
+	if err := us.Database.Conn.Model(&models.User{}).
+		Where("username IN (?)", usernames).
+		Pluck("username", &found).Error; err != nil {
+		return err
+	}
+	registered := make(map[string]bool, len(found))
+	for _, username := range found {
+		registered[username] = true
+	}
+	for _, username := range usernames {
+		if !registered[username] {
+			log.Printf("Admin %q is not registered", username)
+		}
+	}
+
+	return us.Database.Conn.Model(&models.User{}).
+		Where("username IN (?) AND role <> ?", usernames, models.RoleAdmin).
+		UpdateColumn("role", models.RoleAdmin).Error
+}
+
+// UpdateMe changes the settings of the user making the request. Settings
+// that are nil are left unchanged.
+func (us *UserService) UpdateMe(c *fiber.Ctx, likesPrivacy *string) error {
+	// Get the ID of the user making the request
+	userID, err := getRequestorID(c)
+	if err != nil {
+		// Log and handle error here
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to get user ID")
+	}
+
+	var user models.User
+	if err := us.Database.Conn.First(&user, userID).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).SendString("User not found")
+	}
+
+	updates := map[string]interface{}{}
+	if likesPrivacy != nil {
+		updates["likes_privacy"] = *likesPrivacy
+	}
+	if len(updates) > 0 {
+		if err := us.Database.Conn.Model(&user).Updates(updates).Error; err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to update the user",
+			})
+		}
+	}
+
+	// Set the content type to application/vnd.api+json
+	c.Response().Header.Set(fiber.HeaderContentType, jsonapi.MediaType)
+	c.Status(fiber.StatusOK)
+
+	// Marshal the user into JSON API format
+	if err := jsonapi.MarshalPayload(c.Response().BodyWriter(), &user); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to marshal the user",
+		})
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package service
+
+import (
+	"github.com/bwoff11/frens/models"
+	"github.com/bwoff11/frens/pkg/database"
+	"github.com/jinzhu/gorm"
+)
+
+// VisibilityPolicy decides which posts a viewer is allowed to see. Every
+// query that returns posts and every mutation that acts on a post should go
+// through it so privacy levels are enforced in one place.
+type VisibilityPolicy struct{ Database *database.Database }
+
+// Relationship describes how a viewer relates to the author of a post.
+type Relationship struct {
+	IsAuthor bool // the viewer wrote the post
+	Follows  bool // the viewer follows the author
+	Blocked  bool // either side has blocked the other
+}
+
+// canView applies the privacy rules to a single viewer/author relationship.
+// Unknown privacy levels are treated as private.
+func canView(rel Relationship, privacy string) bool {
+	if rel.IsAuthor {
+		return true
+	}
+	if rel.Blocked {
+		return false
+	}
+
+	switch privacy {
+	case models.PrivacyPublic:
+		return true
+	case models.PrivacyProtected:
+		return rel.Follows
+	default:
+		return false
+	}
+}
+
+// Relationship looks up how the viewer relates to the given author. A viewer
+// ID of zero represents an anonymous viewer.
+func (vp *VisibilityPolicy) Relationship(viewerID, authorID uint32) (Relationship, error) {
+	var rel Relationship
+	if viewerID == 0 {
+		return rel, nil
+	}
+	if viewerID == authorID {
+		rel.IsAuthor = true
+		return rel, nil
+	}
+
+	var blocks int
+	if err := vp.Database.Conn.Model(&models.Block{}).
+		Where("(user_id = ? AND blocked_id = ?) OR (user_id = ? AND blocked_id = ?)", viewerID, authorID, authorID, viewerID).
+		Count(&blocks).Error; err != nil {
+		return rel, err
+	}
+	rel.Blocked = blocks > 0
+
+	var follows int
+	if err := vp.Database.Conn.Model(&models.Follow{}).
+		Where("user_id = ? AND followed_id = ?", viewerID, authorID).
+		Count(&follows).Error; err != nil {
+		return rel, err
+	}
+	rel.Follows = follows > 0
+
+	return rel, nil
+}
+
+// CanView reports whether the viewer may see the post.
+func (vp *VisibilityPolicy) CanView(viewerID uint32, post *models.Post) (bool, error) {
+	rel, err := vp.Relationship(viewerID, post.UserID)
+	if err != nil {
+		return false, err
+	}
+	return canView(rel, post.Privacy), nil
+}
+
+// Scope restricts a query on the posts table to the posts the viewer may
+// see. It mirrors canView in SQL so it can be used with gorm's Scopes.
+func (vp *VisibilityPolicy) Scope(viewerID uint32) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		if viewerID == 0 {
+			return db.Where("posts.privacy = ?", models.PrivacyPublic)
+		}
+
+		return db.Where(`posts.user_id = ? OR (
+			posts.user_id NOT IN (SELECT blocked_id FROM blocks WHERE user_id = ?) AND
+			posts.user_id NOT IN (SELECT user_id FROM blocks WHERE blocked_id = ?) AND (
+				posts.privacy = ? OR
+				(posts.privacy = ? AND posts.user_id IN (SELECT followed_id FROM follows WHERE user_id = ?))
+			)
+		)`, viewerID, viewerID, viewerID, models.PrivacyPublic, models.PrivacyProtected, viewerID)
+	}
+}
+
+// CanViewLikes reports whether the viewer may list the posts the user liked.
+func (vp *VisibilityPolicy) CanViewLikes(viewerID uint32, user *models.User) (bool, error) {
+	rel, err := vp.Relationship(viewerID, user.ID)
+	if err != nil {
+		return false, err
+	}
+	return canView(rel, user.LikesPrivacy), nil
+}
@@ -0,0 +1,108 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/bwoff11/frens/models"
+)
+
+func TestCanView(t *testing.T) {
+	viewers := []struct {
+		name string
+		rel  Relationship
+	}{
+		{"author", Relationship{IsAuthor: true}},
+		{"follower", Relationship{Follows: true}},
+		{"stranger", Relationship{}},
+		{"blocked", Relationship{Blocked: true}},
+		{"blocked follower", Relationship{Follows: true, Blocked: true}},
+	}
+	want := map[string]map[string]bool{
+		"author":           {models.PrivacyPublic: true, models.PrivacyProtected: true, models.PrivacyPrivate: true},
+		"follower":         {models.PrivacyPublic: true, models.PrivacyProtected: true, models.PrivacyPrivate: false},
+		"stranger":         {models.PrivacyPublic: true, models.PrivacyProtected: false, models.PrivacyPrivate: false},
+		"blocked":          {models.PrivacyPublic: false, models.PrivacyProtected: false, models.PrivacyPrivate: false},
+		"blocked follower": {models.PrivacyPublic: false, models.PrivacyProtected: false, models.PrivacyPrivate: false},
+	}
+
+	for _, viewer := range viewers {
+		for _, privacy := range []string{models.PrivacyPublic, models.PrivacyProtected, models.PrivacyPrivate} {
+			t.Run(viewer.name+"/"+privacy, func(t *testing.T) {
+				if got := canView(viewer.rel, privacy); got != want[viewer.name][privacy] {
+					t.Errorf("canView = %v, want %v", got, want[viewer.name][privacy])
+				}
+			})
+		}
+	}
+
+	// Unknown levels are treated as private
+	if canView(Relationship{Follows: true}, "friends") {
+		t.Error("a follower can view a post with an unknown privacy level")
+	}
+}
+
+// TestScopeMatchesCanView checks that the SQL of Scope lets through exactly
+// the posts canView allows, for every relationship and privacy level.
+func TestScopeMatchesCanView(t *testing.T) {
+	db := openTestDatabase(t)
+	vp := &VisibilityPolicy{Database: db}
+
+	users := map[string]*models.User{}
+	for _, name := range []string{"author", "follower", "stranger", "blocked", "blocker"} {
+		user := &models.User{Username: name, Email: name + "@example.com", Password: "x", Role: models.RoleUser}
+		if err := db.Conn.Create(user).Error; err != nil {
+			t.Fatal(err)
+		}
+		users[name] = user
+	}
+	author := users["author"]
+	for _, row := range []interface{}{
+		&models.Follow{UserID: users["follower"].ID, FollowedID: author.ID},
+		&models.Follow{UserID: users["blocked"].ID, FollowedID: author.ID},
+		&models.Block{UserID: author.ID, BlockedID: users["blocked"].ID},
+		&models.Block{UserID: users["blocker"].ID, BlockedID: author.ID},
+	} {
+		if err := db.Conn.Create(row).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var posts []*models.Post
+	for _, privacy := range []string{models.PrivacyPublic, models.PrivacyProtected, models.PrivacyPrivate} {
+		post := &models.Post{UserID: author.ID, Text: privacy, Privacy: privacy}
+		if err := db.Conn.Create(post).Error; err != nil {
+			t.Fatal(err)
+		}
+		posts = append(posts, post)
+	}
+
+	viewerIDs := map[string]uint32{"anonymous": 0}
+	for name, user := range users {
+		viewerIDs[name] = user.ID
+	}
+	for name, viewerID := range viewerIDs {
+		t.Run(name, func(t *testing.T) {
+			var scoped []*models.Post
+			if err := db.Conn.Scopes(vp.Scope(viewerID)).Where("posts.user_id = ?", author.ID).Find(&scoped).Error; err != nil {
+				t.Fatal(err)
+			}
+			got := map[uint32]bool{}
+			for _, post := range scoped {
+				got[post.ID] = true
+			}
+
+			for _, post := range posts {
+				allowed, err := vp.CanView(viewerID, post)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got[post.ID] != allowed {
+					t.Errorf("%s post: Scope returns it = %v, CanView = %v", post.Privacy, got[post.ID], allowed)
+				}
+			}
+			if len(got) > len(posts) {
+				t.Errorf("Scope returned %d posts, want at most %d", len(got), len(posts))
+			}
+		})
+	}
+}
@@ -0,0 +1,704 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/bwoff11/frens/models"
+	"github.com/bwoff11/frens/pkg/config"
+	"github.com/bwoff11/frens/pkg/database"
+	"github.com/bwoff11/frens/pkg/events"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/jsonapi"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+)
+
+// WebhookService manages webhooks and delivers events to them. Deliveries
+// are queued in the database, so they survive restarts, and are sent by
+// workers that retry failed ones with exponential backoff. Events only reach
+// the database through the in-memory event bus though, which drops them
+// when it falls behind and loses those not handled yet on shutdown, so
+// delivery is best-effort.
+type WebhookService struct {
+	Database *database.Database
+	Events   events.Bus
+	Views    *PostViews
+	Config   *config.WebhooksConfig
+
+	client *http.Client
+	wake   chan struct{}
+}
+
+// webhookEvents are the event types webhooks can be registered for.
+// User webhooks can't receive the ones that aren't about a single user's
+// activity.
+var webhookEvents = map[events.Type]bool{
+	events.PostCreated:    false,
+	events.PostLiked:      false,
+	events.PostReacted:    false,
+	events.UserFollowed:   false,
+	events.UserRegistered: true,
+}
+
+// WebhookEvent is the payload of a delivery. The ID is unique per event, so
+// receivers can recognize events delivered again after a failure.
+type WebhookEvent struct {
+	ID        string       `jsonapi:"primary,webhook-event"`
+	Event     string       `jsonapi:"attr,event"`
+	CreatedAt time.Time    `jsonapi:"attr,createdAt"`
+	Emoji     string       `jsonapi:"attr,emoji,omitempty"`
+	Actor     *models.User `jsonapi:"relation,actor,omitempty"`
+	Post      *models.Post `jsonapi:"relation,post,omitempty"`
+	User      *models.User `jsonapi:"relation,user,omitempty"`
+}
+
+// WebhookChanges changes a webhook. Nil fields are left as they are.
+// Activating a webhook resets its failure count.
+type WebhookChanges struct {
+	URL    *string
+	Events []string
+	Active *bool
+}
+
+// Headers of deliveries. The signature is the hex encoded HMAC-SHA256 of
+// the timestamp, a dot and the body, keyed with the webhook's secret.
+const (
+	webhookEventHeader     = "X-Frens-Event"
+	webhookDeliveryHeader  = "X-Frens-Delivery"
+	webhookTimestampHeader = "X-Frens-Timestamp"
+	webhookSignatureHeader = "X-Frens-Signature"
+)
+
+// maxWebhookError is how much of a failed attempt's error is logged, in
+// characters.
+const maxWebhookError = 500
+
+var errPrivateAddress = errors.New("private addresses can't be reached")
+
+func NewWebhookService(db *database.Database, bus events.Bus, views *PostViews, config *config.WebhooksConfig) *WebhookService {
+	dialer := &net.Dialer{Timeout: config.Timeout}
+	if !config.AllowPrivateNetworks {
+		dialer.Control = refusePrivateAddresses
+	}
+	// Proxies would connect on the webhook's behalf, past the check
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &WebhookService{
+		Database: db,
+		Events:   bus,
+		Views:    views,
+		Config:   config,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   config.Timeout,
+			// Redirects count as failures instead of being followed
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		wake: make(chan struct{}, config.Workers),
+	}
+}
+
+// refusePrivateAddresses keeps webhooks and pushes from reaching the network
+// the server runs in. It checks the address actually dialed, so host names
+// resolving to private addresses are refused too.
+func refusePrivateAddresses(network, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return errPrivateAddress
+	}
+	return nil
+}
+
+// List returns the webhooks of the user making the request, or the instance
+// webhooks.
+func (ws *WebhookService) List(c *fiber.Ctx, instance bool) error {
+	// Get the ID of the user making the request
+	userID, err := getRequestorID(c)
+	if err != nil {
+		// Log and handle error here
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to get user ID")
+	}
+
+	var webhooks []*models.Webhook
+	if err := ownedWebhooks(ws.Database.Conn, userID, instance).Order("id").Find(&webhooks).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get the webhooks",
+		})
+	}
+
+	// Set the content type to application/vnd.api+json
+	c.Response().Header.Set(fiber.HeaderContentType, jsonapi.MediaType)
+	c.Status(fiber.StatusOK)
+
+	// Marshal the webhooks into JSON API format
+	if err := jsonapi.MarshalPayload(c.Response().BodyWriter(), webhooks); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to marshal the webhooks",
+		})
+	}
+	return nil
+}
+
+// Create registers a webhook for the event types. The response has the
+// secret payloads are signed with, which isn't returned again.
+func (ws *WebhookService) Create(c *fiber.Ctx, instance bool, url string, types []string) error {
+	// Get the ID of the user making the request
+	userID, err := getRequestorID(c)
+	if err != nil {
+		// Log and handle error here
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to get user ID")
+	}
+
+	types, err = checkWebhookEvents(types, instance)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create the webhook",
+		})
+	}
+
+	webhook := models.Webhook{
+		UserID:   userID,
+		Instance: instance,
+		URL:      url,
+		Events:   pq.StringArray(types),
+		Secret:   secret,
+		Active:   true,
+	}
+	limited := false
+	err = ws.Database.Conn.Transaction(func(tx *gorm.DB) error {
+		// Lock the user so concurrent requests can't exceed the limit
+		if !instance {
+			if err := tx.Set("gorm:query_option", "FOR UPDATE").Select("id").First(&models.User{}, userID).Error; err != nil {
+				return err
+			}
+			var count int
+			if err := ownedWebhooks(tx, userID, false).Model(&models.Webhook{}).Count(&count).Error; err != nil {
+				return err
+			}
+			if limited = count >= ws.Config.MaxPerUser; limited {
+				return nil
+			}
+		}
+		return tx.Create(&webhook).Error
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create the webhook",
+		})
+	}
+	if limited {
+		return c.Status(fiber.StatusForbidden).SendString(fmt.Sprintf("You can't register more than %d webhooks", ws.Config.MaxPerUser))
+	}
+
+	webhook.SigningSecret = secret
+	return writeWebhook(c, fiber.StatusCreated, &webhook)
+}
+
+// Update changes a webhook of the user making the request, or an instance
+// webhook.
+func (ws *WebhookService) Update(c *fiber.Ctx, instance bool, webhookID uint32, changes WebhookChanges) error {
+	// Get the ID of the user making the request
+	userID, err := getRequestorID(c)
+	if err != nil {
+		// Log and handle error here
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to get user ID")
+	}
+
+	if changes.Events != nil {
+		if changes.Events, err = checkWebhookEvents(changes.Events, instance); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+	}
+
+	var webhook models.Webhook
+	err = ws.Database.Conn.Transaction(func(tx *gorm.DB) error {
+		if err := ownedWebhooks(tx, userID, instance).Set("gorm:query_option", "FOR UPDATE").First(&webhook, webhookID).Error; err != nil {
+			return err
+		}
+
+		if changes.URL != nil {
+			webhook.URL = *changes.URL
+		}
+		if changes.Events != nil {
+			webhook.Events = pq.StringArray(changes.Events)
+		}
+		if changes.Active != nil {
+			if *changes.Active && !webhook.Active {
+				webhook.FailureCount = 0
+				webhook.DisabledAt = nil
+			}
+			webhook.Active = *changes.Active
+		}
+		return tx.Save(&webhook).Error
+	})
+	if gorm.IsRecordNotFoundError(err) {
+		return c.Status(fiber.StatusNotFound).SendString("Webhook not found")
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update the webhook",
+		})
+	}
+
+	// Deliveries held back while it was disabled are due again
+	if webhook.Active {
+		ws.notify()
+	}
+	return writeWebhook(c, fiber.StatusOK, &webhook)
+}
+
+// Delete removes a webhook of the user making the request, or an instance
+// webhook, with its deliveries.
+func (ws *WebhookService) Delete(c *fiber.Ctx, instance bool, webhookID uint32) error {
+	// Get the ID of the user making the request
+	userID, err := getRequestorID(c)
+	if err != nil {
+		// Log and handle error here
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to get user ID")
+	}
+
+	err = ws.Database.Conn.Transaction(func(tx *gorm.DB) error {
+		var webhook models.Webhook
+		if err := ownedWebhooks(tx, userID, instance).Set("gorm:query_option", "FOR UPDATE").First(&webhook, webhookID).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("webhook_id = ?", webhook.ID).Delete(&models.WebhookDelivery{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&webhook).Error
+	})
+	if gorm.IsRecordNotFoundError(err) {
+		return c.Status(fiber.StatusNotFound).SendString("Webhook not found")
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete the webhook",
+		})
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// Deliveries lists the deliveries of a webhook of the user making the
+// request, or of an instance webhook, the most recent first.
+func (ws *WebhookService) Deliveries(c *fiber.Ctx, instance bool, webhookID uint32, page Page) error {
+	// Get the ID of the user making the request
+	userID, err := getRequestorID(c)
+	if err != nil {
+		// Log and handle error here
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to get user ID")
+	}
+
+	var webhook models.Webhook
+	if err := ownedWebhooks(ws.Database.Conn, userID, instance).Select("id").First(&webhook, webhookID).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return c.Status(fiber.StatusNotFound).SendString("Webhook not found")
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get the webhook",
+		})
+	}
+
+	query := ws.Database.Conn.Where("webhook_deliveries.webhook_id = ?", webhook.ID)
+	deliveries, next, prev, err := paginate(query, page, "webhook_deliveries.created_at", "webhook_deliveries.id",
+		func(d *models.WebhookDelivery) (time.Time, uint32) { return d.CreatedAt, d.ID })
+	if err == errInvalidCursor {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid cursor parameter")
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get the deliveries",
+		})
+	}
+
+	return writePage(c, deliveries, next, prev)
+}
+
+// ownedWebhooks restricts a query to the webhooks the user manages: their
+// own user webhooks, or all instance webhooks, which every admin manages.
+func ownedWebhooks(db *gorm.DB, userID uint32, instance bool) *gorm.DB {
+	if instance {
+		return db.Where("instance")
+	}
+	return db.Where("user_id = ? AND NOT instance", userID)
+}
+
+// checkWebhookEvents removes duplicates from the event types and checks
+// that the webhook can receive them.
+func checkWebhookEvents(types []string, instance bool) ([]string, error) {
+	seen := make(map[string]bool, len(types))
+	unique := make([]string, 0, len(types))
+	for _, t := range types {
+		instanceOnly, ok := webhookEvents[events.Type(t)]
+		if !ok {
+			return nil, fmt.Errorf("Webhooks can't receive %s events", t)
+		}
+		if instanceOnly && !instance {
+			return nil, fmt.Errorf("Only instance webhooks can receive %s events", t)
+		}
+		if !seen[t] {
+			seen[t] = true
+			unique = append(unique, t)
+		}
+	}
+	return unique, nil
+}
+
+func writeWebhook(c *fiber.Ctx, status int, webhook *models.Webhook) error {
+	// Set the content type to application/vnd.api+json
+	c.Response().Header.Set(fiber.HeaderContentType, jsonapi.MediaType)
+	c.Status(status)
+
+	// Marshal the webhook into JSON API format
+	if err := jsonapi.MarshalPayload(c.Response().BodyWriter(), webhook); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to marshal the webhook",
+		})
+	}
+	return nil
+}
+
+// signWebhook signs a delivery's body as sent at the timestamp.
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte{'.'})
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func randomHex(size int) (string, error) {
+	random := make([]byte, size)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(random), nil
+}
+
+// start launches the workers and the cleanup of the delivery log, and
+// subscribes to the events webhooks can receive.
+func (ws *WebhookService) start() {
+	for i := 0; i < ws.Config.Workers; i++ {
+		go ws.work()
+	}
+	go ws.cleanupLoop()
+
+	types := make([]events.Type, 0, len(webhookEvents))
+	for t := range webhookEvents {
+		types = append(types, t)
+	}
+	ws.Events.Subscribe("webhooks", ws.handle, types...)
+}
+
+// handle queues a delivery of the event for every active webhook that
+// receives it: instance webhooks of its type, and user webhooks of the
+// users involved, unless they blocked the actor. Signed URLs would expire
+// before late retries are sent, so media of posts that aren't public is
+// sent without URLs.
+func (ws *WebhookService) handle(event events.Event) {
+	payload := WebhookEvent{Event: string(event.Type), CreatedAt: event.Time, Emoji: event.Emoji}
+	involved := []uint32{event.ActorID}
+
+	switch event.Type {
+	case events.PostCreated, events.PostLiked, events.PostReacted:
+		var post models.Post
+		if err := ws.Database.Conn.Preload("User").Preload("Media").First(&post, event.PostID).Error; err != nil {
+			if !gorm.IsRecordNotFoundError(err) {
+				log.Println("Failed to get the post of a webhook event:", err)
+			}
+			return
+		}
+		payload.Post = &post
+		involved = append(involved, post.UserID)
+	case events.UserFollowed:
+		var user models.User
+		if err := ws.Database.Conn.First(&user, event.UserID).Error; err != nil {
+			log.Println("Failed to get the user of a webhook event:", err)
+			return
+		}
+		payload.User = &user
+		involved = append(involved, user.ID)
+	}
+
+	var webhooks []models.Webhook
+	err := ws.Database.Conn.
+		Where("active AND ? = ANY(events)", string(event.Type)).
+		Where("instance OR (user_id IN (?) AND user_id NOT IN (SELECT user_id FROM blocks WHERE blocked_id = ?))", involved, event.ActorID).
+		Find(&webhooks).Error
+	if err != nil {
+		log.Println("Failed to get the webhooks of an event:", err)
+		return
+	}
+	if len(webhooks) == 0 {
+		return
+	}
+
+	var actor models.User
+	if err := ws.Database.Conn.First(&actor, event.ActorID).Error; err != nil {
+		log.Println("Failed to get the actor of a webhook event:", err)
+		return
+	}
+	payload.Actor = &actor
+	if payload.Post != nil {
+		if payload.Post.Privacy != models.PrivacyPublic {
+			for _, media := range payload.Post.Media {
+				media.URL, media.PreviewURL, media.ThumbnailURL = "", "", ""
+			}
+		}
+		if err := ws.Views.PrepareFor(context.Background(), 0, payload.Post); err != nil {
+			log.Println("Failed to prepare the post of a webhook event:", err)
+			return
+		}
+	}
+
+	if payload.ID, err = randomHex(16); err != nil {
+		log.Println("Failed to create a webhook event ID:", err)
+		return
+	}
+	var body bytes.Buffer
+	if err := jsonapi.MarshalPayload(&body, &payload); err != nil {
+		log.Println("Failed to marshal a webhook event:", err)
+		return
+	}
+
+	now := time.Now()
+	err = ws.Database.Conn.Transaction(func(tx *gorm.DB) error {
+		for _, webhook := range webhooks {
+			if err := tx.Create(&models.WebhookDelivery{
+				WebhookID:     webhook.ID,
+				EventID:       payload.ID,
+				Event:         payload.Event,
+				Payload:       body.String(),
+				Status:        models.DeliveryPending,
+				NextAttemptAt: now,
+			}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("Failed to queue webhook deliveries:", err)
+		return
+	}
+	ws.notify()
+}
+
+// notify wakes the idle workers to look for due deliveries.
+func (ws *WebhookService) notify() {
+	for i := 0; i < ws.Config.Workers; i++ {
+		select {
+		case ws.wake <- struct{}{}:
+		default:
+			return
+		}
+	}
+}
+
+// claimDelivery takes the next due delivery of an active webhook. Its next
+// attempt is pushed back past the time it takes to send it, so no other
+// worker or process takes it meanwhile, and it is tried again if this one
+// dies before recording the outcome.
+const claimDelivery = `
+	UPDATE webhook_deliveries SET next_attempt_at = ?
+	WHERE id = (
+		SELECT webhook_deliveries.id FROM webhook_deliveries
+		JOIN webhooks ON webhooks.id = webhook_deliveries.webhook_id
+		WHERE webhook_deliveries.status = ? AND webhook_deliveries.next_attempt_at <= ? AND webhooks.active
+		ORDER BY webhook_deliveries.next_attempt_at
+		LIMIT 1
+		FOR UPDATE OF webhook_deliveries SKIP LOCKED
+	)
+	RETURNING id`
+
+func (ws *WebhookService) work() {
+	for {
+		now := time.Now()
+		var deliveryID uint32
+		err := ws.Database.Conn.Raw(claimDelivery, now.Add(2*ws.Config.Timeout), models.DeliveryPending, now).Row().Scan(&deliveryID)
+		if err == nil {
+			if err := ws.deliver(deliveryID); err != nil {
+				log.Println("Failed to deliver a webhook:", err)
+			}
+			continue
+		}
+		if err != sql.ErrNoRows {
+			log.Println("Failed to claim a webhook delivery:", err)
+		}
+
+		select {
+		case <-ws.wake:
+		case <-time.After(ws.Config.PollInterval):
+		}
+	}
+}
+
+// deliver sends a claimed delivery and records the outcome. Failed
+// deliveries are scheduled again until they run out of attempts, and count
+// towards disabling the webhook.
+func (ws *WebhookService) deliver(deliveryID uint32) error {
+	var delivery models.WebhookDelivery
+	if err := ws.Database.Conn.First(&delivery, deliveryID).Error; err != nil {
+		return err
+	}
+	var webhook models.Webhook
+	if err := ws.Database.Conn.First(&webhook, delivery.WebhookID).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return nil
+		}
+		return err
+	}
+
+	status, sendErr := ws.send(&webhook, &delivery)
+
+	// Only the outcome is written, so a delivery deleted with its webhook
+	// meanwhile stays deleted
+	now := time.Now()
+	attempts := delivery.Attempts + 1
+	updates := map[string]interface{}{
+		"attempts":        attempts,
+		"last_attempt_at": now,
+		"response_status": status,
+		"error":           "",
+	}
+	switch {
+	case sendErr == nil:
+		updates["status"] = models.DeliverySucceeded
+	case attempts >= ws.Config.MaxAttempts:
+		updates["status"] = models.DeliveryFailed
+		updates["error"] = truncate(sendErr.Error(), maxWebhookError)
+	default:
+		updates["next_attempt_at"] = now.Add(ws.backoff(attempts))
+		updates["error"] = truncate(sendErr.Error(), maxWebhookError)
+	}
+	if err := ws.Database.Conn.Model(&delivery).Updates(updates).Error; err != nil {
+		return err
+	}
+
+	if sendErr == nil {
+		return ws.Database.Conn.Model(&models.Webhook{}).
+			Where("id = ? AND failure_count > 0", webhook.ID).
+			UpdateColumn("failure_count", 0).Error
+	}
+	return ws.recordFailure(webhook.ID, now)
+}
+
+// recordFailure counts a failed attempt of the webhook and disables it once
+// too many failed in a row. Its pending deliveries wait until it is enabled
+// again.
+func (ws *WebhookService) recordFailure(webhookID uint32, now time.Time) error {
+	var active bool
+	var failures int
+	err := ws.Database.Conn.Raw(`
+		UPDATE webhooks SET
+			failure_count = failure_count + 1,
+			active = active AND failure_count + 1 < ?,
+			disabled_at = CASE WHEN active AND failure_count + 1 >= ? THEN ? ELSE disabled_at END
+		WHERE id = ?
+		RETURNING active, failure_count`,
+		ws.Config.DisableAfter, ws.Config.DisableAfter, now, webhookID).Row().Scan(&active, &failures)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !active && failures == ws.Config.DisableAfter {
+		log.Printf("Disabled webhook %d after %d failed deliveries in a row", webhookID, failures)
+	}
+	return nil
+}
+
+// backoff is how long to wait after the given number of failed attempts.
+func (ws *WebhookService) backoff(attempts int) time.Duration {
+	wait := ws.Config.RetryBackoff
+	for i := 1; i < attempts && wait < ws.Config.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > ws.Config.MaxBackoff {
+		wait = ws.Config.MaxBackoff
+	}
+	return wait
+}
+
+// send posts the delivery's payload to the webhook. It returns the status
+// code of the response, or 0 if there was none, and an error unless the
+// endpoint accepted the payload with a 2xx response.
+func (ws *WebhookService) send(webhook *models.Webhook, delivery *models.WebhookDelivery) (int, error) {
+	body := []byte(delivery.Payload)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	ctx, cancel := context.WithTimeout(context.Background(), ws.Config.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", jsonapi.MediaType)
+	req.Header.Set("User-Agent", "frens-webhooks")
+	req.Header.Set(webhookEventHeader, delivery.Event)
+	req.Header.Set(webhookDeliveryHeader, strconv.FormatUint(uint64(delivery.ID), 10))
+	req.Header.Set(webhookTimestampHeader, timestamp)
+	req.Header.Set(webhookSignatureHeader, "sha256="+signWebhook(webhook.Secret, timestamp, body))
+
+	resp, err := ws.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("endpoint responded with %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// cleanupLoop removes finished deliveries that are older than the log
+// retention.
+func (ws *WebhookService) cleanupLoop() {
+	ticker := time.NewTicker(ws.Config.CleanupInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		err := ws.Database.Conn.
+			Where("status <> ? AND updated_at < ?", models.DeliveryPending, time.Now().Add(-ws.Config.LogRetention)).
+			Delete(&models.WebhookDelivery{}).Error
+		if err != nil {
+			log.Println("Failed to clean up webhook deliveries:", err)
+		}
+	}
+}